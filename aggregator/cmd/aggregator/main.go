@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	aggregator "github.com/XaviFP/notifications/aggregator/internal"
+	"github.com/XaviFP/notifications/migrations"
 	_ "github.com/lib/pq"
 	"github.com/tilinna/clock"
 )
@@ -18,6 +28,17 @@ var dbUser = flag.String("dbUser", "y", "Database user")
 var dbPassword = flag.String("dbPassword", "y", "Database password")
 var dbName = flag.String("dbName", "y", "Database name")
 var dbSSLMode = flag.String("dbSSLMode", "disable", "SSL mode for DB connection")
+var maxTitle = flag.Int("maxTitle", aggregator.DefaultValidationRules.MaxTitleLength, "Maximum title length, 0 for no limit")
+var maxBody = flag.Int("maxBody", aggregator.DefaultValidationRules.MaxBodyLength, "Maximum body length, 0 for no limit")
+var stripHTML = flag.Bool("stripHTML", aggregator.DefaultValidationRules.StripHTML, "Remove HTML markup from titles and bodies")
+var auth = flag.Bool("auth", true, "Require journalists to publish with their API token")
+var moderationRules = flag.String("moderation", "", "JSON file with the moderation rules, no moderation if empty")
+var rateLimit = flag.Float64("rateLimit", aggregator.DefaultLimits.RatePerMinute, "Articles and changes accepted per minute from each journalist, 0 for no limit")
+var rateBurst = flag.Int("rateBurst", aggregator.DefaultLimits.Burst, "Articles and changes accepted at once from each journalist")
+var dailyQuota = flag.Int("dailyQuota", aggregator.DefaultLimits.DailyQuota, "Articles stored per day from each journalist, 0 for no limit")
+var review = flag.Bool("review", false, "Hold articles until an editor approves them")
+var shutdownTimeout = flag.Duration("shutdownTimeout", 10*time.Second, "Time given to publishers to finish on shutdown")
+var migrateOnStart = flag.Bool("migrate", true, "Apply pending schema migrations at startup")
 
 func main() {
 	flag.Parse()
@@ -34,10 +55,173 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if flag.Arg(0) == "migrate" {
+		migrate(db)
+		return
+	}
+	if *migrateOnStart {
+		migrate(db)
+	}
+
 	articleRepo := aggregator.NewArticleRepository(db, clock.Realtime())
+	journalistRepo := aggregator.NewJournalistRepository(db)
+	categoryRepo := aggregator.NewCategoryRepository(db)
+
+	if flag.Arg(0) == "add-journalist" || flag.Arg(0) == "add-editor" {
+		addJournalist(journalistRepo, strings.Join(flag.Args()[1:], " "), flag.Arg(0) == "add-editor")
+		return
+	}
+	if flag.Arg(0) == "set-limits" {
+		setLimits(journalistRepo, flag.Args()[1:])
+		return
+	}
+	if *review && !*auth {
+		log.Fatal("reviews need editors, they can't be required without authentication")
+	}
+	if !*auth {
+		log.Println("authentication disabled, anyone can publish")
+		journalistRepo = nil
+	}
+
+	rules := aggregator.DefaultValidationRules
+	rules.MaxTitleLength = *maxTitle
+	rules.MaxBodyLength = *maxBody
+	// Categories are looked up in the taxonomy, however long their names
+	rules.MaxCategoryLength = 0
+	rules.StripHTML = *stripHTML
+
+	var moderator *aggregator.Moderator
+	if *moderationRules != "" {
+		moderator = aggregator.NewModerator(aggregator.NewModerationRepository(db), loadModerationRules(*moderationRules))
+	}
+
+	limiter := aggregator.NewLimiter(aggregator.NewQuotaRepository(db), aggregator.Limits{
+		RatePerMinute: *rateLimit,
+		Burst:         *rateBurst,
+		DailyQuota:    *dailyQuota,
+	}, clock.Realtime())
+
+	scheduler := aggregator.NewScheduler(articleRepo, clock.Realtime())
+	scheduler.Run()
 
-	s := aggregator.NewServer(articleRepo)
+	s := aggregator.NewServer(articleRepo, journalistRepo, categoryRepo, scheduler, rules, moderator, limiter, *review)
 	s.RegistersRoutes()
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	srv := &http.Server{Addr: *addr}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections first, then let publishers finish
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("error shutting down http server:", err)
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println("error shutting down publishers:", err)
+	}
+	scheduler.Stop()
+	if err := db.Close(); err != nil {
+		log.Println("error closing database:", err)
+	}
+}
+
+// addJournalist creates a journalist, or an editor, and prints the token
+// it publishes with, which isn't shown again.
+func addJournalist(repo aggregator.JournalistRepository, name string, editor bool) {
+	add, role := aggregator.AddJournalist, "Journalist"
+	if editor {
+		add, role = aggregator.AddEditor, "Editor"
+	}
+
+	j, token, err := add(repo, name)
+	if err != nil {
+		log.Fatal("error adding journalist: ", err)
+	}
+
+	fmt.Printf("%s %q added with id %d. Token:\n%s\n", role, j.Name, j.ID, token)
+}
+
+// setLimits gives the journalist with the id in args its own limits, as
+// rate=… burst=… quota=… arguments, or the defaults back with "default".
+// Limits left out of the arguments keep the defaults set by the flags.
+func setLimits(repo aggregator.JournalistRepository, args []string) {
+	usage := "usage: set-limits <journalist id> (rate=<per minute> burst=<n> quota=<per day> | default)"
+	if len(args) < 2 {
+		log.Fatal(usage)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatal(usage)
+	}
+
+	var limits *aggregator.Limits
+	if args[1] != "default" {
+		limits = &aggregator.Limits{
+			RatePerMinute: *rateLimit,
+			Burst:         *rateBurst,
+			DailyQuota:    *dailyQuota,
+		}
+		for _, arg := range args[1:] {
+			name, value, _ := strings.Cut(arg, "=")
+			switch name {
+			case "rate":
+				limits.RatePerMinute, err = strconv.ParseFloat(value, 64)
+			case "burst":
+				limits.Burst, err = strconv.Atoi(value)
+			case "quota":
+				limits.DailyQuota, err = strconv.Atoi(value)
+			default:
+				err = fmt.Errorf("unknown limit %q", name)
+			}
+			if err != nil {
+				log.Fatalf("%v\n%s", err, usage)
+			}
+		}
+	}
+
+	err = aggregator.SetLimits(repo, id, limits)
+	if err != nil {
+		log.Fatal("error setting limits: ", err)
+	}
+
+	fmt.Printf("Limits of journalist %d set\n", id)
+}
+
+// loadModerationRules reads the moderation rules from the file at path.
+func loadModerationRules(path string) []aggregator.ModerationRule {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal("error opening moderation rules: ", err)
+	}
+	defer f.Close()
+
+	rules, err := aggregator.LoadModerationRules(f)
+	if err != nil {
+		log.Fatal("error loading moderation rules: ", err)
+	}
+	log.Printf("moderating articles with %d rules", len(rules))
+
+	return rules
+}
+
+// migrate applies the schema migrations the database is missing.
+func migrate(db *sql.DB) {
+	applied, err := migrations.Up(context.Background(), db)
+	if err != nil {
+		log.Fatal("error migrating database: ", err)
+	}
+	for _, m := range applied {
+		log.Println("applied migration", m)
+	}
 }
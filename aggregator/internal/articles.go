@@ -0,0 +1,362 @@
+package aggregator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxBatchSize is the number of articles accepted in a batch.
+	maxBatchSize = 500
+	// maxRequestSize bounds the bodies of the ingestion endpoints.
+	maxRequestSize = 4 << 20
+)
+
+type storedPayload struct {
+	ArticleID int64 `json:"article_id"`
+	// Status is in_review when the article is held for an editor.
+	Status string `json:"status,omitempty"`
+}
+
+type failurePayload struct {
+	Error *errorPayload `json:"error"`
+}
+
+type articleResult struct {
+	Index     int           `json:"index"`
+	ArticleID int64         `json:"article_id,omitempty"`
+	Status    string        `json:"status,omitempty"`
+	Error     *errorPayload `json:"error,omitempty"`
+}
+
+var methodNotAllowedError = &errorPayload{Code: errCodeInvalidMessage, Message: "Method not allowed"}
+
+type batchPayload struct {
+	Results []articleResult `json:"results"`
+}
+
+// postArticle handles POST /articles, storing the article in the body.
+func (s *Server) postArticle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, failurePayload{Error: methodNotAllowedError})
+		return
+	}
+
+	author, err := s.authenticate(r)
+	if err != nil {
+		writeAuthFailure(w, err)
+		return
+	}
+	client := newClient(author, r)
+	if errPayload := s.throttle(client); errPayload != nil {
+		writeFailure(w, errPayload)
+		return
+	}
+
+	var a Article
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&a)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, failurePayload{Error: malformedError})
+		return
+	}
+
+	id, status, errPayload := s.store(client, a)
+	if errPayload != nil {
+		writeFailure(w, errPayload)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, storedPayload{ArticleID: id, Status: status})
+}
+
+// changeArticle handles the articles of the journalist:
+//
+//	GET    /articles/{id}         the article with its status and review note
+//	PUT    /articles/{id}         replaces the article with the one in the body
+//	POST   /articles/{id}/submit  submits a draft
+//	DELETE /articles/{id}         retracts the article
+//
+// Journalists may only see and change their own articles. Changes count
+// against their rate limit.
+func (s *Server) changeArticle(w http.ResponseWriter, r *http.Request) {
+	path, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/articles/"), "/")
+	if action != "" && action != "submit" {
+		writeFailure(w, notFoundError)
+		return
+	}
+	allowed := r.Method == http.MethodGet || r.Method == http.MethodPut || r.Method == http.MethodDelete
+	if action == "submit" {
+		allowed = r.Method == http.MethodPost
+	}
+	if !allowed {
+		writeJSON(w, http.StatusMethodNotAllowed, failurePayload{Error: methodNotAllowedError})
+		return
+	}
+
+	author, err := s.authenticate(r)
+	if err != nil {
+		writeAuthFailure(w, err)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		if errPayload := s.throttle(newClient(author, r)); errPayload != nil {
+			writeFailure(w, errPayload)
+			return
+		}
+	}
+
+	id, err := strconv.ParseInt(path, 10, 64)
+	if err != nil || id <= 0 {
+		writeFailure(w, notFoundError)
+		return
+	}
+
+	var errPayload *errorPayload
+	switch r.Method {
+	case http.MethodGet:
+		a, err := s.articleRepo.stored(id, author.id())
+		if err == nil {
+			writeJSON(w, http.StatusOK, a)
+			return
+		}
+		errPayload = changeError(err)
+	case http.MethodPost:
+		errPayload = s.submit(author, id)
+	case http.MethodDelete:
+		errPayload = s.retract(author, id)
+	default:
+		var a Article
+		err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&a)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, failurePayload{Error: malformedError})
+			return
+		}
+		errPayload = s.update(author, id, a)
+	}
+	if errPayload != nil {
+		writeFailure(w, errPayload)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, storedPayload{ArticleID: id})
+}
+
+// writeFailure answers with the status matching the error, telling
+// limited clients when to retry.
+func writeFailure(w http.ResponseWriter, errPayload *errorPayload) {
+	status := http.StatusUnprocessableEntity
+	switch errPayload.Code {
+	case errCodeStorage:
+		status = http.StatusInternalServerError
+	case errCodeNotFound:
+		status = http.StatusNotFound
+	case errCodeRateLimited, errCodeQuotaExceeded:
+		status = http.StatusTooManyRequests
+	}
+	if errPayload.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(errPayload.RetryAfter))
+	}
+
+	writeJSON(w, status, failurePayload{Error: errPayload})
+}
+
+// postBatch handles POST /articles:batch. The body is either a JSON array
+// of articles or one article per line (NDJSON). The articles passing
+// validation and moderation are stored in a single transaction and every
+// article gets a result, in the order they were sent. They're all rejected
+// when they don't fit in the daily quota.
+func (s *Server) postBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, failurePayload{Error: methodNotAllowedError})
+		return
+	}
+
+	author, err := s.authenticate(r)
+	if err != nil {
+		writeAuthFailure(w, err)
+		return
+	}
+	client := newClient(author, r)
+
+	items, err := readBatch(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if errors.Is(err, errBatchTooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, failurePayload{Error: &errorPayload{Code: errCodeInvalidMessage, Message: err.Error()}})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, failurePayload{Error: malformedError})
+		return
+	}
+	// Every article costs a token, empty batches cost one like any request
+	tokens := len(items)
+	if tokens == 0 {
+		tokens = 1
+	}
+	if errPayload := s.throttleN(client, tokens); errPayload != nil {
+		writeFailure(w, errPayload)
+		return
+	}
+
+	results := make([]articleResult, len(items))
+	var valid []Article
+	var validIndexes []int
+	var decisions []ModerationDecision
+	// Retries of the same article in the batch are stored once and count
+	// once against the quota.
+	externalIDs := make(map[string]struct{})
+	fresh := 0
+	for i, item := range items {
+		results[i].Index = i
+		if item == nil {
+			results[i].Error = malformedError
+			continue
+		}
+
+		a, errPayload := s.validate(author, *item)
+		if errPayload != nil {
+			results[i].Error = errPayload
+			continue
+		}
+		id, errPayload := s.retried(a)
+		if id != 0 || errPayload != nil {
+			results[i].ArticleID, results[i].Error = id, errPayload
+			continue
+		}
+		a, decision, errPayload := s.moderate(a, false)
+		if errPayload != nil {
+			s.moderator.record(decision)
+			results[i].Error = errPayload
+			continue
+		}
+		valid = append(valid, a)
+		validIndexes = append(validIndexes, i)
+		decisions = append(decisions, decision)
+		if _, ok := externalIDs[a.ExternalID]; !ok || a.ExternalID == "" {
+			fresh++
+		}
+		externalIDs[a.ExternalID] = struct{}{}
+	}
+
+	if len(valid) > 0 {
+		release, errPayload := s.reserveQuota(client, fresh)
+		if errPayload != nil {
+			for j, i := range validIndexes {
+				results[i].Error = errPayload
+				s.moderator.record(decisions[j])
+			}
+			status := http.StatusInternalServerError
+			if errPayload.Code == errCodeQuotaExceeded {
+				status = http.StatusTooManyRequests
+				w.Header().Set("Retry-After", strconv.Itoa(errPayload.RetryAfter))
+			}
+			writeJSON(w, status, batchPayload{Results: results})
+			return
+		}
+
+		ids, err := s.articleRepo.storeBatch(valid)
+		s.scheduler.Wake()
+		if err != nil {
+			release()
+		}
+		for j, i := range validIndexes {
+			if err != nil {
+				results[i].Error = storageError
+			} else {
+				results[i].ArticleID = ids[j]
+				results[i].Status = reviewStatus(valid[j])
+				decisions[j].ArticleID = ids[j]
+			}
+			s.moderator.record(decisions[j])
+		}
+		if err != nil {
+			log.Println("error storing batch:", err)
+			writeJSON(w, http.StatusInternalServerError, batchPayload{Results: results})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, batchPayload{Results: results})
+}
+
+var errBatchTooLarge = fmt.Errorf("batches hold at most %d articles", maxBatchSize)
+
+// readBatch decodes a JSON array or NDJSON body. Malformed NDJSON lines
+// are returned as nil so they can be reported individually.
+func readBatch(body io.Reader) ([]*Article, error) {
+	br := bufio.NewReader(body)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*Article
+	if first == '[' {
+		err := json.NewDecoder(br).Decode(&items)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) > maxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		for i := range items {
+			if items[i] == nil {
+				items[i] = &Article{}
+			}
+		}
+
+		return items, nil
+	}
+
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), maxRequestSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == maxBatchSize {
+			return nil, errBatchTooLarge
+		}
+
+		var a Article
+		if err := json.Unmarshal(line, &a); err != nil {
+			items = append(items, nil)
+			continue
+		}
+		items = append(items, &a)
+	}
+
+	return items, scanner.Err()
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+
+		return b, br.UnreadByte()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("write error:", err)
+	}
+}
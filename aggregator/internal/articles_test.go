@@ -0,0 +1,253 @@
+package aggregator
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_PostArticle(t *testing.T) {
+	repo := &mockArticleRepository{done: make(chan struct{}, 2)}
+	repo.On("store", Article{Title: "title", Body: "body"}).Return(int64(1), nil)
+	repo.On("store", Article{Title: "failing", Body: "body"}).Return(int64(0), errors.New("connection refused"))
+
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, nil, nil, false)
+
+	tests := map[string]struct {
+		method   string
+		body     string
+		status   int
+		expected string
+	}{
+		"stored": {
+			method:   http.MethodPost,
+			body:     `{"title": " title ", "body": "body"}`,
+			status:   http.StatusCreated,
+			expected: `{"article_id": 1}`,
+		},
+		"invalid": {
+			method:   http.MethodPost,
+			body:     `{"body": "body"}`,
+			status:   http.StatusUnprocessableEntity,
+			expected: `{"error": {"code": "invalid_article", "message": "title is required", "field": "title"}}`,
+		},
+		"malformed": {
+			method:   http.MethodPost,
+			body:     `{"title": `,
+			status:   http.StatusBadRequest,
+			expected: `{"error": {"code": "invalid_message", "message": "Malformed message"}}`,
+		},
+		"storage error": {
+			method:   http.MethodPost,
+			body:     `{"title": "failing", "body": "body"}`,
+			status:   http.StatusInternalServerError,
+			expected: `{"error": {"code": "storage_error", "message": "Article could not be stored"}}`,
+		},
+		"method not allowed": {
+			method:   http.MethodGet,
+			status:   http.StatusMethodNotAllowed,
+			expected: `{"error": {"code": "invalid_message", "message": "Method not allowed"}}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.postArticle(w, httptest.NewRequest(tt.method, "/articles", strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	repo.AssertExpectations(t)
+}
+
+func TestServer_ChangeArticle(t *testing.T) {
+	repo := &mockArticleRepository{}
+	repo.On("update", int64(1), Article{Title: "fixed", Body: "body"}).Return(nil)
+	repo.On("update", int64(2), Article{Title: "fixed", Body: "body"}).Return(errArticleNotFound)
+	repo.On("retract", int64(1), int64(0)).Return(nil)
+	repo.On("retract", int64(3), int64(0)).Return(errors.New("connection refused"))
+	repo.On("submit", int64(1), int64(0), false).Return(nil)
+	repo.On("submit", int64(2), int64(0), false).Return(errArticleNotFound)
+	repo.On("stored", int64(1), int64(0)).Return(StoredArticle{
+		ID:         1,
+		Article:    Article{Title: "title", Body: "body", Draft: true},
+		Status:     statusDraft,
+		ReviewNote: "Needs a source",
+	}, nil)
+	repo.On("stored", int64(2), int64(0)).Return(StoredArticle{}, errArticleNotFound)
+
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, nil, nil, false)
+
+	tests := map[string]struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		"updated": {
+			method:   http.MethodPut,
+			path:     "/articles/1",
+			body:     `{"title": "fixed", "body": "body"}`,
+			status:   http.StatusOK,
+			expected: `{"article_id": 1}`,
+		},
+		"update not found": {
+			method:   http.MethodPut,
+			path:     "/articles/2",
+			body:     `{"title": "fixed", "body": "body"}`,
+			status:   http.StatusNotFound,
+			expected: `{"error": {"code": "not_found", "message": "Article not found"}}`,
+		},
+		"invalid update": {
+			method:   http.MethodPut,
+			path:     "/articles/1",
+			body:     `{"body": "body"}`,
+			status:   http.StatusUnprocessableEntity,
+			expected: `{"error": {"code": "invalid_article", "message": "title is required", "field": "title"}}`,
+		},
+		"malformed update": {
+			method:   http.MethodPut,
+			path:     "/articles/1",
+			body:     `{"title": `,
+			status:   http.StatusBadRequest,
+			expected: `{"error": {"code": "invalid_message", "message": "Malformed message"}}`,
+		},
+		"retracted": {
+			method:   http.MethodDelete,
+			path:     "/articles/1",
+			status:   http.StatusOK,
+			expected: `{"article_id": 1}`,
+		},
+		"storage error": {
+			method:   http.MethodDelete,
+			path:     "/articles/3",
+			status:   http.StatusInternalServerError,
+			expected: `{"error": {"code": "storage_error", "message": "Article could not be stored"}}`,
+		},
+		"invalid id": {
+			method:   http.MethodDelete,
+			path:     "/articles/japan",
+			status:   http.StatusNotFound,
+			expected: `{"error": {"code": "not_found", "message": "Article not found"}}`,
+		},
+		"stored": {
+			method:   http.MethodGet,
+			path:     "/articles/1",
+			status:   http.StatusOK,
+			expected: `{"id": 1, "title": "title", "body": "body", "category": "", "draft": true, "status": "draft", "review_note": "Needs a source"}`,
+		},
+		"stored not found": {
+			method:   http.MethodGet,
+			path:     "/articles/2",
+			status:   http.StatusNotFound,
+			expected: `{"error": {"code": "not_found", "message": "Article not found"}}`,
+		},
+		"submitted": {
+			method:   http.MethodPost,
+			path:     "/articles/1/submit",
+			status:   http.StatusOK,
+			expected: `{"article_id": 1}`,
+		},
+		"submit not a draft": {
+			method:   http.MethodPost,
+			path:     "/articles/2/submit",
+			status:   http.StatusNotFound,
+			expected: `{"error": {"code": "not_found", "message": "Article not found"}}`,
+		},
+		"unknown action": {
+			method:   http.MethodPost,
+			path:     "/articles/1/publish",
+			status:   http.StatusNotFound,
+			expected: `{"error": {"code": "not_found", "message": "Article not found"}}`,
+		},
+		"method not allowed": {
+			method:   http.MethodPost,
+			path:     "/articles/1",
+			status:   http.StatusMethodNotAllowed,
+			expected: `{"error": {"code": "invalid_message", "message": "Method not allowed"}}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.changeArticle(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	repo.AssertExpectations(t)
+}
+
+func TestServer_PostBatch(t *testing.T) {
+	repo := &mockArticleRepository{}
+	repo.On("storeBatch", []Article{{Title: "first"}, {Title: "third"}}).Return([]int64{1, 2}, nil)
+	repo.On("storeBatch", []Article{{Title: "failing"}}).Return(nil, errors.New("connection refused"))
+
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, nil, nil, false)
+
+	tests := map[string]struct {
+		body     string
+		status   int
+		expected string
+	}{
+		"json": {
+			body:   `[{"title": "first"}, {"title": ""}, {"title": "third"}]`,
+			status: http.StatusOK,
+			expected: `{"results": [
+				{"index": 0, "article_id": 1},
+				{"index": 1, "error": {"code": "invalid_article", "message": "title is required", "field": "title"}},
+				{"index": 2, "article_id": 2}
+			]}`,
+		},
+		"ndjson": {
+			body:   "{\"title\": \"first\"}\n{\"title\": \n\n{\"title\": \"third\"}\n",
+			status: http.StatusOK,
+			expected: `{"results": [
+				{"index": 0, "article_id": 1},
+				{"index": 1, "error": {"code": "invalid_message", "message": "Malformed message"}},
+				{"index": 2, "article_id": 2}
+			]}`,
+		},
+		"storage error": {
+			body:   `[{"title": "failing"}, {}]`,
+			status: http.StatusInternalServerError,
+			expected: `{"results": [
+				{"index": 0, "error": {"code": "storage_error", "message": "Article could not be stored"}},
+				{"index": 1, "error": {"code": "invalid_article", "message": "title is required", "field": "title"}}
+			]}`,
+		},
+		"malformed": {
+			body:     `[{"title": "first"}`,
+			status:   http.StatusBadRequest,
+			expected: `{"error": {"code": "invalid_message", "message": "Malformed message"}}`,
+		},
+		"too large": {
+			body:     strings.Repeat("{}\n", maxBatchSize+1),
+			status:   http.StatusRequestEntityTooLarge,
+			expected: `{"error": {"code": "invalid_message", "message": "batches hold at most 500 articles"}}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.postBatch(w, httptest.NewRequest(http.MethodPost, "/articles:batch", strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	repo.AssertExpectations(t)
+}
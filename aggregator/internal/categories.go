@@ -0,0 +1,46 @@
+package aggregator
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var errCategoryNotFound = errors.New("category not found")
+
+type CategoryRepository interface {
+	resolveCategory(category string) (string, error)
+}
+
+type categoryRepository struct {
+	db *sql.DB
+}
+
+func NewCategoryRepository(db *sql.DB) CategoryRepository {
+	return &categoryRepository{
+		db: db,
+	}
+}
+
+// resolveCategory returns the slug of the category whose slug, display name
+// or alias is the given one, regardless of case. Slugs win over names and
+// names over aliases.
+func (r *categoryRepository) resolveCategory(category string) (string, error) {
+	var slug string
+	err := r.db.QueryRow(`
+		SELECT slug FROM (
+			SELECT slug, 1 AS priority FROM categories WHERE slug = LOWER($1)
+			UNION ALL
+			SELECT slug, 2 FROM categories WHERE LOWER(name) = LOWER($1)
+			UNION ALL
+			SELECT slug, 3 FROM category_aliases WHERE alias = LOWER($1)
+		) matches
+		ORDER BY priority
+		LIMIT 1`,
+		category,
+	).Scan(&slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errCategoryNotFound
+	}
+
+	return slug, err
+}
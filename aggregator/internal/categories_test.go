@@ -0,0 +1,75 @@
+package aggregator
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestServer_Categories(t *testing.T) {
+	repo := &mockArticleRepository{done: make(chan struct{}, 2)}
+	repo.On("store", Article{Title: "title", Category: "technology"}).Return(int64(1), nil)
+	repo.On("store", Article{Title: "title", Category: "international-politics"}).Return(int64(2), nil)
+
+	categories := &mockCategoryRepository{}
+	categories.On("resolveCategory", "Tech").Return("technology", nil)
+	categories.On("resolveCategory", "Sports").Return("", errCategoryNotFound)
+	categories.On("resolveCategory", "Travel").Return("", errors.New("connection refused"))
+	categories.On("resolveCategory", "International politics").Return("international-politics", nil)
+
+	srv := NewServer(repo, nil, categories, nil, ValidationRules{RequireTitle: true}, nil, nil, false)
+
+	tests := map[string]struct {
+		body     string
+		status   int
+		expected string
+	}{
+		"mapped": {
+			body:     `{"title": "title", "category": " Tech "}`,
+			status:   http.StatusCreated,
+			expected: `{"article_id": 1}`,
+		},
+		"long name": {
+			body:     `{"title": "title", "category": "International politics"}`,
+			status:   http.StatusCreated,
+			expected: `{"article_id": 2}`,
+		},
+		"unknown": {
+			body:     `{"title": "title", "category": "Sports"}`,
+			status:   http.StatusUnprocessableEntity,
+			expected: `{"error": {"code": "invalid_article", "message": "category is unknown", "field": "category"}}`,
+		},
+		"storage error": {
+			body:     `{"title": "title", "category": "Travel"}`,
+			status:   http.StatusInternalServerError,
+			expected: `{"error": {"code": "storage_error", "message": "Article could not be stored"}}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.postArticle(w, httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	repo.AssertExpectations(t)
+	categories.AssertExpectations(t)
+}
+
+type mockCategoryRepository struct {
+	mock.Mock
+}
+
+func (m *mockCategoryRepository) resolveCategory(category string) (string, error) {
+	args := m.Called(category)
+	return args.String(0), args.Error(1)
+}
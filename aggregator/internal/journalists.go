@@ -0,0 +1,196 @@
+package aggregator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Journalist is an author allowed to publish articles. Editors also review
+// the articles of the others.
+type Journalist struct {
+	ID     int64
+	Name   string
+	Editor bool
+	// Limits replace the aggregator's default limits when set.
+	Limits *Limits
+}
+
+// id returns the id of the journalist, 0 for anonymous articles when it's
+// nil.
+func (j *Journalist) id() int64 {
+	if j == nil {
+		return 0
+	}
+
+	return j.ID
+}
+
+var errJournalistNotFound = errors.New("journalist not found")
+
+type JournalistRepository interface {
+	create(name string, tokenHash string, editor bool) (Journalist, error)
+	journalistByToken(tokenHash string) (Journalist, error)
+	setLimits(journalistID int64, limits *Limits) error
+}
+
+type journalistRepository struct {
+	db *sql.DB
+}
+
+func NewJournalistRepository(db *sql.DB) JournalistRepository {
+	return &journalistRepository{
+		db: db,
+	}
+}
+
+func (r *journalistRepository) create(name string, tokenHash string, editor bool) (Journalist, error) {
+	j := Journalist{Name: name, Editor: editor}
+	err := r.db.QueryRow(`
+		INSERT INTO journalists (name, token_hash, editor)
+		VALUES ($1, $2, $3)
+		RETURNING id`,
+		name,
+		tokenHash,
+		editor,
+	).Scan(&j.ID)
+
+	return j, err
+}
+
+func (r *journalistRepository) journalistByToken(tokenHash string) (Journalist, error) {
+	var j Journalist
+	var rate sql.NullFloat64
+	var burst, quota sql.NullInt32
+	err := r.db.QueryRow(`
+		SELECT j.id, j.name, j.editor, l.rate_per_minute, l.burst, l.daily_quota
+		FROM journalists j
+		LEFT JOIN journalist_limits l ON l.journalist_id = j.id
+		WHERE j.token_hash = $1`,
+		tokenHash,
+	).Scan(&j.ID, &j.Name, &j.Editor, &rate, &burst, &quota)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Journalist{}, errJournalistNotFound
+	}
+	if rate.Valid {
+		j.Limits = &Limits{RatePerMinute: rate.Float64, Burst: int(burst.Int32), DailyQuota: int(quota.Int32)}
+	}
+
+	return j, err
+}
+
+func (r *journalistRepository) setLimits(journalistID int64, limits *Limits) error {
+	if limits == nil {
+		_, err := r.db.Exec(`DELETE FROM journalist_limits WHERE journalist_id = $1`, journalistID)
+		return err
+	}
+
+	res, err := r.db.Exec(`
+		INSERT INTO journalist_limits (journalist_id, rate_per_minute, burst, daily_quota)
+		SELECT id, $2, $3, $4
+		FROM journalists
+		WHERE id = $1
+		ON CONFLICT (journalist_id) DO UPDATE
+		SET rate_per_minute = EXCLUDED.rate_per_minute,
+			burst = EXCLUDED.burst,
+			daily_quota = EXCLUDED.daily_quota`,
+		journalistID,
+		limits.RatePerMinute,
+		limits.Burst,
+		limits.DailyQuota,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errJournalistNotFound
+	}
+
+	return nil
+}
+
+// AddJournalist creates a journalist and returns the API token it
+// publishes with. Only a hash of the token is stored, it can't be
+// recovered later.
+func AddJournalist(r JournalistRepository, name string) (Journalist, string, error) {
+	return addJournalist(r, name, false)
+}
+
+// AddEditor creates a journalist who also reviews articles, returning its
+// API token like AddJournalist.
+func AddEditor(r JournalistRepository, name string) (Journalist, string, error) {
+	return addJournalist(r, name, true)
+}
+
+func addJournalist(r JournalistRepository, name string, editor bool) (Journalist, string, error) {
+	name = normalizeLine(name)
+	if name == "" {
+		return Journalist{}, "", &ValidationError{Field: "name", Reason: "is required"}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Journalist{}, "", err
+	}
+	token := hex.EncodeToString(b)
+
+	j, err := r.create(name, hashToken(token), editor)
+	if err != nil {
+		return Journalist{}, "", err
+	}
+
+	return j, token, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	errMissingToken = errors.New("missing token")
+	unauthorized    = &errorPayload{Code: "unauthorized", Message: "Unauthorized"}
+)
+
+// authenticate returns the journalist owning the bearer token of the
+// request. Without a journalist repository, requests are published
+// anonymously.
+func (s *Server) authenticate(r *http.Request) (*Journalist, error) {
+	if s.journalistRepo == nil {
+		return nil, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errMissingToken
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	j, err := s.journalistRepo.journalistByToken(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// writeAuthFailure answers a request that couldn't be authenticated,
+// telling missing or unknown tokens apart from failing to look them up.
+func writeAuthFailure(w http.ResponseWriter, err error) {
+	if errors.Is(err, errMissingToken) || errors.Is(err, errJournalistNotFound) {
+		writeJSON(w, http.StatusUnauthorized, failurePayload{Error: unauthorized})
+		return
+	}
+
+	log.Println("error authenticating journalist:", err)
+	writeFailure(w, storageError)
+}
@@ -0,0 +1,117 @@
+package aggregator
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAddJournalist(t *testing.T) {
+	repo := &mockJournalistRepository{}
+	var hash string
+	repo.On("create", "Alice Smith", mock.Anything, false).
+		Run(func(args mock.Arguments) { hash = args.String(1) }).
+		Return(Journalist{ID: 1, Name: "Alice Smith"}, nil)
+
+	j, token, err := AddJournalist(repo, "  Alice \n Smith ")
+	assert.Nil(t, err)
+	assert.Equal(t, Journalist{ID: 1, Name: "Alice Smith"}, j)
+	assert.Len(t, token, 64)
+	assert.Equal(t, hashToken(token), hash)
+
+	_, _, err = AddJournalist(repo, " ")
+	assert.Equal(t, &ValidationError{Field: "name", Reason: "is required"}, err)
+
+	repo.On("create", "Bob", mock.Anything, true).Return(Journalist{ID: 2, Name: "Bob", Editor: true}, nil)
+	j, _, err = AddEditor(repo, "Bob")
+	assert.Nil(t, err)
+	assert.True(t, j.Editor)
+}
+
+func TestServer_Authentication(t *testing.T) {
+	journalists := &mockJournalistRepository{}
+	journalists.On("journalistByToken", hashToken("secret")).Return(Journalist{ID: 7, Name: "Alice"}, nil)
+	journalists.On("journalistByToken", hashToken("unlucky")).Return(Journalist{}, errors.New("connection refused"))
+	journalists.On("journalistByToken", mock.Anything).Return(Journalist{}, errJournalistNotFound)
+
+	done := make(chan struct{}, 2)
+	articles := &mockArticleRepository{done: done}
+	articles.On("store", Article{Title: "title", AuthorID: 7}).Return(int64(1), nil)
+
+	srv := NewServer(articles, journalists, nil, nil, ValidationRules{}, nil, nil, false)
+	s := httptest.NewServer(http.HandlerFunc(srv.publish))
+	defer s.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	for _, header := range []http.Header{
+		nil,
+		{"Authorization": []string{"secret"}},
+		{"Authorization": []string{"Bearer wrong"}},
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		assert.Equal(t, websocket.ErrBadHandshake, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Tokens that can't be looked up aren't taken for wrong ones
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": []string{"Bearer unlucky"}})
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": []string{"Bearer secret"}})
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// The author comes from the token, not from the article sent
+	err = c.WriteJSON(map[string]interface{}{"message_id": "1", "title": "title", "AuthorID": 1})
+	assert.Nil(t, err)
+
+	var ack ackPayload
+	err = c.ReadJSON(&ack)
+	assert.Nil(t, err)
+	assert.Equal(t, ackPayload{MessageID: "1", ArticleID: 1}, ack)
+
+	w := httptest.NewRecorder()
+	srv.postArticle(w, httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(`{"title": "title"}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(`{"title": "title"}`))
+	req.Header.Set("Authorization", "Bearer unlucky")
+	w = httptest.NewRecorder()
+	srv.postArticle(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"error": {"code": "storage_error", "message": "Article could not be stored"}}`, w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(`{"title": "title"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	srv.postArticle(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	articles.AssertExpectations(t)
+}
+
+type mockJournalistRepository struct {
+	mock.Mock
+}
+
+func (m *mockJournalistRepository) create(name string, tokenHash string, editor bool) (Journalist, error) {
+	args := m.Called(name, tokenHash, editor)
+	return args.Get(0).(Journalist), args.Error(1)
+}
+
+func (m *mockJournalistRepository) journalistByToken(tokenHash string) (Journalist, error) {
+	args := m.Called(tokenHash)
+	return args.Get(0).(Journalist), args.Error(1)
+}
+
+func (m *mockJournalistRepository) setLimits(journalistID int64, limits *Limits) error {
+	return m.Called(journalistID, limits).Error(0)
+}
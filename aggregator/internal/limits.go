@@ -0,0 +1,299 @@
+package aggregator
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tilinna/clock"
+)
+
+// Limits bound how much a client publishes. Zero values don't limit.
+type Limits struct {
+	// RatePerMinute is how many publishing requests or frames are accepted
+	// per minute on average, in bursts of up to Burst. Each article of a
+	// batch counts as a request.
+	RatePerMinute float64
+	Burst         int
+	// DailyQuota is how many articles are stored per UTC day.
+	DailyQuota int
+}
+
+// DefaultLimits let the journalist client publish automatically, an
+// article every 2 seconds, but not much faster.
+var DefaultLimits = Limits{
+	RatePerMinute: 60,
+	Burst:         10,
+	DailyQuota:    1000,
+}
+
+// pruneInterval is how often buckets back to full are dropped, so
+// addresses seen once aren't kept forever.
+const pruneInterval = time.Minute
+
+var errQuotaExceeded = errors.New("daily quota exceeded")
+
+// client is who's publishing: a journalist, or an address when publishing
+// anonymously.
+type client struct {
+	author *Journalist
+	// key identifies the client to the rate limits and quotas.
+	key string
+}
+
+func newClient(author *Journalist, r *http.Request) client {
+	if author != nil {
+		return client{author: author, key: "journalist:" + strconv.FormatInt(author.ID, 10)}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return client{key: "ip:" + host}
+}
+
+type QuotaRepository interface {
+	reserve(client string, day time.Time, n int, quota int) (bool, error)
+	release(client string, day time.Time, n int) error
+}
+
+type quotaRepository struct {
+	db *sql.DB
+}
+
+func NewQuotaRepository(db *sql.DB) QuotaRepository {
+	return &quotaRepository{
+		db: db,
+	}
+}
+
+// reserve counts n articles of the client on day, telling whether they fit
+// in quota. Nothing is counted when they don't.
+func (r *quotaRepository) reserve(client string, day time.Time, n int, quota int) (bool, error) {
+	var articles int
+	err := r.db.QueryRow(`
+		INSERT INTO publishing_usage AS u (client, day, articles)
+		SELECT $1, $2, $3
+		WHERE $3 <= $4
+		ON CONFLICT (client, day) DO UPDATE
+		SET articles = u.articles + EXCLUDED.articles
+		WHERE u.articles + EXCLUDED.articles <= $4
+		RETURNING articles`,
+		client,
+		day,
+		n,
+		quota,
+	).Scan(&articles)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// release gives back articles reserved but not stored.
+func (r *quotaRepository) release(client string, day time.Time, n int) error {
+	_, err := r.db.Exec(`
+		UPDATE publishing_usage
+		SET articles = GREATEST(articles - $3, 0)
+		WHERE client = $1 AND day = $2`,
+		client,
+		day,
+		n,
+	)
+
+	return err
+}
+
+// Limiter enforces the rate limits and daily quotas of the clients. Rates
+// are kept in memory by each aggregator, quotas are shared through the
+// database.
+type Limiter struct {
+	quotaRepo QuotaRepository
+	defaults  Limits
+	clock     clock.Clock
+
+	mut     sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+// bucket holds the tokens of a client, one taken by each request.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is back to its burst.
+	full time.Time
+}
+
+// NewLimiter returns a limiter applying the limits journalists have, or
+// the defaults when they have none.
+func NewLimiter(quotaRepository QuotaRepository, defaults Limits, c clock.Clock) *Limiter {
+	return &Limiter{
+		quotaRepo: quotaRepository,
+		defaults:  defaults,
+		clock:     c,
+		buckets:   make(map[string]*bucket),
+		pruned:    c.Now(),
+	}
+}
+
+func (l *Limiter) limits(c client) Limits {
+	if c.author != nil && c.author.Limits != nil {
+		return *c.author.Limits
+	}
+
+	return l.defaults
+}
+
+// allow takes a token from the client's bucket. When it's empty, it
+// returns how long until there's one again. A nil limiter allows every
+// request.
+func (l *Limiter) allow(c client) (time.Duration, bool) {
+	return l.allowN(c, 1)
+}
+
+// allowN takes n tokens from the client's bucket, returning how long until
+// there are enough when there aren't. More tokens than the burst are taken
+// once the bucket is full, leaving it in debt, so large batches go through
+// but hold the client back for as long as they cost.
+func (l *Limiter) allowN(c client, n int) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	limits := l.limits(c)
+	if limits.RatePerMinute <= 0 {
+		return 0, true
+	}
+
+	perSecond := limits.RatePerMinute / 60
+	burst := math.Max(float64(limits.Burst), 1)
+	now := l.clock.Now()
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if now.Sub(l.pruned) >= pruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[c.key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[c.key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	need := math.Min(float64(n), burst)
+	if b.tokens < need {
+		return time.Duration((need - b.tokens) / perSecond * float64(time.Second)), false
+	}
+	b.tokens -= float64(n)
+	b.full = now.Add(time.Duration((burst - b.tokens) / perSecond * float64(time.Second)))
+
+	return 0, true
+}
+
+// prune drops the buckets back to full, they're created full again.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if !b.full.After(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruned = now
+}
+
+// reserve counts n articles against the client's daily quota before
+// they're stored, failing with errQuotaExceeded when they don't fit. The
+// returned function gives them back when they couldn't be stored.
+func (l *Limiter) reserve(c client, n int) (func(), error) {
+	if l == nil || l.limits(c).DailyQuota <= 0 {
+		return func() {}, nil
+	}
+
+	day := l.today()
+	ok, err := l.quotaRepo.reserve(c.key, day, n, l.limits(c).DailyQuota)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errQuotaExceeded
+	}
+
+	return func() {
+		err := l.quotaRepo.release(c.key, day, n)
+		if err != nil {
+			log.Println("error releasing quota:", err)
+		}
+	}, nil
+}
+
+func (l *Limiter) today() time.Time {
+	return l.clock.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// untilTomorrow is how long until quotas start over.
+func (l *Limiter) untilTomorrow() time.Duration {
+	return l.today().Add(24 * time.Hour).Sub(l.clock.Now())
+}
+
+// SetLimits gives a journalist other limits than the defaults, or the
+// defaults back when limits is nil.
+func SetLimits(r JournalistRepository, journalistID int64, limits *Limits) error {
+	if limits != nil && (limits.RatePerMinute < 0 || limits.Burst < 0 || limits.DailyQuota < 0) {
+		return &ValidationError{Field: "limits", Reason: "can't be negative"}
+	}
+
+	return r.setLimits(journalistID, limits)
+}
+
+// throttle takes a token from the client's bucket, describing the error
+// for the client when it's empty.
+func (s *Server) throttle(c client) *errorPayload {
+	return s.throttleN(c, 1)
+}
+
+// throttleN takes n tokens from the client's bucket, describing the error
+// for the client when there aren't enough.
+func (s *Server) throttleN(c client, n int) *errorPayload {
+	wait, ok := s.limiter.allowN(c, n)
+	if ok {
+		return nil
+	}
+
+	return &errorPayload{Code: errCodeRateLimited, Message: "Too many requests", RetryAfter: retryAfter(wait)}
+}
+
+// reserveQuota counts n articles against the client's daily quota,
+// describing the error for the client when they don't fit.
+func (s *Server) reserveQuota(c client, n int) (func(), *errorPayload) {
+	release, err := s.limiter.reserve(c, n)
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		return nil, &errorPayload{
+			Code:       errCodeQuotaExceeded,
+			Message:    fmt.Sprintf("Daily quota of %d articles reached", s.limiter.limits(c).DailyQuota),
+			RetryAfter: retryAfter(s.limiter.untilTomorrow()),
+		}
+	case err != nil:
+		log.Println("error reserving quota:", err)
+		return nil, storageError
+	}
+
+	return release, nil
+}
+
+// retryAfter rounds a wait up to whole seconds.
+func retryAfter(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
@@ -0,0 +1,233 @@
+package aggregator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tilinna/clock"
+)
+
+func TestLimiter(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewMock(start)
+
+	quotas := &mockQuotaRepository{}
+	quotas.On("reserve", "journalist:7", day, 2, 5).Return(true, nil).Once()
+	quotas.On("reserve", "journalist:7", day, 1, 5).Return(false, nil).Once()
+	quotas.On("release", "journalist:7", day, 2).Return(nil).Once()
+
+	l := NewLimiter(quotas, Limits{RatePerMinute: 60, Burst: 2, DailyQuota: 5}, clk)
+	anonymous := client{key: "ip:192.0.2.1"}
+	journalist := client{author: &Journalist{ID: 7}, key: "journalist:7"}
+	unlimited := client{author: &Journalist{ID: 8, Limits: &Limits{}}, key: "journalist:8"}
+
+	// Bursts are allowed, then a request per second
+	for i := 0; i < 2; i++ {
+		_, ok := l.allow(anonymous)
+		assert.True(t, ok)
+	}
+	wait, ok := l.allow(anonymous)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	clk.Add(500 * time.Millisecond)
+	wait, ok = l.allow(anonymous)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	clk.Add(500 * time.Millisecond)
+	_, ok = l.allow(anonymous)
+	assert.True(t, ok)
+
+	// Clients have buckets of their own
+	_, ok = l.allow(journalist)
+	assert.True(t, ok)
+	for i := 0; i < 100; i++ {
+		_, ok = l.allow(unlimited)
+		assert.True(t, ok)
+	}
+
+	// Full buckets are dropped
+	clk.Add(time.Minute)
+	_, ok = l.allow(journalist)
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1)
+
+	release, err := l.reserve(journalist, 2)
+	assert.Nil(t, err)
+	_, err = l.reserve(journalist, 1)
+	assert.Equal(t, errQuotaExceeded, err)
+	release()
+
+	// Without quota nothing is counted
+	_, err = l.reserve(unlimited, 1)
+	assert.Nil(t, err)
+
+	var none *Limiter
+	_, ok = none.allow(anonymous)
+	assert.True(t, ok)
+	_, err = none.reserve(anonymous, 1)
+	assert.Nil(t, err)
+
+	quotas.AssertExpectations(t)
+}
+
+func TestLimiter_Batches(t *testing.T) {
+	clk := clock.NewMock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	l := NewLimiter(nil, Limits{RatePerMinute: 60, Burst: 10}, clk)
+	c := client{key: "ip:192.0.2.1"}
+
+	// Each article takes a token
+	_, ok := l.allowN(c, 4)
+	assert.True(t, ok)
+	_, ok = l.allowN(c, 6)
+	assert.True(t, ok)
+	wait, ok := l.allowN(c, 2)
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+
+	// Batches over the burst wait for a full bucket and leave it in debt
+	clk.Add(5 * time.Second)
+	wait, ok = l.allowN(c, 30)
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Second, wait)
+
+	clk.Add(5 * time.Second)
+	_, ok = l.allowN(c, 30)
+	assert.True(t, ok)
+	wait, ok = l.allow(c)
+	assert.False(t, ok)
+	assert.Equal(t, 21*time.Second, wait)
+}
+
+func TestServer_Limits(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewMock(start)
+
+	quotas := &mockQuotaRepository{}
+	quotas.On("reserve", "ip:192.0.2.1", day, 1, 1).Return(true, nil).Once()
+	quotas.On("reserve", "ip:192.0.2.1", day, 1, 1).Return(false, nil).Once()
+	quotas.On("reserve", "ip:198.51.100.1", day, 2, 1).Return(false, nil).Once()
+
+	repo := &mockArticleRepository{done: make(chan struct{}, 1)}
+	repo.On("store", Article{Title: "title"}).Return(int64(1), nil).Once()
+	repo.On("byExternalID", int64(0), "feed-1").Return(int64(7), nil).Once()
+
+	limiter := NewLimiter(quotas, Limits{RatePerMinute: 60, Burst: 1, DailyQuota: 1}, clk)
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, nil, limiter, false)
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		remoteAddr string
+		body       string
+		wait       time.Duration
+		status     int
+		retryAfter string
+		expected   string
+	}{
+		{
+			name:     "stored",
+			handler:  srv.postArticle,
+			body:     `{"title": "title"}`,
+			status:   http.StatusCreated,
+			expected: `{"article_id": 1}`,
+		},
+		{
+			name:       "rate limited",
+			handler:    srv.postArticle,
+			body:       `{"title": "title"}`,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "1",
+			expected:   `{"error": {"code": "rate_limited", "message": "Too many requests", "retry_after": 1}}`,
+		},
+		{
+			name:       "quota exceeded",
+			handler:    srv.postArticle,
+			body:       `{"title": "title"}`,
+			wait:       time.Second,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "43199",
+			expected:   `{"error": {"code": "quota_exceeded", "message": "Daily quota of 1 articles reached", "retry_after": 43199}}`,
+		},
+		{
+			name:       "batch over quota",
+			handler:    srv.postBatch,
+			remoteAddr: "198.51.100.1:4321",
+			body:       `[{"title": "title"}, {"title": ""}, {"title": "title"}]`,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "43199",
+			expected: `{"results": [
+				{"index": 0, "error": {"code": "quota_exceeded", "message": "Daily quota of 1 articles reached", "retry_after": 43199}},
+				{"index": 1, "error": {"code": "invalid_article", "message": "title is required", "field": "title"}},
+				{"index": 2, "error": {"code": "quota_exceeded", "message": "Daily quota of 1 articles reached", "retry_after": 43199}}
+			]}`,
+		},
+		{
+			name:       "batch rate limited",
+			handler:    srv.postBatch,
+			remoteAddr: "198.51.100.1:4321",
+			body:       `[{"title": "title"}]`,
+			wait:       time.Second,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "2",
+			expected:   `{"error": {"code": "rate_limited", "message": "Too many requests", "retry_after": 2}}`,
+		},
+		{
+			name:       "retried",
+			handler:    srv.postArticle,
+			remoteAddr: "198.51.100.2:4321",
+			body:       `{"title": "title", "external_id": "feed-1"}`,
+			status:     http.StatusCreated,
+			expected:   `{"article_id": 7}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk.Add(tt.wait)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(tt.body))
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			tt.handler(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	// Publish frames over the limit are answered with an error ack
+	c := client{key: "ip:203.0.113.1"}
+	repo.On("retract", int64(1), int64(0)).Return(nil).Once()
+	assert.Equal(t, ackPayload{MessageID: "1", ArticleID: 1}, srv.handlePublish(c, []byte(`{"message_id": "1", "op": "retract", "article_id": 1}`)))
+	assert.Equal(t, ackPayload{
+		MessageID: "2",
+		Error:     &errorPayload{Code: errCodeRateLimited, Message: "Too many requests", RetryAfter: 1},
+	}, srv.handlePublish(c, []byte(`{"message_id": "2", "op": "retract", "article_id": 1}`)))
+
+	repo.AssertExpectations(t)
+	quotas.AssertExpectations(t)
+}
+
+type mockQuotaRepository struct {
+	mock.Mock
+}
+
+func (m *mockQuotaRepository) reserve(client string, day time.Time, n int, quota int) (bool, error) {
+	args := m.Called(client, day, n, quota)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockQuotaRepository) release(client string, day time.Time, n int) error {
+	return m.Called(client, day, n).Error(0)
+}
@@ -0,0 +1,472 @@
+package aggregator
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ModerationAction is what moderation does with an article. The strictest
+// action of the rules an article matches is taken.
+type ModerationAction string
+
+const (
+	ActionAllow ModerationAction = "allow"
+	// ActionFix stores the article as fixed by the rules.
+	ActionFix ModerationAction = "fix"
+	// ActionQuarantine holds the article for an editor to review.
+	ActionQuarantine ModerationAction = "quarantine"
+	ActionReject     ModerationAction = "reject"
+)
+
+func (a ModerationAction) severity() int {
+	switch a {
+	case ActionFix:
+		return 1
+	case ActionQuarantine:
+		return 2
+	case ActionReject:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// ModerationRule is one check of the moderation stage. Check returns
+// ActionAllow when the article passes, or the action the rule takes with
+// the reason. Rules that fix articles return the fixed article.
+type ModerationRule interface {
+	Name() string
+	Check(a Article) (Article, ModerationAction, string)
+}
+
+// ModerationHit is a rule an article matched.
+type ModerationHit struct {
+	Rule   string           `json:"rule"`
+	Action ModerationAction `json:"action"`
+	Reason string           `json:"reason"`
+}
+
+// ModerationDecision is what moderation did with an article.
+type ModerationDecision struct {
+	// ArticleID is 0 for rejected articles, they aren't stored.
+	ArticleID int64
+	AuthorID  int64
+	Title     string
+	Action    ModerationAction
+	Hits      []ModerationHit
+}
+
+// reasons tells why the article was held back, leaving out what was fixed.
+func (d ModerationDecision) reasons() string {
+	reasons := make([]string, 0, len(d.Hits))
+	for _, h := range d.Hits {
+		if h.Action != ActionFix {
+			reasons = append(reasons, h.Reason)
+		}
+	}
+
+	return strings.Join(reasons, ", ")
+}
+
+type ModerationRepository interface {
+	logDecision(d ModerationDecision) error
+}
+
+type moderationRepository struct {
+	db *sql.DB
+}
+
+func NewModerationRepository(db *sql.DB) ModerationRepository {
+	return &moderationRepository{
+		db: db,
+	}
+}
+
+func (r *moderationRepository) logDecision(d ModerationDecision) error {
+	hits, err := json.Marshal(d.Hits)
+	if err != nil {
+		return err
+	}
+	if d.Hits == nil {
+		hits = []byte("[]")
+	}
+
+	_, err = r.db.Exec(`
+		INSERT INTO moderation_decisions (article_id, author_id, title, action, hits)
+		VALUES (NULLIF($1::bigint, 0), NULLIF($2::bigint, 0), $3, $4, $5)`,
+		d.ArticleID,
+		d.AuthorID,
+		d.Title,
+		d.Action,
+		hits,
+	)
+
+	return err
+}
+
+// Moderator runs articles through the moderation rules before they're
+// stored, logging every decision.
+type Moderator struct {
+	rules []ModerationRule
+	repo  ModerationRepository
+}
+
+func NewModerator(repo ModerationRepository, rules []ModerationRule) *Moderator {
+	return &Moderator{
+		rules: rules,
+		repo:  repo,
+	}
+}
+
+// moderate checks the article against every rule in order, each seeing the
+// fixes of the ones before. A nil moderator allows every article.
+func (m *Moderator) moderate(a Article) (Article, ModerationDecision) {
+	d := ModerationDecision{AuthorID: a.AuthorID, Title: a.Title, Action: ActionAllow}
+	if m == nil {
+		return a, d
+	}
+
+	for _, rule := range m.rules {
+		fixed, action, reason := rule.Check(a)
+		if action == ActionAllow {
+			continue
+		}
+
+		d.Hits = append(d.Hits, ModerationHit{Rule: rule.Name(), Action: action, Reason: reason})
+		if action == ActionFix {
+			a = fixed
+		}
+		if action.severity() > d.Action.severity() {
+			d.Action = action
+		}
+	}
+
+	return a, d
+}
+
+// record logs a decision. Articles are stored or rejected all the same when
+// it fails.
+func (m *Moderator) record(d ModerationDecision) {
+	if m == nil {
+		return
+	}
+
+	err := m.repo.logDecision(d)
+	if err != nil {
+		log.Println("error logging moderation decision:", err)
+	}
+}
+
+// ModerationConfig holds the moderation rules, as read from a JSON file.
+type ModerationConfig struct {
+	BlockedTerms []struct {
+		Terms  []string         `json:"terms"`
+		Action ModerationAction `json:"action"`
+	} `json:"blocked_terms"`
+	Patterns []struct {
+		Name    string           `json:"name"`
+		Pattern string           `json:"pattern"`
+		Action  ModerationAction `json:"action"`
+	} `json:"patterns"`
+	MaxLinks *struct {
+		Max    int              `json:"max"`
+		Action ModerationAction `json:"action"`
+	} `json:"max_links"`
+	Shouting *struct {
+		// Ratio is the share of upper case letters from which an article
+		// is shouting.
+		Ratio float64 `json:"ratio"`
+		// MinLetters spares short articles, where a few acronyms are
+		// enough to reach the ratio.
+		MinLetters int              `json:"min_letters"`
+		Action     ModerationAction `json:"action"`
+	} `json:"shouting"`
+}
+
+// LoadModerationRules reads a ModerationConfig and returns its rules,
+// blocked terms first, then patterns, links and shouting.
+func LoadModerationRules(r io.Reader) ([]ModerationRule, error) {
+	var config ModerationConfig
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("decoding moderation rules: %w", err)
+	}
+
+	var rules []ModerationRule
+	for _, b := range config.BlockedTerms {
+		if err := checkAction("blocked_terms", b.Action); err != nil {
+			return nil, err
+		}
+		rule := newBlockedTermsRule(b.Terms, b.Action)
+		if rule == nil {
+			return nil, fmt.Errorf("blocked_terms: terms are required")
+		}
+		rules = append(rules, rule)
+	}
+	for _, p := range config.Patterns {
+		if err := checkAction("patterns", p.Action); err != nil {
+			return nil, err
+		}
+		if p.Name == "" {
+			return nil, fmt.Errorf("patterns: name is required")
+		}
+		pattern, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("patterns: %s: %w", p.Name, err)
+		}
+		rules = append(rules, &patternRule{name: p.Name, pattern: pattern, action: p.Action})
+	}
+	if l := config.MaxLinks; l != nil {
+		if err := checkAction("max_links", l.Action); err != nil {
+			return nil, err
+		}
+		if l.Max < 0 {
+			return nil, fmt.Errorf("max_links: max can't be negative")
+		}
+		rules = append(rules, &maxLinksRule{max: l.Max, action: l.Action})
+	}
+	if s := config.Shouting; s != nil {
+		if err := checkAction("shouting", s.Action); err != nil {
+			return nil, err
+		}
+		if s.Ratio <= 0 || s.Ratio > 1 {
+			return nil, fmt.Errorf("shouting: ratio must be above 0 and at most 1")
+		}
+		rules = append(rules, &shoutingRule{ratio: s.Ratio, minLetters: s.MinLetters, action: s.Action})
+	}
+
+	return rules, nil
+}
+
+func checkAction(rule string, action ModerationAction) error {
+	if action.severity() == 0 {
+		return fmt.Errorf("%s: action must be fix, quarantine or reject", rule)
+	}
+
+	return nil
+}
+
+// blockedTermsRule matches whole words or phrases regardless of case. Its
+// fix masks them, and drops the tags holding them.
+type blockedTermsRule struct {
+	pattern *regexp.Regexp
+	action  ModerationAction
+}
+
+func newBlockedTermsRule(terms []string, action ModerationAction) *blockedTermsRule {
+	var quoted []string
+	for _, t := range terms {
+		if t = normalizeLine(t); t != "" {
+			quoted = append(quoted, regexp.QuoteMeta(t))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	// Longer terms first, so phrases win over the words in them
+	sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+
+	return &blockedTermsRule{
+		pattern: regexp.MustCompile(`(?i)(?:` + strings.Join(quoted, "|") + `)`),
+		action:  action,
+	}
+}
+
+func (r *blockedTermsRule) Name() string {
+	return "blocked_terms"
+}
+
+func (r *blockedTermsRule) Check(a Article) (Article, ModerationAction, string) {
+	var found string
+	a.Title, found = maskWords(r.pattern, a.Title, found)
+	a.Body, found = maskWords(r.pattern, a.Body, found)
+	a.Tags = dropTags(a.Tags, func(t string) bool {
+		_, blocked := maskWords(r.pattern, t, "")
+		if found == "" {
+			found = blocked
+		}
+		return blocked != ""
+	})
+	if found == "" {
+		return a, ActionAllow, ""
+	}
+
+	return a, r.action, fmt.Sprintf("contains blocked term %q", strings.ToLower(found))
+}
+
+// maskWords masks the matches of pattern that aren't part of a longer
+// word, returning the first one found when found is empty.
+func maskWords(pattern *regexp.Regexp, s string, found string) (string, string) {
+	// Masking keeps lengths, the indexes stay valid
+	var first string
+	matches := pattern.FindAllStringIndex(s, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		start, end := matches[i][0], matches[i][1]
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if isWordRune(before) || isWordRune(after) {
+			continue
+		}
+
+		first = s[start:end]
+		s = s[:start] + mask(first) + s[end:]
+	}
+	if found == "" {
+		found = first
+	}
+
+	return s, found
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// dropTags returns the tags that don't match, in a new slice so the
+// article checked keeps its own.
+func dropTags(tags []string, matches func(tag string) bool) []string {
+	var kept []string
+	for _, t := range tags {
+		if !matches(t) {
+			kept = append(kept, t)
+		}
+	}
+
+	return kept
+}
+
+// mask replaces every letter and digit with an asterisk.
+func mask(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isWordRune(r) {
+			return '*'
+		}
+		return r
+	}, s)
+}
+
+// patternRule matches a regular expression. Its fix masks the matches and
+// drops the tags matching.
+type patternRule struct {
+	name    string
+	pattern *regexp.Regexp
+	action  ModerationAction
+}
+
+func (r *patternRule) Name() string {
+	return "pattern:" + r.name
+}
+
+func (r *patternRule) Check(a Article) (Article, ModerationAction, string) {
+	tags := dropTags(a.Tags, r.pattern.MatchString)
+	if !r.pattern.MatchString(a.Title) && !r.pattern.MatchString(a.Body) && len(tags) == len(a.Tags) {
+		return a, ActionAllow, ""
+	}
+
+	a.Title = r.pattern.ReplaceAllStringFunc(a.Title, mask)
+	a.Body = r.pattern.ReplaceAllStringFunc(a.Body, mask)
+	a.Tags = tags
+
+	return a, r.action, "matches " + r.name
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// maxLinksRule limits the links in an article, tags included. Its fix
+// drops the links past the limit, and the tags holding them.
+type maxLinksRule struct {
+	max    int
+	action ModerationAction
+}
+
+func (r *maxLinksRule) Name() string {
+	return "max_links"
+}
+
+func (r *maxLinksRule) Check(a Article) (Article, ModerationAction, string) {
+	links := len(linkPattern.FindAllStringIndex(a.Title, -1)) + len(linkPattern.FindAllStringIndex(a.Body, -1))
+	for _, t := range a.Tags {
+		links += len(linkPattern.FindAllStringIndex(t, -1))
+	}
+	if links <= r.max {
+		return a, ActionAllow, ""
+	}
+
+	kept := 0
+	drop := func(link string) string {
+		if kept < r.max {
+			kept++
+			return link
+		}
+		return ""
+	}
+	a.Title = linkPattern.ReplaceAllStringFunc(a.Title, drop)
+	a.Body = linkPattern.ReplaceAllStringFunc(a.Body, drop)
+	a.Tags = dropTags(a.Tags, func(t string) bool {
+		return linkPattern.ReplaceAllStringFunc(t, drop) != t
+	})
+
+	return a, r.action, fmt.Sprintf("has %d links, at most %d allowed", links, r.max)
+}
+
+// shoutingRule matches articles written mostly in upper case. Its fix
+// turns them into sentence case. Tags are left out, validation already
+// lower cased them.
+type shoutingRule struct {
+	ratio      float64
+	minLetters int
+	action     ModerationAction
+}
+
+func (r *shoutingRule) Name() string {
+	return "shouting"
+}
+
+func (r *shoutingRule) Check(a Article) (Article, ModerationAction, string) {
+	var letters, upper int
+	for _, c := range a.Title + a.Body {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+		letters++
+		if unicode.IsUpper(c) {
+			upper++
+		}
+	}
+	if letters == 0 || letters < r.minLetters || float64(upper)/float64(letters) < r.ratio {
+		return a, ActionAllow, ""
+	}
+
+	a.Title = sentenceCase(a.Title)
+	a.Body = sentenceCase(a.Body)
+
+	return a, r.action, "is mostly upper case"
+}
+
+// sentenceCase lower cases s, capitalizing the first letter of every
+// sentence.
+func sentenceCase(s string) string {
+	capitalize := true
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c == '.' || c == '!' || c == '?':
+			capitalize = true
+		case unicode.IsLetter(c) && capitalize:
+			capitalize = false
+			return unicode.ToUpper(c)
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			capitalize = false
+		}
+		return unicode.ToLower(c)
+	}, s)
+}
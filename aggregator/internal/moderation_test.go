@@ -0,0 +1,407 @@
+package aggregator
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tilinna/clock"
+)
+
+func TestLoadModerationRules(t *testing.T) {
+	rules, err := LoadModerationRules(strings.NewReader(`{
+		"blocked_terms": [{"terms": ["darn", "heck"], "action": "fix"}],
+		"patterns": [{"name": "test junk", "pattern": "(?i)^test", "action": "reject"}],
+		"max_links": {"max": 2, "action": "quarantine"},
+		"shouting": {"ratio": 0.7, "min_letters": 10, "action": "fix"}
+	}`))
+	assert.Nil(t, err)
+	var names []string
+	for _, r := range rules {
+		names = append(names, r.Name())
+	}
+	assert.Equal(t, []string{"blocked_terms", "pattern:test junk", "max_links", "shouting"}, names)
+
+	tests := map[string]struct {
+		config   string
+		expected string
+	}{
+		"unknown field":  {`{"blocked": []}`, `decoding moderation rules: json: unknown field "blocked"`},
+		"unknown action": {`{"max_links": {"max": 2, "action": "delete"}}`, "max_links: action must be fix, quarantine or reject"},
+		"no terms":       {`{"blocked_terms": [{"terms": [" "], "action": "fix"}]}`, "blocked_terms: terms are required"},
+		"no name":        {`{"patterns": [{"pattern": "a", "action": "fix"}]}`, "patterns: name is required"},
+		"bad pattern":    {`{"patterns": [{"name": "p", "pattern": "(", "action": "fix"}]}`, "patterns: p: error parsing regexp: missing closing ): `(`"},
+		"bad ratio":      {`{"shouting": {"ratio": 2, "action": "fix"}}`, "shouting: ratio must be above 0 and at most 1"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadModerationRules(strings.NewReader(tt.config))
+			assert.EqualError(t, err, tt.expected)
+		})
+	}
+}
+
+func TestModerationRules(t *testing.T) {
+	tests := map[string]struct {
+		rule     ModerationRule
+		article  Article
+		expected Article
+		action   ModerationAction
+		reason   string
+	}{
+		"blocked term": {
+			rule:     newBlockedTermsRule([]string{"darn", "what the heck"}, ActionFix),
+			article:  Article{Title: "Darn trains", Body: "What the heck, darn it. Darnell stays."},
+			expected: Article{Title: "**** trains", Body: "**** *** ****, **** it. Darnell stays."},
+			action:   ActionFix,
+			reason:   `contains blocked term "darn"`,
+		},
+		"blocked term in tags": {
+			rule:     newBlockedTermsRule([]string{"darn"}, ActionFix),
+			article:  Article{Title: "trains", Body: "body", Tags: []string{"rail", "darn trains", "darnell"}},
+			expected: Article{Title: "trains", Body: "body", Tags: []string{"rail", "darnell"}},
+			action:   ActionFix,
+			reason:   `contains blocked term "darn"`,
+		},
+		"no blocked term": {
+			rule:     newBlockedTermsRule([]string{"darn"}, ActionReject),
+			article:  Article{Title: "Darnell", Body: "undarned"},
+			expected: Article{Title: "Darnell", Body: "undarned"},
+			action:   ActionAllow,
+		},
+		"non ascii term": {
+			rule:     newBlockedTermsRule([]string{"baka"}, ActionQuarantine),
+			article:  Article{Title: "title", Body: "バカ baka ébaka"},
+			expected: Article{Title: "title", Body: "バカ **** ébaka"},
+			action:   ActionQuarantine,
+			reason:   `contains blocked term "baka"`,
+		},
+		"pattern": {
+			rule:     &patternRule{name: "phone numbers", pattern: regexp.MustCompile(`\d{3}-\d{4}`), action: ActionFix},
+			article:  Article{Title: "title", Body: "Call 555-1234"},
+			expected: Article{Title: "title", Body: "Call ***-****"},
+			action:   ActionFix,
+			reason:   "matches phone numbers",
+		},
+		"pattern in tags": {
+			rule:     &patternRule{name: "phone numbers", pattern: regexp.MustCompile(`\d{3}-\d{4}`), action: ActionReject},
+			article:  Article{Title: "title", Body: "body", Tags: []string{"call 555-1234"}},
+			expected: Article{Title: "title", Body: "body"},
+			action:   ActionReject,
+			reason:   "matches phone numbers",
+		},
+		"too many links": {
+			rule:     &maxLinksRule{max: 1, action: ActionFix},
+			article:  Article{Title: "www.a.com", Body: "See https://b.com and http://c.com/x?y=1"},
+			expected: Article{Title: "www.a.com", Body: "See  and "},
+			action:   ActionFix,
+			reason:   "has 3 links, at most 1 allowed",
+		},
+		"links in tags": {
+			rule:     &maxLinksRule{max: 1, action: ActionFix},
+			article:  Article{Title: "title", Body: "See https://b.com", Tags: []string{"www.c.com", "travel"}},
+			expected: Article{Title: "title", Body: "See https://b.com", Tags: []string{"travel"}},
+			action:   ActionFix,
+			reason:   "has 2 links, at most 1 allowed",
+		},
+		"links": {
+			rule:     &maxLinksRule{max: 1, action: ActionReject},
+			article:  Article{Title: "title", Body: "See https://b.com"},
+			expected: Article{Title: "title", Body: "See https://b.com"},
+			action:   ActionAllow,
+		},
+		"shouting": {
+			rule:     &shoutingRule{ratio: 0.7, minLetters: 10, action: ActionFix},
+			article:  Article{Title: "TOYOTA WINS", Body: "THE NEW EV IS FAST! BUY IT NOW. really"},
+			expected: Article{Title: "Toyota wins", Body: "The new ev is fast! Buy it now. Really"},
+			action:   ActionFix,
+			reason:   "is mostly upper case",
+		},
+		"short shouting": {
+			rule:     &shoutingRule{ratio: 0.7, minLetters: 10, action: ActionFix},
+			article:  Article{Title: "EV NEWS"},
+			expected: Article{Title: "EV NEWS"},
+			action:   ActionAllow,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, action, reason := tt.rule.Check(tt.article)
+			assert.Equal(t, tt.action, action)
+			assert.Equal(t, tt.reason, reason)
+			if action != ActionAllow {
+				assert.Equal(t, tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestServer_Moderation(t *testing.T) {
+	rules, err := LoadModerationRules(strings.NewReader(`{
+		"blocked_terms": [{"terms": ["darn"], "action": "fix"}, {"terms": ["lorem ipsum"], "action": "reject"}],
+		"max_links": {"max": 0, "action": "quarantine"}
+	}`))
+	assert.Nil(t, err)
+	rules = append(rules, dropTitleRule{title: "drop me"})
+
+	decisions := &mockModerationRepository{}
+	decisions.On("logDecision", ModerationDecision{
+		ArticleID: 1,
+		AuthorID:  7,
+		Title:     "darn trains",
+		Action:    ActionFix,
+		Hits:      []ModerationHit{{Rule: "blocked_terms", Action: ActionFix, Reason: `contains blocked term "darn"`}},
+	}).Return(nil)
+	decisions.On("logDecision", ModerationDecision{
+		AuthorID: 7,
+		Title:    "title",
+		Action:   ActionReject,
+		Hits:     []ModerationHit{{Rule: "blocked_terms", Action: ActionReject, Reason: `contains blocked term "lorem ipsum"`}},
+	}).Return(nil)
+	decisions.On("logDecision", ModerationDecision{
+		ArticleID: 2,
+		AuthorID:  7,
+		Title:     "title",
+		Action:    ActionQuarantine,
+		Hits:      []ModerationHit{{Rule: "max_links", Action: ActionQuarantine, Reason: "has 1 links, at most 0 allowed"}},
+	}).Return(nil)
+	decisions.On("logDecision", ModerationDecision{
+		ArticleID: 3,
+		AuthorID:  7,
+		Title:     "title",
+		Action:    ActionReject,
+		Hits:      []ModerationHit{{Rule: "max_links", Action: ActionQuarantine, Reason: "has 1 links, at most 0 allowed"}},
+	}).Return(nil)
+	decisions.On("logDecision", mock.Anything).Return(nil)
+
+	repo := &mockArticleRepository{done: make(chan struct{}, 3)}
+	// Fixed articles are stored as fixed, quarantined ones held for review
+	repo.On("store", Article{AuthorID: 7, Title: "**** trains", Body: "body"}).Return(int64(1), nil)
+	repo.On("store", Article{AuthorID: 7, Title: "title", Body: "www.example.com", review: true}).Return(int64(2), nil)
+
+	journalists := &mockJournalistRepository{}
+	journalists.On("journalistByToken", hashToken("secret")).Return(Journalist{ID: 7}, nil)
+
+	srv := NewServer(repo, journalists, nil, nil, ValidationRules{RequireTitle: true}, NewModerator(decisions, rules), nil, false)
+
+	tests := map[string]struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		"fixed": {
+			method:   http.MethodPost,
+			path:     "/articles",
+			body:     `{"title": "darn trains", "body": "body"}`,
+			status:   http.StatusCreated,
+			expected: `{"article_id": 1}`,
+		},
+		"rejected": {
+			method:   http.MethodPost,
+			path:     "/articles",
+			body:     `{"title": "title", "body": "Lorem  ipsum dolor"}`,
+			status:   http.StatusUnprocessableEntity,
+			expected: `{"error": {"code": "moderation_rejected", "message": "Article rejected by moderation: contains blocked term \"lorem ipsum\""}}`,
+		},
+		"quarantined": {
+			method:   http.MethodPost,
+			path:     "/articles",
+			body:     `{"title": "title", "body": "www.example.com"}`,
+			status:   http.StatusCreated,
+			expected: `{"article_id": 2, "status": "in_review"}`,
+		},
+		"change quarantined": {
+			method:   http.MethodPut,
+			path:     "/articles/3",
+			body:     `{"title": "title", "body": "www.example.com"}`,
+			status:   http.StatusUnprocessableEntity,
+			expected: `{"error": {"code": "moderation_rejected", "message": "Article rejected by moderation: has 1 links, at most 0 allowed"}}`,
+		},
+		"emptied by a fix": {
+			method:   http.MethodPost,
+			path:     "/articles",
+			body:     `{"title": "drop me", "body": "body"}`,
+			status:   http.StatusUnprocessableEntity,
+			expected: `{"error": {"code": "invalid_article", "message": "title is required", "field": "title"}}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer secret")
+			if tt.method == http.MethodPost {
+				srv.postArticle(w, r)
+			} else {
+				srv.changeArticle(w, r)
+			}
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	// Acks and batch results tell quarantined articles are held too
+	c := client{author: &Journalist{ID: 7}, key: "journalist:7"}
+	assert.Equal(t,
+		ackPayload{MessageID: "1", ArticleID: 2, Status: "in_review"},
+		srv.handlePublish(c, []byte(`{"message_id": "1", "title": "title", "body": "www.example.com"}`)),
+	)
+
+	repo.On("storeBatch", []Article{
+		{AuthorID: 7, Title: "**** trains", Body: "body"},
+		{AuthorID: 7, Title: "title", Body: "www.example.com", review: true},
+	}).Return([]int64{4, 5}, nil).Once()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/articles:batch", strings.NewReader(`[
+		{"title": "darn trains", "body": "body"},
+		{"title": "title", "body": "www.example.com"}
+	]`))
+	r.Header.Set("Authorization", "Bearer secret")
+	srv.postBatch(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"results": [
+		{"index": 0, "article_id": 4},
+		{"index": 1, "article_id": 5, "status": "in_review"}
+	]}`, w.Body.String())
+
+	repo.AssertExpectations(t)
+	decisions.AssertExpectations(t)
+}
+
+func TestServer_ModerationWithoutAuth(t *testing.T) {
+	rules, err := LoadModerationRules(strings.NewReader(`{"max_links": {"max": 0, "action": "quarantine"}}`))
+	assert.Nil(t, err)
+
+	decisions := &mockModerationRepository{}
+	decisions.On("logDecision", ModerationDecision{
+		Title:  "title",
+		Action: ActionReject,
+		Hits:   []ModerationHit{{Rule: "max_links", Action: ActionQuarantine, Reason: "has 1 links, at most 0 allowed"}},
+	}).Return(nil)
+
+	// Without editors to review them, quarantined articles are rejected
+	repo := &mockArticleRepository{}
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, NewModerator(decisions, rules), nil, false)
+
+	w := httptest.NewRecorder()
+	srv.postArticle(w, httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(`{"title": "title", "body": "www.example.com"}`)))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{"error": {"code": "moderation_rejected", "message": "Article rejected by moderation: has 1 links, at most 0 allowed"}}`, w.Body.String())
+
+	repo.AssertExpectations(t)
+	decisions.AssertExpectations(t)
+}
+
+func TestServer_ModerationNotStored(t *testing.T) {
+	rules, err := LoadModerationRules(strings.NewReader(`{"blocked_terms": [{"terms": ["darn"], "action": "fix"}]}`))
+	assert.Nil(t, err)
+
+	// Decisions are recorded without id when the articles aren't stored
+	decision := ModerationDecision{
+		Title:  "darn trains",
+		Action: ActionFix,
+		Hits:   []ModerationHit{{Rule: "blocked_terms", Action: ActionFix, Reason: `contains blocked term "darn"`}},
+	}
+	decisions := &mockModerationRepository{}
+	decisions.On("logDecision", decision).Return(nil).Times(3)
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	quotas := &mockQuotaRepository{}
+	quotas.On("reserve", "ip:192.0.2.1", day, 1, 1).Return(false, nil).Once()
+	quotas.On("reserve", "ip:198.51.100.1", day, 1, 1).Return(true, nil).Once()
+	quotas.On("release", "ip:198.51.100.1", day, 1).Return(nil).Once()
+	quotas.On("reserve", "ip:203.0.113.1", day, 1, 1).Return(true, nil).Once()
+	quotas.On("release", "ip:203.0.113.1", day, 1).Return(nil).Once()
+	limiter := NewLimiter(quotas, Limits{DailyQuota: 1}, clock.NewMock(start))
+
+	repo := &mockArticleRepository{done: make(chan struct{}, 1)}
+	repo.On("store", Article{Title: "**** trains"}).Return(int64(0), errors.New("connection refused")).Once()
+	repo.On("storeBatch", []Article{{Title: "**** trains"}}).Return(nil, errors.New("connection refused")).Once()
+
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, NewModerator(decisions, rules), limiter, false)
+
+	tests := map[string]struct {
+		handler    http.HandlerFunc
+		path       string
+		remoteAddr string
+		body       string
+		status     int
+	}{
+		"over quota": {
+			handler:    srv.postArticle,
+			path:       "/articles",
+			remoteAddr: "192.0.2.1:4321",
+			body:       `{"title": "darn trains"}`,
+			status:     http.StatusTooManyRequests,
+		},
+		"storage error": {
+			handler:    srv.postArticle,
+			path:       "/articles",
+			remoteAddr: "198.51.100.1:4321",
+			body:       `{"title": "darn trains"}`,
+			status:     http.StatusInternalServerError,
+		},
+		"batch storage error": {
+			handler:    srv.postBatch,
+			path:       "/articles/batch",
+			remoteAddr: "203.0.113.1:4321",
+			body:       `[{"title": "darn trains"}]`,
+			status:     http.StatusInternalServerError,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.RemoteAddr = tt.remoteAddr
+			tt.handler(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+
+	repo.AssertExpectations(t)
+	quotas.AssertExpectations(t)
+	decisions.AssertExpectations(t)
+}
+
+// dropTitleRule empties the title it's given, as fixes can.
+type dropTitleRule struct {
+	title string
+}
+
+func (r dropTitleRule) Name() string {
+	return "drop_title"
+}
+
+func (r dropTitleRule) Check(a Article) (Article, ModerationAction, string) {
+	if a.Title != r.title {
+		return a, ActionAllow, ""
+	}
+
+	a.Title = ""
+	return a, ActionFix, "drops the title"
+}
+
+type mockModerationRepository struct {
+	mock.Mock
+}
+
+func (m *mockModerationRepository) logDecision(d ModerationDecision) error {
+	return m.Called(d).Error(0)
+}
@@ -2,9 +2,11 @@ package aggregator
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/tilinna/clock"
 )
 
@@ -34,10 +36,74 @@ type Article struct {
 	Body        string    `json:"body"`
 	Category    string    `json:"category"`
 	PublishedAt time.Time `json:"published_at"`
+	// Tags file the article under more topics than its category.
+	Tags []string `json:"tags,omitempty"`
+	// ExternalID optionally identifies the article for the client, an
+	// article sent again with the same one isn't stored twice.
+	ExternalID string `json:"external_id,omitempty"`
+	// AuthorID is the journalist publishing the article, set by the server
+	// from its credentials.
+	AuthorID int64 `json:"-"`
+	// PublishAt holds the article back until the given time. Articles are
+	// published right away without it or when it's already past.
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// Draft keeps the article from its author until it's submitted.
+	Draft bool `json:"draft,omitempty"`
+	// review holds the article for editors to approve, set by the server
+	// when reviews are required.
+	review bool
 }
 
+// StoredArticle is an article as its author and editors see it before and
+// after it's published.
+type StoredArticle struct {
+	ID int64 `json:"id"`
+	Article
+	// PublishedAt is only set once the article is published.
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	Status      string     `json:"status"`
+	Author      string     `json:"author,omitempty"`
+	SubmittedAt *time.Time `json:"submitted_at,omitempty"`
+	ReviewNote  string     `json:"review_note,omitempty"`
+}
+
+// scheduled tells whether the article is to be published after now.
+func (a Article) scheduled(now time.Time) bool {
+	return a.PublishAt != nil && a.PublishAt.After(now)
+}
+
+const (
+	statusDraft     = "draft"
+	statusInReview  = "in_review"
+	statusApproved  = "approved"
+	statusScheduled = "scheduled"
+	statusPublished = "published"
+	statusRetracted = "retracted"
+)
+
+var (
+	errNoneDue         = errors.New("no scheduled article due")
+	errArticleNotFound = errors.New("article not found")
+)
+
 type ArticleRepository interface {
-	store(a Article) error
+	store(a Article) (int64, error)
+	storeBatch(articles []Article) ([]int64, error)
+	byExternalID(authorID int64, externalID string) (int64, error)
+	update(id int64, a Article) error
+	retract(id int64, authorID int64) error
+	stored(id int64, authorID int64) (StoredArticle, error)
+	submit(id int64, authorID int64, review bool) error
+	reviewQueue(limit int) ([]StoredArticle, error)
+	approve(id int64, editorID int64) error
+	reject(id int64, editorID int64, note string) error
+	nextScheduled() (time.Time, bool, error)
+	releaseDue(now time.Time) (int64, error)
+}
+
+// queryRower is implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type articleRepository struct {
@@ -52,21 +118,407 @@ func NewArticleRepository(db *sql.DB, c clock.Clock) ArticleRepository {
 	}
 }
 
-func (r *articleRepository) store(a Article) error {
-	_, err := r.db.Exec(`
-		INSERT INTO articles (
-				title,
-				body,
-				category,
-				published_at
-		) VALUES ($1, $2, $3, $4)`,
+// store inserts the article and returns its id. When its author already
+// stored an article with the same external id, its id is returned instead.
+func (r *articleRepository) store(a Article) (int64, error) {
+	return r.insert(r.db, a, r.clock.Now().UTC())
+}
+
+// storeBatch stores every article in a single transaction, returning
+// their ids in the same order. Nothing is stored when one of them fails.
+func (r *articleRepository) storeBatch(articles []Article) ([]int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := r.clock.Now().UTC()
+	ids := make([]int64, len(articles))
+	for i, a := range articles {
+		ids[i], err = r.insert(tx, a, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ids, tx.Commit()
+}
+
+// insert stores the article as published at now, as scheduled for its
+// PublishAt time, or as a draft or in review when it's held back. Its tags
+// are stored by the same statement, so they're there when the article is
+// notified.
+func (r *articleRepository) insert(q queryRower, a Article, now time.Time) (int64, error) {
+	publishedAt, status := &now, statusPublished
+	var submittedAt *time.Time
+	switch {
+	case a.Draft:
+		publishedAt, status = a.PublishAt, statusDraft
+	case a.review:
+		publishedAt, status, submittedAt = a.PublishAt, statusInReview, &now
+	case a.scheduled(now):
+		publishedAt, status = a.PublishAt, statusScheduled
+	}
+
+	var id int64
+	err := q.QueryRow(`
+		WITH inserted AS (
+			INSERT INTO articles (
+					title,
+					body,
+					category,
+					published_at,
+					external_id,
+					author_id,
+					status,
+					submitted_at
+			) VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), NULLIF($6::bigint, 0), $7, $9)
+			ON CONFLICT (COALESCE(author_id, 0), external_id) DO NOTHING
+			RETURNING id
+		), new_tags AS (
+			INSERT INTO tags (name)
+			SELECT UNNEST($8::text[])
+			ON CONFLICT (name) DO NOTHING
+		), tagged AS (
+			INSERT INTO article_tags (article_id, tag)
+			SELECT id, UNNEST($8::text[]) FROM inserted
+		)
+		SELECT id FROM inserted`,
 		a.Title,
 		a.Body,
 		a.Category,
+		publishedAt,
+		a.ExternalID,
+		a.AuthorID,
+		status,
+		pq.Array(a.Tags),
+		submittedAt,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return byExternalID(q, a.AuthorID, a.ExternalID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// byExternalID returns the id of the article stored with the external id
+// by the journalist, or anonymously when authorID is 0. It fails with
+// errArticleNotFound when there's none.
+func (r *articleRepository) byExternalID(authorID int64, externalID string) (int64, error) {
+	return byExternalID(r.db, authorID, externalID)
+}
+
+func byExternalID(q queryRower, authorID int64, externalID string) (int64, error) {
+	var id int64
+	err := q.QueryRow(`
+		SELECT id
+		FROM articles
+		WHERE COALESCE(author_id, 0) = $1 AND external_id = $2`,
+		authorID,
+		externalID,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errArticleNotFound
+	}
+
+	return id, err
+}
+
+// update replaces the title, body, category and tags of an article written
+// by a.AuthorID, or of an anonymous one when it's 0. Approved articles go
+// back to review. It fails with errArticleNotFound when there's no such
+// article or it was retracted.
+func (r *articleRepository) update(id int64, a Article) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE articles
+		SET title = $2,
+			body = $3,
+			category = NULLIF($4, ''),
+			status = CASE WHEN status = 'approved' THEN 'in_review' ELSE status END
+		WHERE id = $1
+			AND status != 'retracted'
+			AND author_id IS NOT DISTINCT FROM NULLIF($5::bigint, 0)`,
+		id,
+		a.Title,
+		a.Body,
+		a.Category,
+		a.AuthorID,
+	)
+	err = affectedOne(res, err)
+	if err != nil {
+		return err
+	}
+
+	// The articles trigger only notices changes to the article row.
+	// Notifying twice in a transaction delivers once.
+	_, err = tx.Exec(`
+		WITH new_tags AS (
+			INSERT INTO tags (name)
+			SELECT UNNEST($2::text[])
+			ON CONFLICT (name) DO NOTHING
+		), removed AS (
+			DELETE FROM article_tags
+			WHERE article_id = $1 AND tag != ALL(COALESCE($2::text[], '{}'))
+			RETURNING tag
+		), added AS (
+			INSERT INTO article_tags (article_id, tag)
+			SELECT $1, UNNEST($2::text[])
+			ON CONFLICT DO NOTHING
+			RETURNING tag
+		)
+		SELECT pg_notify('article_updated', a.id::text)
+		FROM articles a
+		WHERE a.id = $1
+			AND a.status = 'published'
+			AND (EXISTS (SELECT 1 FROM removed) OR EXISTS (SELECT 1 FROM added))`,
+		id,
+		pq.Array(a.Tags),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// retract withdraws an article written by authorID, or an anonymous one
+// when it's 0. Scheduled articles are never published. Retracting an
+// article twice is fine.
+func (r *articleRepository) retract(id int64, authorID int64) error {
+	res, err := r.db.Exec(`
+		UPDATE articles
+		SET status = 'retracted'
+		WHERE id = $1 AND author_id IS NOT DISTINCT FROM NULLIF($2::bigint, 0)`,
+		id,
+		authorID,
+	)
+
+	return affectedOne(res, err)
+}
+
+// stored returns an article written by authorID, or an anonymous one when
+// it's 0, whatever its status.
+func (r *articleRepository) stored(id int64, authorID int64) (StoredArticle, error) {
+	articles, err := r.storedArticles(`
+		WHERE a.id = $1 AND a.author_id IS NOT DISTINCT FROM NULLIF($2::bigint, 0)`,
+		id,
+		authorID,
+	)
+	if err != nil {
+		return StoredArticle{}, err
+	}
+	if len(articles) == 0 {
+		return StoredArticle{}, errArticleNotFound
+	}
+
+	return articles[0], nil
+}
+
+// reviewQueue returns the articles waiting for review, oldest submission
+// first.
+func (r *articleRepository) reviewQueue(limit int) ([]StoredArticle, error) {
+	return r.storedArticles(`
+		WHERE a.status = 'in_review'
+		ORDER BY a.submitted_at, a.id
+		LIMIT $1`,
+		limit,
+	)
+}
+
+func (r *articleRepository) storedArticles(where string, args ...interface{}) ([]StoredArticle, error) {
+	rows, err := r.db.Query(`
+		SELECT
+			a.id,
+			a.title,
+			a.body,
+			COALESCE(a.category, ''),
+			(SELECT ARRAY_AGG(t.tag ORDER BY t.tag) FROM article_tags t WHERE t.article_id = a.id),
+			COALESCE(a.external_id, ''),
+			a.published_at,
+			a.status,
+			COALESCE(j.name, ''),
+			a.submitted_at,
+			COALESCE(a.review_note, '')
+		FROM articles a
+		LEFT JOIN journalists j ON j.id = a.author_id
+		`+where,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var articles []StoredArticle
+	for rows.Next() {
+		var a StoredArticle
+		var publishedAt, submittedAt sql.NullTime
+		err := rows.Scan(
+			&a.ID,
+			&a.Title,
+			&a.Body,
+			&a.Category,
+			pq.Array(&a.Tags),
+			&a.ExternalID,
+			&publishedAt,
+			&a.Status,
+			&a.Author,
+			&submittedAt,
+			&a.ReviewNote,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Until published, published_at is the time asked for
+		switch {
+		case a.Status == statusPublished || a.Status == statusRetracted:
+			a.PublishedAt = &publishedAt.Time
+		case publishedAt.Valid:
+			a.PublishAt = &publishedAt.Time
+		}
+		if submittedAt.Valid {
+			a.SubmittedAt = &submittedAt.Time
+		}
+		a.Draft = a.Status == statusDraft
+
+		articles = append(articles, a)
+	}
+
+	return articles, rows.Err()
+}
+
+// submit sends a draft written by authorID, or an anonymous one when it's
+// 0, to review. When reviews aren't required it's published, or scheduled
+// when its publish time is ahead.
+func (r *articleRepository) submit(id int64, authorID int64, review bool) error {
+	res, err := r.db.Exec(`
+		UPDATE articles
+		SET status = CASE
+				WHEN $3 THEN 'in_review'
+				WHEN published_at > $4 THEN 'scheduled'
+				ELSE 'published'
+			END,
+			published_at = CASE WHEN $3 OR published_at > $4 THEN published_at ELSE $4 END,
+			submitted_at = $4
+		WHERE id = $1
+			AND status = 'draft'
+			AND author_id IS NOT DISTINCT FROM NULLIF($2::bigint, 0)`,
+		id,
+		authorID,
+		review,
 		r.clock.Now().UTC(),
 	)
+
+	return affectedOne(res, err)
+}
+
+// approve marks an article in review as approved by editorID, for the
+// scheduler to publish it when it's due. Editors can't approve their own
+// articles.
+func (r *articleRepository) approve(id int64, editorID int64) error {
+	res, err := r.db.Exec(`
+		UPDATE articles
+		SET status = 'approved',
+			published_at = GREATEST(published_at, $3),
+			reviewed_by = $2,
+			review_note = NULL
+		WHERE id = $1
+			AND status = 'in_review'
+			AND author_id IS DISTINCT FROM $2`,
+		id,
+		editorID,
+		r.clock.Now().UTC(),
+	)
+
+	return affectedOne(res, err)
+}
+
+// reject sends an article in review back to draft, with a note for its
+// author. Editors can't reject their own articles.
+func (r *articleRepository) reject(id int64, editorID int64, note string) error {
+	res, err := r.db.Exec(`
+		UPDATE articles
+		SET status = 'draft',
+			reviewed_by = $2,
+			review_note = NULLIF($3, '')
+		WHERE id = $1
+			AND status = 'in_review'
+			AND author_id IS DISTINCT FROM $2`,
+		id,
+		editorID,
+		note,
+	)
+
+	return affectedOne(res, err)
+}
+
+// affectedOne returns errArticleNotFound when the statement didn't change
+// any article.
+func affectedOne(res sql.Result, err error) error {
 	if err != nil {
 		return err
 	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errArticleNotFound
+	}
+
 	return nil
 }
+
+// nextScheduled returns the time the next scheduled or approved article is
+// due, false when there are none.
+func (r *articleRepository) nextScheduled() (time.Time, bool, error) {
+	var next sql.NullTime
+	err := r.db.QueryRow(`
+		SELECT MIN(published_at)
+		FROM articles
+		WHERE status IN ('scheduled', 'approved')`,
+	).Scan(&next)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return next.Time, next.Valid, nil
+}
+
+// releaseDue publishes the oldest scheduled or approved article due at now and returns
+// its id, errNoneDue when there's none. Articles are released one at a
+// time so they're numbered in the order they were due. Rows being released
+// by another instance are skipped.
+func (r *articleRepository) releaseDue(now time.Time) (int64, error) {
+	var id int64
+	err := r.db.QueryRow(`
+		UPDATE articles
+		SET status = 'published'
+		WHERE id = (
+			SELECT id
+			FROM articles
+			WHERE status IN ('scheduled', 'approved') AND published_at <= $1
+			ORDER BY published_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id`,
+		now,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errNoneDue
+	}
+
+	return id, err
+}
@@ -1,11 +1,14 @@
 package aggregator
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"testing"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/XaviFP/notifications/migrations"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/tilinna/clock"
 )
@@ -22,14 +25,14 @@ func TestRepository(t *testing.T) {
 	expected := Article{
 		Title:    "test-title",
 		Body:     "test-body",
-		Category: "testcategory",
+		Category: "travel",
 	}
 
-	err = repo.store(expected)
+	id, err := repo.store(expected)
 	assert.Nil(t, err)
 
 	var actual Article
-	row := db.QueryRow("SELECT title, body, category, published_at FROM articles")
+	row := db.QueryRow("SELECT title, body, category, published_at FROM articles WHERE id = $1", id)
 	err = row.Scan(&actual.Title, &actual.Body, &actual.Category, &actual.PublishedAt)
 	assert.Nil(t, err)
 
@@ -37,6 +40,432 @@ func TestRepository(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestRepository_ExternalID(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewArticleRepository(db, clock.Realtime())
+
+	a := Article{Title: "title", Body: "body", Category: "japan", ExternalID: "feed-1"}
+	first, err := repo.store(a)
+	assert.Nil(t, err)
+
+	// A retry gets the stored article back
+	a.Title = "retried"
+	second, err := repo.store(a)
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+
+	// Articles without external id are always stored
+	a.ExternalID = ""
+	third, err := repo.store(a)
+	assert.Nil(t, err)
+	fourth, err := repo.store(a)
+	assert.Nil(t, err)
+	assert.NotEqual(t, third, fourth)
+
+	// External ids are chosen by each journalist
+	journalists := NewJournalistRepository(db)
+	alice, _, err := AddJournalist(journalists, "Alice")
+	assert.Nil(t, err)
+	bob, _, err := AddJournalist(journalists, "Bob")
+	assert.Nil(t, err)
+
+	a = Article{Title: "title", ExternalID: "feed-1", AuthorID: alice.ID}
+	alices, err := repo.store(a)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, alices)
+	a.AuthorID = bob.ID
+	bobs, err := repo.store(a)
+	assert.Nil(t, err)
+	assert.NotEqual(t, alices, bobs)
+
+	id, err := repo.byExternalID(bob.ID, "feed-1")
+	assert.Nil(t, err)
+	assert.Equal(t, bobs, id)
+	id, err = repo.byExternalID(0, "feed-1")
+	assert.Nil(t, err)
+	assert.Equal(t, first, id)
+	_, err = repo.byExternalID(bob.ID, "feed-2")
+	assert.Equal(t, errArticleNotFound, err)
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM articles").Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+}
+
+func TestRepository_StoreBatch(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewArticleRepository(db, clock.Realtime())
+
+	ids, err := repo.storeBatch([]Article{
+		{Title: "first", ExternalID: "feed-1"},
+		{Title: "second"},
+		{Title: "first again", ExternalID: "feed-1"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, ids, 3)
+	assert.Equal(t, ids[0], ids[2])
+
+	// A failing article rolls the whole batch back
+	_, err = repo.storeBatch([]Article{
+		{Title: "third"},
+		{Title: "invalid", ExternalID: "feed-2\x00"},
+	})
+	assert.NotNil(t, err)
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM articles").Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestJournalistRepository(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewJournalistRepository(db)
+
+	j, token, err := AddJournalist(repo, "Alice")
+	assert.Nil(t, err)
+
+	actual, err := repo.journalistByToken(hashToken(token))
+	assert.Nil(t, err)
+	assert.Equal(t, j, actual)
+
+	_, err = repo.journalistByToken(hashToken("wrong"))
+	assert.Equal(t, errJournalistNotFound, err)
+
+	id, err := NewArticleRepository(db, clock.Realtime()).store(Article{Title: "title", AuthorID: j.ID})
+	assert.Nil(t, err)
+
+	var authorID int64
+	err = db.QueryRow("SELECT author_id FROM articles WHERE id = $1", id).Scan(&authorID)
+	assert.Nil(t, err)
+	assert.Equal(t, j.ID, authorID)
+}
+
+func TestRepository_Scheduled(t *testing.T) {
+	db := newTestDB(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clockMock := clock.NewMock(now)
+	repo := NewArticleRepository(db, clockMock)
+
+	publishAt := now.Add(time.Hour)
+	id, err := repo.store(Article{Title: "embargoed", PublishAt: &publishAt})
+	assert.Nil(t, err)
+
+	// Past publish times are published right away
+	past := now.Add(-time.Hour)
+	_, err = repo.store(Article{Title: "late", PublishAt: &past})
+	assert.Nil(t, err)
+
+	var status string
+	var seq sql.NullInt64
+	err = db.QueryRow("SELECT status, seq FROM articles WHERE id = $1", id).Scan(&status, &seq)
+	assert.Nil(t, err)
+	assert.Equal(t, statusScheduled, status)
+	assert.False(t, seq.Valid)
+
+	next, ok, err := repo.nextScheduled()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, publishAt.Equal(next))
+
+	_, err = repo.releaseDue(publishAt.Add(-time.Second))
+	assert.Equal(t, errNoneDue, err)
+
+	released, err := repo.releaseDue(publishAt)
+	assert.Nil(t, err)
+	assert.Equal(t, id, released)
+
+	var publishedAt time.Time
+	err = db.QueryRow("SELECT status, seq, published_at FROM articles WHERE id = $1", id).Scan(&status, &seq, &publishedAt)
+	assert.Nil(t, err)
+	assert.Equal(t, statusPublished, status)
+	assert.True(t, seq.Valid)
+	assert.True(t, publishAt.Equal(publishedAt))
+
+	_, ok, err = repo.nextScheduled()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestRepository_UpdateRetract(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewArticleRepository(db, clock.Realtime())
+
+	alice, _, err := AddJournalist(NewJournalistRepository(db), "Alice")
+	assert.Nil(t, err)
+
+	id, err := repo.store(Article{Title: "title", Body: "body", Category: "japan", AuthorID: alice.ID})
+	assert.Nil(t, err)
+
+	// Only the author may change an article
+	err = repo.update(id, Article{Title: "fixed", Body: "body", Category: "japan"})
+	assert.Equal(t, errArticleNotFound, err)
+	err = repo.retract(id, 0)
+	assert.Equal(t, errArticleNotFound, err)
+
+	err = repo.update(id, Article{Title: "fixed", Body: "body", Category: "japan", AuthorID: alice.ID})
+	assert.Nil(t, err)
+
+	var title, status string
+	err = db.QueryRow("SELECT title, status FROM articles WHERE id = $1", id).Scan(&title, &status)
+	assert.Nil(t, err)
+	assert.Equal(t, "fixed", title)
+	assert.Equal(t, statusPublished, status)
+
+	err = repo.retract(id, alice.ID)
+	assert.Nil(t, err)
+	err = repo.retract(id, alice.ID)
+	assert.Nil(t, err)
+
+	err = db.QueryRow("SELECT status FROM articles WHERE id = $1", id).Scan(&status)
+	assert.Nil(t, err)
+	assert.Equal(t, statusRetracted, status)
+
+	// Retracted articles can't be brought back
+	err = repo.update(id, Article{Title: "again", Body: "body", Category: "japan", AuthorID: alice.ID})
+	assert.Equal(t, errArticleNotFound, err)
+
+	err = repo.update(id+1, Article{Title: "missing"})
+	assert.Equal(t, errArticleNotFound, err)
+}
+
+func TestRepository_Tags(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewArticleRepository(db, clock.Realtime())
+
+	alice, _, err := AddJournalist(NewJournalistRepository(db), "Alice")
+	assert.Nil(t, err)
+
+	a := Article{Title: "title", Body: "body", Category: "japan", AuthorID: alice.ID, ExternalID: "feed-1", Tags: []string{"trains", "food"}}
+	id, err := repo.store(a)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"food", "trains"}, articleTags(t, db, id))
+
+	// A retry doesn't tag the stored article again
+	a.Tags = []string{"retried"}
+	retried, err := repo.store(a)
+	assert.Nil(t, err)
+	assert.Equal(t, id, retried)
+	assert.Equal(t, []string{"food", "trains"}, articleTags(t, db, id))
+
+	// Updates replace the tags
+	err = repo.update(id, Article{Title: "title", Body: "body", Category: "japan", AuthorID: alice.ID, Tags: []string{"trains", "travel"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"trains", "travel"}, articleTags(t, db, id))
+
+	err = repo.update(id, Article{Title: "title", Body: "body", Category: "japan", AuthorID: alice.ID})
+	assert.Nil(t, err)
+	assert.Empty(t, articleTags(t, db, id))
+}
+
+func articleTags(t *testing.T, db *sql.DB, id int64) []string {
+	var tags []string
+	err := db.QueryRow("SELECT ARRAY_AGG(tag ORDER BY tag) FROM article_tags WHERE article_id = $1", id).Scan(pq.Array(&tags))
+	assert.Nil(t, err)
+
+	return tags
+}
+
+func TestRepository_Review(t *testing.T) {
+	db := newTestDB(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clockMock := clock.NewMock(now)
+	repo := NewArticleRepository(db, clockMock)
+	journalists := NewJournalistRepository(db)
+
+	alice, _, err := AddJournalist(journalists, "Alice")
+	assert.Nil(t, err)
+	eve, token, err := AddEditor(journalists, "Eve")
+	assert.Nil(t, err)
+	actual, err := journalists.journalistByToken(hashToken(token))
+	assert.Nil(t, err)
+	assert.True(t, actual.Editor)
+
+	status := func(id int64) string {
+		var status string
+		err := db.QueryRow("SELECT status FROM articles WHERE id = $1", id).Scan(&status)
+		assert.Nil(t, err)
+		return status
+	}
+
+	id, err := repo.store(Article{Title: "title", Body: "body", Category: "japan", AuthorID: alice.ID, Draft: true})
+	assert.Nil(t, err)
+	assert.Equal(t, statusDraft, status(id))
+
+	err = repo.submit(id, eve.ID, true)
+	assert.Equal(t, errArticleNotFound, err)
+	err = repo.submit(id, alice.ID, true)
+	assert.Nil(t, err)
+	assert.Equal(t, statusInReview, status(id))
+
+	queue, err := repo.reviewQueue(10)
+	assert.Nil(t, err)
+	assert.Len(t, queue, 1)
+	assert.Equal(t, id, queue[0].ID)
+	assert.Equal(t, "Alice", queue[0].Author)
+	assert.True(t, now.Equal(*queue[0].SubmittedAt))
+
+	// Editors don't review their own articles
+	err = repo.approve(id, alice.ID)
+	assert.Equal(t, errArticleNotFound, err)
+
+	err = repo.reject(id, eve.ID, "Needs a source")
+	assert.Nil(t, err)
+	stored, err := repo.stored(id, alice.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, statusDraft, stored.Status)
+	assert.Equal(t, "Needs a source", stored.ReviewNote)
+	assert.Nil(t, stored.PublishedAt)
+
+	err = repo.submit(id, alice.ID, true)
+	assert.Nil(t, err)
+	err = repo.approve(id, eve.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, statusApproved, status(id))
+	err = repo.approve(id, eve.ID)
+	assert.Equal(t, errArticleNotFound, err)
+
+	// Approved articles are published by the scheduler
+	next, ok, err := repo.nextScheduled()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, now.Equal(next))
+	released, err := repo.releaseDue(now)
+	assert.Nil(t, err)
+	assert.Equal(t, id, released)
+	assert.Equal(t, statusPublished, status(id))
+
+	// Articles sent for review go straight to the queue, and go back to it
+	// when changed after their approval
+	publishAt := now.Add(time.Hour)
+	reviewed, err := repo.store(Article{Title: "title", Category: "japan", AuthorID: alice.ID, PublishAt: &publishAt, review: true})
+	assert.Nil(t, err)
+	assert.Equal(t, statusInReview, status(reviewed))
+	err = repo.approve(reviewed, eve.ID)
+	assert.Nil(t, err)
+	_, err = repo.releaseDue(now)
+	assert.Equal(t, errNoneDue, err)
+	err = repo.update(reviewed, Article{Title: "changed", Category: "japan", AuthorID: alice.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, statusInReview, status(reviewed))
+
+	// Without reviews, submitted drafts are published
+	draft, err := repo.store(Article{Title: "title", Category: "japan", Draft: true})
+	assert.Nil(t, err)
+	err = repo.submit(draft, 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, statusPublished, status(draft))
+}
+
+func TestModerationRepository(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewModerationRepository(db)
+
+	alice, _, err := AddJournalist(NewJournalistRepository(db), "Alice")
+	assert.Nil(t, err)
+	id, err := NewArticleRepository(db, clock.Realtime()).store(Article{Title: "**** trains", Category: "japan", AuthorID: alice.ID})
+	assert.Nil(t, err)
+
+	err = repo.logDecision(ModerationDecision{
+		ArticleID: id,
+		AuthorID:  alice.ID,
+		Title:     "darn trains",
+		Action:    ActionFix,
+		Hits:      []ModerationHit{{Rule: "blocked_terms", Action: ActionFix, Reason: `contains blocked term "darn"`}},
+	})
+	assert.Nil(t, err)
+	// Rejected articles have no id, allowed ones no hits
+	err = repo.logDecision(ModerationDecision{AuthorID: alice.ID, Title: "test", Action: ActionReject, Hits: []ModerationHit{{Rule: "pattern:test junk", Action: ActionReject, Reason: "matches test junk"}}})
+	assert.Nil(t, err)
+	err = repo.logDecision(ModerationDecision{Title: "title", Action: ActionAllow})
+	assert.Nil(t, err)
+
+	rows, err := db.Query("SELECT COALESCE(article_id, 0), action, hits::text FROM moderation_decisions ORDER BY id")
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	var actual []string
+	for rows.Next() {
+		var articleID int64
+		var action, hits string
+		err := rows.Scan(&articleID, &action, &hits)
+		assert.Nil(t, err)
+		actual = append(actual, fmt.Sprintf("%t %s %s", articleID == id, action, hits))
+	}
+	assert.Equal(t, []string{
+		`true fix [{"rule": "blocked_terms", "action": "fix", "reason": "contains blocked term \"darn\""}]`,
+		`false reject [{"rule": "pattern:test junk", "action": "reject", "reason": "matches test junk"}]`,
+		`false allow []`,
+	}, actual)
+}
+
+func TestRepository_Limits(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewJournalistRepository(db)
+
+	j, token, err := AddJournalist(repo, "Alice")
+	assert.Nil(t, err)
+
+	limits := &Limits{RatePerMinute: 0.5, Burst: 3, DailyQuota: 20}
+	assert.Nil(t, SetLimits(repo, j.ID, limits))
+	actual, err := repo.journalistByToken(hashToken(token))
+	assert.Nil(t, err)
+	assert.Equal(t, limits, actual.Limits)
+
+	// Back to the defaults
+	assert.Nil(t, SetLimits(repo, j.ID, nil))
+	actual, err = repo.journalistByToken(hashToken(token))
+	assert.Nil(t, err)
+	assert.Nil(t, actual.Limits)
+
+	assert.Equal(t, errJournalistNotFound, SetLimits(repo, j.ID+1, limits))
+
+	quotas := NewQuotaRepository(db)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := fmt.Sprintf("journalist:%d", j.ID)
+
+	ok, err := quotas.reserve(key, day, 2, 3)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = quotas.reserve(key, day, 2, 3)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = quotas.reserve(key, day, 4, 3)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Quotas start over every day
+	ok, err = quotas.reserve(key, day.AddDate(0, 0, 1), 3, 3)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Nil(t, quotas.release(key, day, 2))
+	ok, err = quotas.reserve(key, day, 3, 3)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestCategoryRepository(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewCategoryRepository(db)
+
+	for _, category := range []string{"technology", "TECHNOLOGY", "Tech"} {
+		slug, err := repo.resolveCategory(category)
+		assert.Nil(t, err)
+		assert.Equal(t, "technology", slug)
+	}
+
+	_, err := repo.resolveCategory("sports")
+	assert.Equal(t, errCategoryNotFound, err)
+
+	// Articles can only be filed under known categories
+	_, err = NewArticleRepository(db, clock.Realtime()).store(Article{Title: "title", Category: "sports"})
+	assert.NotNil(t, err)
+}
+
 func newTestDB(t *testing.T) *sql.DB {
 	dbConfig := DbConfig{
 		Host:     "localhost",
@@ -50,12 +479,28 @@ func newTestDB(t *testing.T) *sql.DB {
 	if err != nil {
 		panic(err)
 	}
+	_, err = migrations.Up(context.Background(), db)
+	if err != nil {
+		panic(err)
+	}
 	_, err = db.Exec("DELETE FROM articles")
 	t.Cleanup(func() {
 		defer db.Close()
 
+		_, err = db.Exec("DELETE FROM moderation_decisions")
+		assert.Nil(t, err)
+
 		_, err = db.Exec("DELETE FROM articles")
 		assert.Nil(t, err)
+
+		_, err = db.Exec("DELETE FROM journalists")
+		assert.Nil(t, err)
+
+		_, err = db.Exec("DELETE FROM tags")
+		assert.Nil(t, err)
+
+		_, err = db.Exec("DELETE FROM publishing_usage")
+		assert.Nil(t, err)
 	})
 
 	return db
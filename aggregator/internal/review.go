@@ -0,0 +1,124 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// reviewQueueSize is the number of articles listed in the review queue.
+	reviewQueueSize = 100
+	// maxReviewNote bounds the notes editors leave on rejected articles.
+	maxReviewNote = 500
+)
+
+var forbidden = &errorPayload{Code: "forbidden", Message: "Only editors review articles"}
+
+type reviewQueuePayload struct {
+	Articles []StoredArticle `json:"articles"`
+}
+
+// reviewRequest is the optional body of POST /review/{id}/reject.
+type reviewRequest struct {
+	Note string `json:"note"`
+}
+
+// reviewQueue handles GET /review, listing the articles waiting for an
+// editor, oldest submission first.
+func (s *Server) reviewQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, failurePayload{Error: methodNotAllowedError})
+		return
+	}
+	if _, ok := s.authenticateEditor(w, r); !ok {
+		return
+	}
+
+	articles, err := s.articleRepo.reviewQueue(reviewQueueSize)
+	if err != nil {
+		log.Println("error loading review queue:", err)
+		writeFailure(w, storageError)
+		return
+	}
+	if articles == nil {
+		articles = []StoredArticle{}
+	}
+
+	writeJSON(w, http.StatusOK, reviewQueuePayload{Articles: articles})
+}
+
+// reviewArticle handles POST /review/{id}/approve, letting the article be
+// published when it's due, and POST /review/{id}/reject, sending it back
+// to its author with an optional note. Editors can't review their own
+// articles.
+func (s *Server) reviewArticle(w http.ResponseWriter, r *http.Request) {
+	path, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/review/"), "/")
+	if action != "approve" && action != "reject" {
+		writeFailure(w, notFoundError)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, failurePayload{Error: methodNotAllowedError})
+		return
+	}
+
+	editor, ok := s.authenticateEditor(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(path, 10, 64)
+	if err != nil || id <= 0 {
+		writeFailure(w, notFoundError)
+		return
+	}
+
+	if action == "approve" {
+		err = s.articleRepo.approve(id, editor.ID)
+		if err == nil {
+			s.scheduler.Wake()
+		}
+	} else {
+		var req reviewRequest
+		err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req)
+		if err != nil && !errors.Is(err, io.EOF) {
+			writeJSON(w, http.StatusBadRequest, failurePayload{Error: malformedError})
+			return
+		}
+		note := normalizeText(req.Note)
+		if utf8.RuneCountInString(note) > maxReviewNote {
+			writeFailure(w, invalidArticleError(&ValidationError{Field: "note", Reason: fmt.Sprintf("must be at most %d characters", maxReviewNote)}))
+			return
+		}
+		err = s.articleRepo.reject(id, editor.ID, note)
+	}
+	if errPayload := changeError(err); errPayload != nil {
+		writeFailure(w, errPayload)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, storedPayload{ArticleID: id})
+}
+
+// authenticateEditor returns the editor making the request, answering the
+// request itself when it isn't one.
+func (s *Server) authenticateEditor(w http.ResponseWriter, r *http.Request) (*Journalist, bool) {
+	editor, err := s.authenticate(r)
+	if err != nil {
+		writeAuthFailure(w, err)
+		return nil, false
+	}
+	if editor == nil || !editor.Editor {
+		writeJSON(w, http.StatusForbidden, failurePayload{Error: forbidden})
+		return nil, false
+	}
+
+	return editor, true
+}
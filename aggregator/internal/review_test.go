@@ -0,0 +1,172 @@
+package aggregator
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestServer_Review(t *testing.T) {
+	journalists := &mockJournalistRepository{}
+	journalists.On("journalistByToken", hashToken("editor")).Return(Journalist{ID: 1, Name: "Eve", Editor: true}, nil)
+	journalists.On("journalistByToken", hashToken("alice")).Return(Journalist{ID: 2, Name: "Alice"}, nil)
+	journalists.On("journalistByToken", mock.Anything).Return(Journalist{}, errJournalistNotFound)
+
+	submittedAt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	repo := &mockArticleRepository{done: make(chan struct{}, 1)}
+	repo.On("reviewQueue", reviewQueueSize).Return([]StoredArticle{
+		{ID: 3, Article: Article{Title: "title", Body: "body", Category: "japan"}, Status: statusInReview, Author: "Alice", SubmittedAt: &submittedAt},
+	}, nil).Once()
+	repo.On("reviewQueue", reviewQueueSize).Return(nil, errors.New("connection refused"))
+	repo.On("approve", int64(3), int64(1)).Return(nil)
+	repo.On("approve", int64(4), int64(1)).Return(errArticleNotFound)
+	repo.On("reject", int64(3), int64(1), "Needs a source").Return(nil)
+	repo.On("reject", int64(5), int64(1), "").Return(nil)
+	// Reviewed articles are stored as in review
+	repo.On("store", Article{Title: "title", AuthorID: 2, review: true}).Return(int64(6), nil)
+
+	srv := NewServer(repo, journalists, nil, nil, ValidationRules{RequireTitle: true}, nil, nil, true)
+
+	// The queue fails once it's been listed, cases run in order
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		status   int
+		expected string
+	}{
+		{
+			name:   "queue",
+			method: http.MethodGet,
+			path:   "/review",
+			token:  "editor",
+			status: http.StatusOK,
+			expected: `{"articles": [
+				{"id": 3, "title": "title", "body": "body", "category": "japan", "status": "in_review", "author": "Alice", "submitted_at": "2020-01-01T12:00:00Z"}
+			]}`,
+		},
+		{
+			name:     "queue storage error",
+			method:   http.MethodGet,
+			path:     "/review",
+			token:    "editor",
+			status:   http.StatusInternalServerError,
+			expected: `{"error": {"code": "storage_error", "message": "Article could not be stored"}}`,
+		},
+		{
+			name:     "approved",
+			method:   http.MethodPost,
+			path:     "/review/3/approve",
+			token:    "editor",
+			status:   http.StatusOK,
+			expected: `{"article_id": 3}`,
+		},
+		{
+			name:     "approve not in review",
+			method:   http.MethodPost,
+			path:     "/review/4/approve",
+			token:    "editor",
+			status:   http.StatusNotFound,
+			expected: `{"error": {"code": "not_found", "message": "Article not found"}}`,
+		},
+		{
+			name:     "rejected",
+			method:   http.MethodPost,
+			path:     "/review/3/reject",
+			token:    "editor",
+			body:     `{"note": " Needs a source "}`,
+			status:   http.StatusOK,
+			expected: `{"article_id": 3}`,
+		},
+		{
+			name:     "rejected without note",
+			method:   http.MethodPost,
+			path:     "/review/5/reject",
+			token:    "editor",
+			status:   http.StatusOK,
+			expected: `{"article_id": 5}`,
+		},
+		{
+			name:     "note too long",
+			method:   http.MethodPost,
+			path:     "/review/3/reject",
+			token:    "editor",
+			body:     `{"note": "` + strings.Repeat("a", maxReviewNote+1) + `"}`,
+			status:   http.StatusUnprocessableEntity,
+			expected: `{"error": {"code": "invalid_article", "message": "note must be at most 500 characters", "field": "note"}}`,
+		},
+		{
+			name:     "malformed",
+			method:   http.MethodPost,
+			path:     "/review/3/reject",
+			token:    "editor",
+			body:     `{"note": `,
+			status:   http.StatusBadRequest,
+			expected: `{"error": {"code": "invalid_message", "message": "Malformed message"}}`,
+		},
+		{
+			name:     "not an editor",
+			method:   http.MethodPost,
+			path:     "/review/3/approve",
+			token:    "alice",
+			status:   http.StatusForbidden,
+			expected: `{"error": {"code": "forbidden", "message": "Only editors review articles"}}`,
+		},
+		{
+			name:     "unauthorized",
+			method:   http.MethodGet,
+			path:     "/review",
+			token:    "wrong",
+			status:   http.StatusUnauthorized,
+			expected: `{"error": {"code": "unauthorized", "message": "Unauthorized"}}`,
+		},
+		{
+			name:     "unknown action",
+			method:   http.MethodPost,
+			path:     "/review/3/publish",
+			token:    "editor",
+			status:   http.StatusNotFound,
+			expected: `{"error": {"code": "not_found", "message": "Article not found"}}`,
+		},
+		{
+			name:     "method not allowed",
+			method:   http.MethodGet,
+			path:     "/review/3/approve",
+			token:    "editor",
+			status:   http.StatusMethodNotAllowed,
+			expected: `{"error": {"code": "invalid_message", "message": "Method not allowed"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			if tt.path == "/review" {
+				srv.reviewQueue(w, r)
+			} else {
+				srv.reviewArticle(w, r)
+			}
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(`{"title": "title"}`))
+	r.Header.Set("Authorization", "Bearer alice")
+	srv.postArticle(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	repo.AssertExpectations(t)
+}
@@ -0,0 +1,135 @@
+package aggregator
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tilinna/clock"
+)
+
+// schedulerPoll bounds how long the scheduler sleeps, so articles scheduled
+// through another aggregator are released on time too.
+const schedulerPoll = time.Minute
+
+// schedulerRetry is how long the scheduler waits after failing to release
+// articles.
+const schedulerRetry = 5 * time.Second
+
+// Scheduler publishes scheduled articles when they're due. It keeps no
+// state of its own, so articles due while the aggregator was down are
+// released as soon as it starts.
+type Scheduler struct {
+	articleRepo ArticleRepository
+	clock       clock.Clock
+
+	wake     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+	mut      sync.Mutex
+	running  bool
+}
+
+func NewScheduler(articleRepository ArticleRepository, c clock.Clock) *Scheduler {
+	return &Scheduler{
+		articleRepo: articleRepository,
+		clock:       c,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+func (s *Scheduler) Run() {
+	s.mut.Lock()
+	s.running = true
+	s.mut.Unlock()
+
+	go func() {
+		defer close(s.stopped)
+
+		for {
+			wait := schedulerRetry
+			if s.release() {
+				wait = s.untilNext()
+			}
+
+			timer := s.clock.NewTimer(wait)
+			select {
+			case <-s.done:
+				timer.Stop()
+				return
+			case <-s.wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// Stop waits for the articles being released, if the scheduler was run.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+
+		s.mut.Lock()
+		running := s.running
+		s.mut.Unlock()
+		if running {
+			<-s.stopped
+		}
+	})
+}
+
+// Wake makes the scheduler look for the next article due again, after a
+// new one was scheduled. It does nothing on a nil scheduler.
+func (s *Scheduler) Wake() {
+	if s == nil {
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// release publishes every article due, telling whether it could.
+func (s *Scheduler) release() bool {
+	now := s.clock.Now().UTC()
+	for {
+		id, err := s.articleRepo.releaseDue(now)
+		if errors.Is(err, errNoneDue) {
+			return true
+		}
+		if err != nil {
+			log.Println("error releasing scheduled articles:", err)
+			return false
+		}
+
+		log.Printf("released scheduled article %d", id)
+	}
+}
+
+func (s *Scheduler) untilNext() time.Duration {
+	next, ok, err := s.articleRepo.nextScheduled()
+	if err != nil {
+		log.Println("error loading scheduled articles:", err)
+		return schedulerPoll
+	}
+	if !ok {
+		return schedulerPoll
+	}
+
+	wait := next.Sub(s.clock.Now())
+	if wait < 0 {
+		return 0
+	}
+	if wait > schedulerPoll {
+		return schedulerPoll
+	}
+
+	return wait
+}
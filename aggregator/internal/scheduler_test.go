@@ -0,0 +1,106 @@
+package aggregator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tilinna/clock"
+)
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clk := clock.NewMock(start)
+	due := start.Add(10 * time.Second)
+	later := due.Add(5 * time.Second)
+
+	released := make(chan int64, 3)
+	record := func(id int64) func(mock.Arguments) {
+		return func(mock.Arguments) { released <- id }
+	}
+	// Every check for the next article is followed by a new timer
+	checked := make(chan struct{}, 4)
+	check := func(mock.Arguments) { checked <- struct{}{} }
+	waitTimer := func() {
+		<-checked
+		assert.Eventually(t, func() bool { return clk.Len() == 1 }, time.Second, time.Millisecond)
+	}
+
+	repo := &mockArticleRepository{}
+	// Articles due while the aggregator was down are released on start
+	repo.On("releaseDue", start).Run(record(1)).Return(int64(1), nil).Once()
+	repo.On("releaseDue", start).Return(int64(0), errNoneDue).Once()
+	repo.On("nextScheduled").Run(check).Return(due, true, nil).Once()
+	repo.On("releaseDue", due).Run(record(2)).Return(int64(2), nil).Once()
+	repo.On("releaseDue", due).Return(int64(0), errNoneDue).Once()
+	repo.On("nextScheduled").Run(check).Return(time.Time{}, false, nil).Once()
+	// Woken up after an article is scheduled
+	repo.On("releaseDue", due).Return(int64(0), errNoneDue).Once()
+	repo.On("nextScheduled").Run(check).Return(later, true, nil).Once()
+	repo.On("releaseDue", later).Run(record(3)).Return(int64(3), nil).Once()
+	repo.On("releaseDue", later).Return(int64(0), errNoneDue).Once()
+	repo.On("nextScheduled").Run(check).Return(time.Time{}, false, nil)
+
+	s := NewScheduler(repo, clk)
+	s.Run()
+	assert.Equal(t, int64(1), <-released)
+
+	waitTimer()
+	clk.Add(9 * time.Second)
+	assert.Empty(t, released)
+
+	// Released exactly when due
+	clk.Add(time.Second)
+	assert.Equal(t, int64(2), <-released)
+
+	waitTimer()
+	s.Wake()
+	waitTimer()
+	clk.Add(5 * time.Second)
+	assert.Equal(t, int64(3), <-released)
+
+	waitTimer()
+	s.Stop()
+	repo.AssertExpectations(t)
+}
+
+func TestScheduler_StopWithoutRun(t *testing.T) {
+	s := NewScheduler(&mockArticleRepository{}, clock.NewMock(time.Now()))
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop waited for a scheduler never run")
+	}
+}
+
+func TestServer_WakesScheduler(t *testing.T) {
+	repo := &mockArticleRepository{done: make(chan struct{}, 2)}
+	repo.On("store", mock.Anything).Return(int64(1), nil)
+
+	scheduler := NewScheduler(repo, clock.Realtime())
+	srv := NewServer(repo, nil, nil, scheduler, ValidationRules{}, nil, nil, false)
+
+	w := httptest.NewRecorder()
+	srv.postArticle(w, httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(`{"title": "now"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Len(t, scheduler.wake, 0)
+
+	w = httptest.NewRecorder()
+	srv.postArticle(w, httptest.NewRequest(http.MethodPost, "/articles", strings.NewReader(`{"title": "later", "publish_at": "2030-01-01T09:00:00Z"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Len(t, scheduler.wake, 1)
+
+	publishAt := time.Date(2030, 1, 1, 9, 0, 0, 0, time.UTC)
+	repo.AssertCalled(t, "store", Article{Title: "later", PublishAt: &publishAt})
+}
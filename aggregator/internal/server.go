@@ -1,23 +1,122 @@
 package aggregator
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type Server struct {
-	articleRepo ArticleRepository
+	articleRepo    ArticleRepository
+	journalistRepo JournalistRepository
+	categoryRepo   CategoryRepository
+	scheduler      *Scheduler
+	validator      *validator
+	moderator      *Moderator
+	limiter        *Limiter
+	// review holds articles for editors to approve before they're
+	// published.
+	review bool
+
+	// handlers tracks the publisher connections being served, so shutdown
+	// can wait for them.
+	handlers sync.WaitGroup
+	connsMut sync.Mutex
+	conns    map[*websocket.Conn]struct{}
 }
 
-func NewServer(articleRepository ArticleRepository) *Server {
+// NewServer returns the aggregator server, storing the articles that pass
+// the validation rules. Journalists authenticate with the tokens kept in
+// journalistRepository, anyone may publish when it's nil. Categories are
+// mapped to the slugs in categoryRepository, any is accepted when it's nil.
+// The scheduler is woken up when articles are scheduled or approved. Valid
+// articles go through the moderator, when there's one. Publishers are held
+// to the limiter's rate limits and quotas, unlimited when it's nil. With
+// review, articles go live once an editor approves them.
+func NewServer(articleRepository ArticleRepository, journalistRepository JournalistRepository, categoryRepository CategoryRepository, scheduler *Scheduler, rules ValidationRules, moderator *Moderator, limiter *Limiter, review bool) *Server {
 	return &Server{
-		articleRepo: articleRepository,
+		articleRepo:    articleRepository,
+		journalistRepo: journalistRepository,
+		categoryRepo:   categoryRepository,
+		scheduler:      scheduler,
+		validator:      newValidator(rules),
+		moderator:      moderator,
+		limiter:        limiter,
+		review:         review,
+		conns:          make(map[*websocket.Conn]struct{}),
 	}
 }
 
+// publishMessage is a frame sent by journalists. MessageID is chosen by
+// the client and echoed back in the ack.
+type publishMessage struct {
+	MessageID string `json:"message_id"`
+	// Op is what to do with the article, publishing it when empty.
+	Op string `json:"op,omitempty"`
+	// ArticleID is the article to update, submit or retract.
+	ArticleID int64 `json:"article_id,omitempty"`
+	Article
+}
+
+const (
+	opPublish = "publish"
+	opUpdate  = "update"
+	opSubmit  = "submit"
+	opRetract = "retract"
+)
+
+// ackPayload answers each publish frame with the id of the stored article
+// or the reason it wasn't.
+type ackPayload struct {
+	MessageID string `json:"message_id"`
+	ArticleID int64  `json:"article_id,omitempty"`
+	// Status is in_review when the article is held for an editor.
+	Status string        `json:"status,omitempty"`
+	Error  *errorPayload `json:"error,omitempty"`
+}
+
+const (
+	errCodeInvalidMessage = "invalid_message"
+	errCodeInvalidArticle = "invalid_article"
+	errCodeStorage        = "storage_error"
+	errCodeNotFound       = "not_found"
+	errCodeModerated      = "moderation_rejected"
+	errCodeRateLimited    = "rate_limited"
+	errCodeQuotaExceeded  = "quota_exceeded"
+)
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	// RetryAfter is how many seconds to wait before publishing again
+	// when limited.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+var (
+	malformedError = &errorPayload{Code: errCodeInvalidMessage, Message: "Malformed message"}
+	storageError   = &errorPayload{Code: errCodeStorage, Message: "Article could not be stored"}
+	notFoundError  = &errorPayload{Code: errCodeNotFound, Message: "Article not found"}
+)
+
 func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+
+	author, err := s.authenticate(r)
+	if err != nil {
+		log.Println("rejecting publisher:", err)
+		writeAuthFailure(w, err)
+		return
+	}
+
 	upgrader := websocket.Upgrader{}
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -25,24 +124,300 @@ func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.track(c)
+	defer s.untrack(c)
 	defer c.Close()
 
-	var a Article
+	client := newClient(author, r)
+
 	for {
-		err := c.ReadJSON(&a)
+		_, data, err := c.ReadMessage()
 		if err != nil {
 			log.Println("closing connection. read error:", err)
 			break
 		}
 
-		err = s.articleRepo.store(a)
+		err = c.WriteJSON(s.handlePublish(client, data))
 		if err != nil {
-			log.Println("closing connecton. processing error:", err)
+			log.Println("closing connection. write error:", err)
 			break
 		}
 	}
 }
 
+// handlePublish stores, updates or retracts the article in a publish
+// frame. Rejected frames, and those over the client's rate limit, are
+// reported in the ack, leaving the connection open for the next ones.
+func (s *Server) handlePublish(c client, data []byte) ackPayload {
+	var msg publishMessage
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return ackPayload{Error: malformedError}
+	}
+
+	ack := ackPayload{MessageID: msg.MessageID}
+	if ack.Error = s.throttle(c); ack.Error != nil {
+		return ack
+	}
+
+	author := c.author
+	switch msg.Op {
+	case "", opPublish:
+		ack.ArticleID, ack.Status, ack.Error = s.store(c, msg.Article)
+	case opUpdate:
+		ack.Error = s.update(author, msg.ArticleID, msg.Article)
+	case opSubmit:
+		ack.Error = s.submit(author, msg.ArticleID)
+	case opRetract:
+		ack.Error = s.retract(author, msg.ArticleID)
+	default:
+		ack.Error = &errorPayload{Code: errCodeInvalidMessage, Message: "Unknown op", Field: "op"}
+	}
+	if ack.Error == nil && msg.Op != "" && msg.Op != opPublish {
+		ack.ArticleID = msg.ArticleID
+	}
+
+	return ack
+}
+
+// store validates, moderates and stores an article written by the client,
+// counting it against its daily quota, and returns its id with its review
+// status. Retries of an article already stored get its id back, without
+// counting. The error is described for the client when it's rejected.
+func (s *Server) store(c client, a Article) (int64, string, *errorPayload) {
+	a, errPayload := s.validate(c.author, a)
+	if errPayload != nil {
+		return 0, "", errPayload
+	}
+	if id, errPayload := s.retried(a); id != 0 || errPayload != nil {
+		return id, "", errPayload
+	}
+	a, decision, errPayload := s.moderate(a, false)
+	if errPayload != nil {
+		s.moderator.record(decision)
+		return 0, "", errPayload
+	}
+	// Decisions on articles that couldn't be stored are recorded without id
+	release, errPayload := s.reserveQuota(c, 1)
+	if errPayload != nil {
+		s.moderator.record(decision)
+		return 0, "", errPayload
+	}
+
+	id, err := s.articleRepo.store(a)
+	if err != nil {
+		release()
+		s.moderator.record(decision)
+		log.Println("error storing article:", err)
+		return 0, "", storageError
+	}
+	decision.ArticleID = id
+	s.moderator.record(decision)
+	if a.PublishAt != nil && !a.Draft && !a.review {
+		s.scheduler.Wake()
+	}
+
+	return id, reviewStatus(a), nil
+}
+
+// reviewStatus tells the client when a stored article is held for an
+// editor, by the aggregator's rules or by moderation.
+func reviewStatus(a Article) string {
+	if a.review && !a.Draft {
+		return statusInReview
+	}
+
+	return ""
+}
+
+// retried returns the id of the article already stored when a is a retry
+// of it, 0 otherwise.
+func (s *Server) retried(a Article) (int64, *errorPayload) {
+	if a.ExternalID == "" {
+		return 0, nil
+	}
+
+	id, err := s.articleRepo.byExternalID(a.AuthorID, a.ExternalID)
+	switch {
+	case errors.Is(err, errArticleNotFound):
+		return 0, nil
+	case err != nil:
+		log.Println("error loading retried article:", err)
+		return 0, storageError
+	}
+
+	return id, nil
+}
+
+// update replaces the content of an article written by author. The
+// article's external id and publish time are left as they were.
+func (s *Server) update(author *Journalist, id int64, a Article) *errorPayload {
+	a, errPayload := s.validate(author, a)
+	if errPayload != nil {
+		return errPayload
+	}
+	a, decision, errPayload := s.moderate(a, true)
+	decision.ArticleID = id
+	if errPayload != nil {
+		s.moderator.record(decision)
+		return errPayload
+	}
+
+	errPayload = changeError(s.articleRepo.update(id, a))
+	if errPayload == nil {
+		s.moderator.record(decision)
+	}
+
+	return errPayload
+}
+
+// moderate runs a valid article through moderation. Fixed articles are
+// validated again, as fixes may leave them empty. Changes to stored
+// articles can't be quarantined, and neither can articles without
+// authentication as there are no editors to review them, they're rejected
+// instead.
+func (s *Server) moderate(a Article, change bool) (Article, ModerationDecision, *errorPayload) {
+	a, d := s.moderator.moderate(a)
+	if (change || s.journalistRepo == nil) && d.Action == ActionQuarantine {
+		d.Action = ActionReject
+	}
+
+	switch d.Action {
+	case ActionAllow:
+		return a, d, nil
+	case ActionReject:
+		return a, d, &errorPayload{Code: errCodeModerated, Message: "Article rejected by moderation: " + d.reasons()}
+	case ActionQuarantine:
+		a.review = true
+	}
+
+	a, err := s.validator.validate(a)
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		d.Action = ActionReject
+		return a, d, invalidArticleError(verr)
+	}
+
+	return a, d, nil
+}
+
+// submit sends a draft written by author to review, or publishes it when
+// reviews aren't required.
+func (s *Server) submit(author *Journalist, id int64) *errorPayload {
+	err := s.articleRepo.submit(id, author.id(), s.review)
+	if err == nil && !s.review {
+		s.scheduler.Wake()
+	}
+
+	return changeError(err)
+}
+
+// retract withdraws an article written by author.
+func (s *Server) retract(author *Journalist, id int64) *errorPayload {
+	return changeError(s.articleRepo.retract(id, author.id()))
+}
+
+// changeError describes the error updating or retracting an article for
+// the client. Articles of other journalists are reported as not found.
+func changeError(err error) *errorPayload {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errArticleNotFound):
+		return notFoundError
+	default:
+		log.Println("error changing article:", err)
+		return storageError
+	}
+}
+
+func (s *Server) validate(author *Journalist, a Article) (Article, *errorPayload) {
+	a, err := s.validator.validate(a)
+	a.AuthorID = author.id()
+	a.review = s.review
+
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return a, invalidArticleError(verr)
+	}
+
+	if s.categoryRepo != nil && a.Category != "" {
+		slug, err := s.categoryRepo.resolveCategory(a.Category)
+		if errors.Is(err, errCategoryNotFound) {
+			return a, invalidArticleError(&ValidationError{Field: "category", Reason: "is unknown"})
+		}
+		if err != nil {
+			log.Println("resolving category:", err)
+			return a, storageError
+		}
+		a.Category = slug
+	}
+
+	return a, nil
+}
+
+func invalidArticleError(verr *ValidationError) *errorPayload {
+	return &errorPayload{Code: errCodeInvalidArticle, Message: verr.Error(), Field: verr.Field}
+}
+
+// Shutdown asks publishers to leave with a going away close frame and
+// waits for the articles being stored. Connections still open when ctx is
+// done are closed abruptly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+
+	s.connsMut.Lock()
+	for c := range s.conns {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down")
+		err := c.WriteControl(websocket.CloseMessage, msg, deadline)
+		if err != nil {
+			log.Println("write close:", err)
+		}
+	}
+	s.connsMut.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.connsMut.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.connsMut.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+func (s *Server) track(c *websocket.Conn) {
+	s.connsMut.Lock()
+	defer s.connsMut.Unlock()
+
+	s.conns[c] = struct{}{}
+}
+
+func (s *Server) untrack(c *websocket.Conn) {
+	s.connsMut.Lock()
+	defer s.connsMut.Unlock()
+
+	delete(s.conns, c)
+}
+
 func (s *Server) RegistersRoutes() {
 	http.HandleFunc("/publish", s.publish)
+	http.HandleFunc("/articles", s.postArticle)
+	http.HandleFunc("/articles/", s.changeArticle)
+	http.HandleFunc("/articles:batch", s.postBatch)
+	http.HandleFunc("/review", s.reviewQueue)
+	http.HandleFunc("/review/", s.reviewArticle)
 }
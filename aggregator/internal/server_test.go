@@ -1,10 +1,13 @@
 package aggregator
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -12,13 +15,19 @@ import (
 )
 
 func TestServer(t *testing.T) {
-	done := make(chan struct{})
+	done := make(chan struct{}, 2)
 	repo := &mockArticleRepository{done: done}
 
 	expected := Article{Title: "title", Body: "body"}
-	repo.On("store", expected).Return(nil)
+	repo.On("store", expected).Return(int64(1), nil)
+	failing := Article{Title: "failing", Body: "body"}
+	repo.On("store", failing).Return(int64(0), errors.New("connection refused"))
+	repo.On("update", int64(1), Article{Title: "fixed", Body: "body"}).Return(nil)
+	repo.On("update", int64(2), Article{Title: "fixed", Body: "body"}).Return(errArticleNotFound)
+	repo.On("retract", int64(1), int64(0)).Return(nil)
+	repo.On("submit", int64(3), int64(0), false).Return(nil)
 
-	srv := NewServer(repo)
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, nil, nil, false)
 	s := httptest.NewServer(http.HandlerFunc(srv.publish))
 
 	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
@@ -26,22 +35,164 @@ func TestServer(t *testing.T) {
 	assert.Nil(t, err)
 	defer c.Close()
 
-	err = c.WriteJSON(expected)
-	assert.Nil(t, err)
+	// A rejected frame doesn't close the connection, every frame is acked
+	tests := []struct {
+		frame    interface{}
+		expected ackPayload
+	}{
+		{
+			frame:    publishMessage{MessageID: "1", Article: expected},
+			expected: ackPayload{MessageID: "1", ArticleID: 1},
+		},
+		{
+			frame:    "not an article",
+			expected: ackPayload{Error: &errorPayload{Code: errCodeInvalidMessage, Message: "Malformed message"}},
+		},
+		{
+			frame:    publishMessage{MessageID: "2", Article: Article{Body: "body"}},
+			expected: ackPayload{MessageID: "2", Error: &errorPayload{Code: errCodeInvalidArticle, Message: "title is required", Field: "title"}},
+		},
+		{
+			frame:    publishMessage{MessageID: "3", Article: failing},
+			expected: ackPayload{MessageID: "3", Error: &errorPayload{Code: errCodeStorage, Message: "Article could not be stored"}},
+		},
+		{
+			frame:    publishMessage{MessageID: "4", Op: opUpdate, ArticleID: 1, Article: Article{Title: "fixed", Body: "body"}},
+			expected: ackPayload{MessageID: "4", ArticleID: 1},
+		},
+		{
+			frame:    publishMessage{MessageID: "5", Op: opUpdate, ArticleID: 2, Article: Article{Title: "fixed", Body: "body"}},
+			expected: ackPayload{MessageID: "5", Error: &errorPayload{Code: errCodeNotFound, Message: "Article not found"}},
+		},
+		{
+			frame:    publishMessage{MessageID: "6", Op: opUpdate, ArticleID: 1, Article: Article{Body: "body"}},
+			expected: ackPayload{MessageID: "6", Error: &errorPayload{Code: errCodeInvalidArticle, Message: "title is required", Field: "title"}},
+		},
+		{
+			frame:    publishMessage{MessageID: "7", Op: opRetract, ArticleID: 1},
+			expected: ackPayload{MessageID: "7", ArticleID: 1},
+		},
+		{
+			frame:    publishMessage{MessageID: "8", Op: "delete", ArticleID: 1},
+			expected: ackPayload{MessageID: "8", Error: &errorPayload{Code: errCodeInvalidMessage, Message: "Unknown op", Field: "op"}},
+		},
+		{
+			frame:    publishMessage{MessageID: "9", Op: opSubmit, ArticleID: 3},
+			expected: ackPayload{MessageID: "9", ArticleID: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		err = c.WriteJSON(tt.frame)
+		assert.Nil(t, err)
 
+		var actual ackPayload
+		err = c.ReadJSON(&actual)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, actual)
+	}
+
+	<-done
 	<-done
 
 	repo.AssertExpectations(t)
 }
 
+func TestServer_Shutdown(t *testing.T) {
+	done := make(chan struct{})
+	repo := &mockArticleRepository{done: done}
+
+	srv := NewServer(repo, nil, nil, nil, ValidationRules{RequireTitle: true}, nil, nil, false)
+	s := httptest.NewServer(http.HandlerFunc(srv.publish))
+	defer s.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	c, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	// Wait until the connection is being served
+	assert.Eventually(t, func() bool {
+		srv.connsMut.Lock()
+		defer srv.connsMut.Unlock()
+
+		return len(srv.conns) == 1
+	}, time.Second, time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	// Reading answers the close frame, letting the handler finish
+	_, _, err = c.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+	assert.Nil(t, <-shutdown)
+}
+
 type mockArticleRepository struct {
 	mock.Mock
 	done chan struct{}
 }
 
-func (m *mockArticleRepository) store(a Article) error {
+func (m *mockArticleRepository) store(a Article) (int64, error) {
 	args := m.Called(a)
 	m.done <- struct{}{}
 
-	return args.Error(0)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockArticleRepository) update(id int64, a Article) error {
+	return m.Called(id, a).Error(0)
+}
+
+func (m *mockArticleRepository) retract(id int64, authorID int64) error {
+	return m.Called(id, authorID).Error(0)
+}
+
+func (m *mockArticleRepository) nextScheduled() (time.Time, bool, error) {
+	args := m.Called()
+	return args.Get(0).(time.Time), args.Bool(1), args.Error(2)
+}
+
+func (m *mockArticleRepository) releaseDue(now time.Time) (int64, error) {
+	args := m.Called(now)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockArticleRepository) byExternalID(authorID int64, externalID string) (int64, error) {
+	args := m.Called(authorID, externalID)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockArticleRepository) storeBatch(articles []Article) ([]int64, error) {
+	args := m.Called(articles)
+	ids, _ := args.Get(0).([]int64)
+	return ids, args.Error(1)
+}
+
+func (m *mockArticleRepository) stored(id int64, authorID int64) (StoredArticle, error) {
+	args := m.Called(id, authorID)
+	return args.Get(0).(StoredArticle), args.Error(1)
+}
+
+func (m *mockArticleRepository) submit(id int64, authorID int64, review bool) error {
+	return m.Called(id, authorID, review).Error(0)
+}
+
+func (m *mockArticleRepository) reviewQueue(limit int) ([]StoredArticle, error) {
+	args := m.Called(limit)
+	articles, _ := args.Get(0).([]StoredArticle)
+	return articles, args.Error(1)
+}
+
+func (m *mockArticleRepository) approve(id int64, editorID int64) error {
+	return m.Called(id, editorID).Error(0)
+}
+
+func (m *mockArticleRepository) reject(id int64, editorID int64, note string) error {
+	return m.Called(id, editorID, note).Error(0)
 }
@@ -0,0 +1,185 @@
+package aggregator
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ValidationRules configures how articles are checked before they're
+// stored. Zero lengths mean no limit.
+type ValidationRules struct {
+	RequireTitle      bool
+	RequireBody       bool
+	RequireCategory   bool
+	MaxTitleLength    int
+	MaxBodyLength     int
+	MaxCategoryLength int
+	// StripHTML removes markup from titles and bodies, keeping their text.
+	StripHTML bool
+}
+
+// maxExternalIDLength bounds the external ids clients send, they identify
+// articles and aren't meant to carry content.
+const maxExternalIDLength = 255
+
+// Articles take up to maxTags tags of up to maxTagLength characters.
+const (
+	maxTags      = 10
+	maxTagLength = 30
+)
+
+// DefaultValidationRules are the limits the journalist client enforces.
+var DefaultValidationRules = ValidationRules{
+	RequireTitle:      true,
+	RequireBody:       true,
+	RequireCategory:   true,
+	MaxTitleLength:    50,
+	MaxBodyLength:     250,
+	MaxCategoryLength: 10,
+	StripHTML:         true,
+}
+
+// ValidationError tells which field of an article was rejected and why.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+type validator struct {
+	rules ValidationRules
+}
+
+func newValidator(rules ValidationRules) *validator {
+	return &validator{rules: rules}
+}
+
+// validate normalizes the article text and checks it against the rules,
+// returning the article to store or a *ValidationError.
+//
+// Invalid UTF-8 and control characters are dropped, text is converted to
+// NFC and whitespace is trimmed. Titles and categories are kept on a single
+// line. Lengths count code points after normalization, so composed and
+// decomposed accents count the same.
+func (v *validator) validate(a Article) (Article, error) {
+	if v.rules.StripHTML {
+		a.Title = stripHTML(a.Title)
+		a.Body = stripHTML(a.Body)
+	}
+	a.Title = normalizeLine(a.Title)
+	a.Body = normalizeText(a.Body)
+	a.Category = normalizeLine(a.Category)
+	a.ExternalID = strings.TrimSpace(removeControl(a.ExternalID, false))
+	a.Tags = normalizeTags(a.Tags)
+
+	fields := []struct {
+		name     string
+		value    string
+		required bool
+		max      int
+	}{
+		{"title", a.Title, v.rules.RequireTitle, v.rules.MaxTitleLength},
+		{"body", a.Body, v.rules.RequireBody, v.rules.MaxBodyLength},
+		{"category", a.Category, v.rules.RequireCategory, v.rules.MaxCategoryLength},
+		{"external_id", a.ExternalID, false, maxExternalIDLength},
+	}
+	for _, f := range fields {
+		if f.required && f.value == "" {
+			return a, &ValidationError{Field: f.name, Reason: "is required"}
+		}
+		if f.max > 0 && utf8.RuneCountInString(f.value) > f.max {
+			return a, &ValidationError{Field: f.name, Reason: fmt.Sprintf("must be at most %d characters", f.max)}
+		}
+	}
+
+	if len(a.Tags) > maxTags {
+		return a, &ValidationError{Field: "tags", Reason: fmt.Sprintf("must be at most %d", maxTags)}
+	}
+	for _, t := range a.Tags {
+		if utf8.RuneCountInString(t) > maxTagLength {
+			return a, &ValidationError{Field: "tags", Reason: fmt.Sprintf("must be at most %d characters each", maxTagLength)}
+		}
+	}
+
+	return a, nil
+}
+
+// normalizeTags lower cases the tags, keeping each once and dropping the
+// empty ones.
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(normalizeLine(t))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			normalized = append(normalized, t)
+		}
+	}
+
+	return normalized
+}
+
+// normalizeLine collapses every run of whitespace, line breaks included,
+// into a single space.
+func normalizeLine(s string) string {
+	return strings.Join(strings.Fields(removeControl(s, false)), " ")
+}
+
+// normalizeText does the same line by line, keeping line breaks.
+func normalizeText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	lines := strings.Split(removeControl(s, true), "\n")
+	for i, l := range lines {
+		lines[i] = strings.Join(strings.Fields(l), " ")
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// removeControl also converts the text to NFC, so the same text is stored
+// the same way however it was typed.
+func removeControl(s string, keepBreaks bool) string {
+	s = norm.NFC.String(strings.ToValidUTF8(s, ""))
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case keepBreaks && r == '\n':
+			return r
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.IsControl(r), r == '\uFEFF':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+var (
+	htmlBlocks = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>`)
+	htmlTags   = regexp.MustCompile(`(?s)<(?:[a-zA-Z/!?][^>]*)?>`)
+)
+
+// stripHTML decodes entities, then removes tags, comments and the contents
+// of scripts and styles. Tags become spaces so words they separated stay
+// apart. It's repeated until nothing changes, so escaped markup can't
+// come back to life once decoded.
+func stripHTML(s string) string {
+	for {
+		stripped := htmlBlocks.ReplaceAllString(html.UnescapeString(s), " ")
+		stripped = htmlTags.ReplaceAllString(stripped, " ")
+		if stripped == s {
+			return s
+		}
+		s = stripped
+	}
+}
@@ -0,0 +1,126 @@
+package aggregator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidator(t *testing.T) {
+	v := newValidator(ValidationRules{
+		RequireTitle:      true,
+		RequireCategory:   true,
+		MaxTitleLength:    10,
+		MaxBodyLength:     20,
+		MaxCategoryLength: 10,
+		StripHTML:         true,
+	})
+
+	tests := map[string]struct {
+		article  Article
+		expected Article
+		err      *ValidationError
+	}{
+		"valid": {
+			article:  Article{Title: "Tokyo", Body: "body", Category: "Japan"},
+			expected: Article{Title: "Tokyo", Body: "body", Category: "Japan"},
+		},
+		"normalized": {
+			article: Article{
+				Title:    "  Kyoto\t\n \x00fall ",
+				Body:     " <p>Red   leaves</p>\r\n<script>alert(1)</script>&amp; temples \xff",
+				Category: " travel ",
+			},
+			expected: Article{Title: "Kyoto fall", Body: "Red leaves\n& temples", Category: "travel"},
+		},
+		"escaped markup": {
+			article: Article{
+				Title:    "&amp;lt;b&amp;gt;Tokyo",
+				Body:     "&lt;script&gt;alert(1)&lt;/script&gt;Temples",
+				Category: "Japan",
+			},
+			expected: Article{Title: "Tokyo", Body: "Temples", Category: "Japan"},
+		},
+		"length counts characters": {
+			article:  Article{Title: "東京の秋の紅葉と寺院", Category: "Japan"},
+			expected: Article{Title: "東京の秋の紅葉と寺院", Category: "Japan"},
+		},
+		"composed": {
+			// "Café Niño" typed with combining accents
+			article:  Article{Title: "Cafe\u0301 Nin\u0303o", Category: "Japan"},
+			expected: Article{Title: "Café Niño", Category: "Japan"},
+		},
+		"external id": {
+			article:  Article{Title: "Tokyo", Category: "Japan", ExternalID: " feed-1 "},
+			expected: Article{Title: "Tokyo", Category: "Japan", ExternalID: "feed-1"},
+		},
+		"external id too long": {
+			article: Article{Title: "Tokyo", Category: "Japan", ExternalID: strings.Repeat("a", maxExternalIDLength+1)},
+			err:     &ValidationError{Field: "external_id", Reason: "must be at most 255 characters"},
+		},
+		"tags": {
+			article:  Article{Title: "Tokyo", Category: "Japan", Tags: []string{" Electric\tvehicles ", "", "Batteries", "batteries"}},
+			expected: Article{Title: "Tokyo", Category: "Japan", Tags: []string{"electric vehicles", "batteries"}},
+		},
+		"too many tags": {
+			article: Article{Title: "Tokyo", Category: "Japan", Tags: strings.Split("a,b,c,d,e,f,g,h,i,j,k", ",")},
+			err:     &ValidationError{Field: "tags", Reason: "must be at most 10"},
+		},
+		"tag too long": {
+			article: Article{Title: "Tokyo", Category: "Japan", Tags: []string{strings.Repeat("a", maxTagLength+1)}},
+			err:     &ValidationError{Field: "tags", Reason: "must be at most 30 characters each"},
+		},
+		"missing title": {
+			article: Article{Title: " <b></b> ", Category: "Japan"},
+			err:     &ValidationError{Field: "title", Reason: "is required"},
+		},
+		"missing category": {
+			article: Article{Title: "Tokyo"},
+			err:     &ValidationError{Field: "category", Reason: "is required"},
+		},
+		"title too long": {
+			article: Article{Title: "Tokyo in autumn", Category: "Japan"},
+			err:     &ValidationError{Field: "title", Reason: "must be at most 10 characters"},
+		},
+		"body too long": {
+			article: Article{Title: "Tokyo", Body: "Red leaves and old temples", Category: "Japan"},
+			err:     &ValidationError{Field: "body", Reason: "must be at most 20 characters"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := v.validate(tt.article)
+			if tt.err != nil {
+				assert.Equal(t, tt.err, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestValidator_NormalizedLength(t *testing.T) {
+	v := newValidator(ValidationRules{MaxTitleLength: 9})
+
+	// Composed and decomposed, both are 9 characters long
+	for _, title := range []string{"Caf\u00e9 Ni\u00f1o", "Cafe\u0301 Nin\u0303o"} {
+		actual, err := v.validate(Article{Title: title})
+		assert.Nil(t, err)
+		assert.Equal(t, "Caf\u00e9 Ni\u00f1o", actual.Title)
+	}
+
+	_, err := v.validate(Article{Title: "Cafe\u0301s Nin\u0303o"})
+	assert.Equal(t, &ValidationError{Field: "title", Reason: "must be at most 9 characters"}, err)
+}
+
+func TestValidator_KeepsHTML(t *testing.T) {
+	v := newValidator(ValidationRules{})
+
+	actual, err := v.validate(Article{Title: "<b>Tokyo</b>", Body: "a < b"})
+	assert.Nil(t, err)
+	assert.Equal(t, Article{Title: "<b>Tokyo</b>", Body: "a < b"}, actual)
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/bubbles/textinput"
@@ -18,11 +23,64 @@ import (
 
 var addr = flag.String("addr", "localhost:8080", "http service address")
 var auto = flag.Bool("auto", false, "send random articles every 2 seconds")
+var token = flag.String("token", "", "API token of the journalist")
 
 type Article struct {
 	Title    string `json:"title"`
 	Body     string `json:"body"`
 	Category string `json:"category"`
+	// Tags file the article under more topics than its category.
+	Tags []string `json:"tags,omitempty"`
+	// ExternalID makes sending the same article again safe, the aggregator
+	// stores it once.
+	ExternalID string `json:"external_id,omitempty"`
+}
+
+func newExternalID() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// publishMessage is the frame sent for each article, the aggregator echoes
+// MessageID in its ack.
+type publishMessage struct {
+	MessageID string `json:"message_id"`
+	Article
+}
+
+// Ack tells whether the article sent with MessageID was stored.
+type Ack struct {
+	MessageID string    `json:"message_id"`
+	ArticleID int64     `json:"article_id,omitempty"`
+	Error     *AckError `json:"error,omitempty"`
+}
+
+type AckError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	// RetryAfter is how many seconds to wait when publishing too much.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+func (e *AckError) String() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, retry in %ds", e.Message, e.RetryAfter)
+	}
+
+	return e.Message
+}
+
+func (a Ack) String() string {
+	if a.Error != nil {
+		return fmt.Sprintf("Message %s rejected: %s", a.MessageID, a.Error)
+	}
+
+	return fmt.Sprintf("Message %s stored as article %d", a.MessageID, a.ArticleID)
 }
 
 func main() {
@@ -49,14 +107,24 @@ func main() {
 				return
 			case <-t.C:
 				article := randomArticle()
-				fmt.Printf("Sending article:\n Title: %s\n Body: %s\n Category: %s\n----------------------------------------\n",
+				article.ExternalID = newExternalID()
+				fmt.Printf("Sending article:\n Title: %s\n Body: %s\n Category: %s\n Tags: %s\n----------------------------------------\n",
 					article.Title,
 					article.Body,
 					article.Category,
+					strings.Join(article.Tags, ", "),
 				)
-				if err := sender.Send(article); err != nil {
+				if _, err := sender.Send(article); err != nil {
 					log.Fatal(err)
 				}
+				ack, err := sender.ReadAck()
+				if err != nil {
+					log.Fatal(err)
+				}
+				fmt.Println(ack)
+				if ack.Error != nil && ack.Error.Code == "quota_exceeded" {
+					return
+				}
 			}
 		}
 
@@ -71,10 +139,24 @@ func main() {
 
 type ArticleSender struct {
 	conn *websocket.Conn
+	next int
+}
+
+// Send publishes the article and returns the id of its message, matching
+// the ack read later.
+func (a *ArticleSender) Send(article Article) (string, error) {
+	a.next++
+	id := strconv.Itoa(a.next)
+
+	return id, a.conn.WriteJSON(publishMessage{MessageID: id, Article: article})
 }
 
-func (a *ArticleSender) Send(article Article) error {
-	return a.conn.WriteJSON(article)
+// ReadAck blocks until the aggregator acks one of the articles sent.
+func (a *ArticleSender) ReadAck() (Ack, error) {
+	var ack Ack
+	err := a.conn.ReadJSON(&ack)
+
+	return ack, err
 }
 
 func NewArticleSender() (*ArticleSender, error) {
@@ -82,7 +164,15 @@ func NewArticleSender() (*ArticleSender, error) {
 	signal.Notify(interrupt, os.Interrupt)
 
 	u := url.URL{Scheme: "ws", Host: *addr, Path: "/publish"}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+
+	c, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		log.Fatal("dial: unauthorized, pass a valid journalist token with -token")
+	}
 	if err != nil {
 		log.Fatal("dial:", err)
 	}
@@ -102,12 +192,25 @@ func (a *ArticleSender) Close() error {
 
 type (
 	errMsg error
+	ackMsg Ack
 )
 
+func waitForAck(s *ArticleSender) tea.Cmd {
+	return func() tea.Msg {
+		ack, err := s.ReadAck()
+		if err != nil {
+			return errMsg(err)
+		}
+
+		return ackMsg(ack)
+	}
+}
+
 const (
 	title = iota
 	body
 	category
+	tags
 )
 
 const (
@@ -128,10 +231,14 @@ type model struct {
 	focused int
 	err     error
 	sender  *ArticleSender
+	// status is the outcome of the last article sent
+	status string
+	// sent holds the titles of the articles waiting for an ack
+	sent map[string]string
 }
 
 func initialModel(s *ArticleSender) model {
-	var inputs []textinput.Model = make([]textinput.Model, 3)
+	var inputs []textinput.Model = make([]textinput.Model, 4)
 	inputs[title] = textinput.New()
 	inputs[title].Placeholder = "Title"
 	inputs[title].Focus()
@@ -151,16 +258,23 @@ func initialModel(s *ArticleSender) model {
 	inputs[category].Width = 10
 	inputs[category].Prompt = ""
 
+	inputs[tags] = textinput.New()
+	inputs[tags].Placeholder = "Tags, comma separated"
+	inputs[tags].CharLimit = 100
+	inputs[tags].Width = 50
+	inputs[tags].Prompt = ""
+
 	return model{
 		inputs:  inputs,
 		focused: 0,
 		sender:  s,
 		err:     nil,
+		sent:    make(map[string]string),
 	}
 }
 
 func (m model) Init() tea.Cmd {
-	return textinput.Blink
+	return tea.Batch(textinput.Blink, waitForAck(m.sender))
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -171,10 +285,14 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch msg.Type {
 		case tea.KeyEnter:
 			if m.focused == len(m.inputs) {
-				if err := m.sender.Send(m.toArticle()); err != nil {
+				article := m.toArticle()
+				id, err := m.sender.Send(article)
+				if err != nil {
 					m.err = err
 					return m, nil
 				}
+				m.sent[id] = article.Title
+				m.status = fmt.Sprintf("Sending %q...", article.Title)
 
 				m.reset()
 			}
@@ -199,6 +317,16 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.inputs[m.focused].Focus()
 		}
 
+	case ackMsg:
+		title := m.sent[msg.MessageID]
+		delete(m.sent, msg.MessageID)
+		if msg.Error != nil {
+			m.status = fmt.Sprintf("%q rejected: %s", title, msg.Error)
+		} else {
+			m.status = fmt.Sprintf("%q published as article %d", title, msg.ArticleID)
+		}
+
+		return m, waitForAck(m.sender)
 	case errMsg:
 		m.err = msg
 		return m, nil
@@ -227,6 +355,11 @@ func (m model) View() string {
  %s
  %s
 
+ %s
+ %s
+
+ %s
+
  %s
 `,
 		inputStyle.Width(30).Render("Title"),
@@ -235,11 +368,22 @@ func (m model) View() string {
 		m.inputs[body].View(),
 		inputStyle.Width(30).Render("Category"),
 		m.inputs[category].View(),
+		inputStyle.Width(30).Render("Tags"),
+		m.inputs[tags].View(),
 		*button,
+		m.statusLine(),
 	)
 
 }
 
+func (m model) statusLine() string {
+	if m.err != nil {
+		return blurredStyle.Render("Error: " + m.err.Error())
+	}
+
+	return blurredStyle.Render(m.status)
+}
+
 func (m *model) nextInput() {
 	m.focused = (m.focused + 1) % (len(m.inputs) + 1)
 }
@@ -259,10 +403,23 @@ func (m *model) reset() {
 
 func (m *model) toArticle() Article {
 	return Article{
-		Title:    m.inputs[title].Value(),
-		Body:     m.inputs[body].Value(),
-		Category: m.inputs[category].Value(),
+		Title:      m.inputs[title].Value(),
+		Body:       m.inputs[body].Value(),
+		Category:   m.inputs[category].Value(),
+		Tags:       splitTags(m.inputs[tags].Value()),
+		ExternalID: newExternalID(),
+	}
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
 	}
+
+	return tags
 }
 
 func randomArticle() Article {
@@ -271,21 +428,25 @@ func randomArticle() Article {
 			Title:    "Japan's new emperor: What's his name?",
 			Body:     "Japan's new emperor Naruhito will formally ascend the Chrysanthemum throne on Wednesday, a day after his father's historic abdication.",
 			Category: "Japan",
+			Tags:     []string{"Imperial family"},
 		},
 		{
 			Title:    "Japan's emperor: The cost of keeping one",
 			Body:     "Japan's Emperor Akihito has declared his abdication in a historic ceremony at the Imperial Palace in Tokyo.",
 			Category: "Japan",
+			Tags:     []string{"Imperial family", "Economy"},
 		},
 		{
 			Title:    "Best season to visit Japan",
 			Body:     "Although Japan is a year-round destination, the best time to visit Japan is in spring (March & April) or autumn (October & November), when the weather is great and there are many cultural festivals.",
 			Category: "Travel",
+			Tags:     []string{"Japan", "Festivals"},
 		},
 		{
-			Title:    "Toyota's battery 'breakthrough' could lead to more range, faster charges",
+			Title:    "Toyota battery breakthrough could extend EV range",
 			Body:     "Toyota says it has developed a more efficient and safer way of producing smaller, lighter-weight lithium-ion batteries that could increase EV range and reduce charging times.",
 			Category: "Technology",
+			Tags:     []string{"Japan", "Batteries", "Electric vehicles"},
 		},
 	}
 	return articles[rand.Intn(len(articles))]
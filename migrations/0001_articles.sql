@@ -26,4 +26,4 @@ CREATE TABLE articles (
 
 CREATE TRIGGER articles_notify_on_insert
 AFTER INSERT ON articles
-    FOR EACH ROW EXECUTE FUNCTION notify_new_article();
\ No newline at end of file
+    FOR EACH ROW EXECUTE FUNCTION notify_new_article();
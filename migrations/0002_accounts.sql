@@ -0,0 +1,31 @@
+-- Credits of each subscriber, one is taken for every full article read.
+CREATE TABLE IF NOT EXISTS accounts (
+  user_id TEXT PRIMARY KEY,
+  balance INTEGER NOT NULL CHECK (balance >= 0),
+  plan TEXT NOT NULL DEFAULT 'free' CHECK (plan IN ('free', 'premium'))
+);
+
+-- Append-only record of every change to an account balance.
+CREATE TABLE IF NOT EXISTS account_ledger (
+  id BIGSERIAL PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES accounts (user_id),
+  amount INTEGER NOT NULL,
+  balance INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  article_id BIGINT,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS account_ledger_user_id_idx ON account_ledger (user_id, id);
+CREATE INDEX IF NOT EXISTS account_ledger_article_id_idx ON account_ledger (user_id, article_id);
+
+CREATE OR REPLACE FUNCTION reject_ledger_change() RETURNS TRIGGER AS $$
+    BEGIN
+        RAISE EXCEPTION 'account_ledger is append-only';
+    END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS account_ledger_append_only ON account_ledger;
+CREATE TRIGGER account_ledger_append_only
+BEFORE UPDATE OR DELETE ON account_ledger
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
@@ -0,0 +1,12 @@
+-- Authors allowed to publish, identified by the hash of their API token.
+CREATE TABLE IF NOT EXISTS journalists (
+  id BIGSERIAL PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE articles
+  -- Key chosen by the client so retried articles are stored once
+  ADD COLUMN IF NOT EXISTS external_id TEXT UNIQUE,
+  ADD COLUMN IF NOT EXISTS author_id BIGINT REFERENCES journalists (id);
@@ -0,0 +1,110 @@
+-- Scheduled articles are released once published_at is due. Retracted ones
+-- are kept, as subscribers may have read and paid for them.
+ALTER TABLE articles
+  ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'published' CHECK (status IN ('scheduled', 'published', 'retracted')),
+  ADD COLUMN IF NOT EXISTS seq BIGINT UNIQUE;
+
+CREATE INDEX IF NOT EXISTS articles_scheduled_idx ON articles (published_at) WHERE status = 'scheduled';
+
+-- Published articles are numbered in the order they were published, which
+-- differs from their ids for scheduled ones. Subscriber cursors follow it.
+CREATE SEQUENCE IF NOT EXISTS articles_seq;
+
+-- Articles published before numbering existed are numbered by id.
+UPDATE articles a
+SET seq = numbered.n + (SELECT COALESCE(MAX(seq), 0) FROM articles)
+FROM (
+  SELECT id, ROW_NUMBER() OVER (ORDER BY id) AS n
+  FROM articles
+  WHERE seq IS NULL AND status = 'published'
+) numbered
+WHERE a.id = numbered.id;
+
+SELECT setval('articles_seq', GREATEST(MAX(a.seq), (SELECT last_value FROM articles_seq)))
+FROM articles a
+HAVING MAX(a.seq) IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION sequence_published_article() RETURNS TRIGGER AS $$
+    BEGIN
+        IF (NEW.status = 'published' AND NEW.seq IS NULL) THEN
+            NEW.seq = nextval('articles_seq');
+        END IF;
+
+        RETURN NEW;
+    END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION notify_new_article() RETURNS TRIGGER AS $$
+
+    BEGIN
+    
+        -- Articles are announced once published, either when inserted or
+        -- when released by the scheduler.
+        IF (NEW.status != 'published') THEN
+            RETURN NULL;
+        END IF;
+        IF (TG_OP = 'UPDATE') THEN
+            IF (OLD.status = 'published') THEN
+                RETURN NULL;
+            END IF;
+        END IF;
+        
+        -- Only the id is sent, payloads are limited to 8000 bytes and the
+        -- publisher reads the row itself.
+        PERFORM pg_notify('new_articles', NEW.id::text);
+        
+        RETURN NULL; 
+    END;
+    
+$$ LANGUAGE plpgsql;
+
+-- Subscribers already sent an article are told when it's corrected or
+-- retracted. Scheduled articles change silently.
+CREATE OR REPLACE FUNCTION notify_article_change() RETURNS TRIGGER AS $$
+    BEGIN
+        IF (OLD.status != 'published') THEN
+            RETURN NULL;
+        END IF;
+
+        IF (NEW.status = 'retracted') THEN
+            PERFORM pg_notify('article_retracted', NEW.id::text);
+        ELSIF ((NEW.title, NEW.body, NEW.category) IS DISTINCT FROM (OLD.title, OLD.body, OLD.category)) THEN
+            PERFORM pg_notify('article_updated', NEW.id::text);
+        END IF;
+
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS articles_notify_on_insert ON articles;
+
+DROP TRIGGER IF EXISTS articles_sequence ON articles;
+CREATE TRIGGER articles_sequence
+BEFORE INSERT OR UPDATE OF status ON articles
+    FOR EACH ROW EXECUTE FUNCTION sequence_published_article();
+
+DROP TRIGGER IF EXISTS articles_notify_on_publish ON articles;
+CREATE TRIGGER articles_notify_on_publish
+AFTER INSERT OR UPDATE OF status ON articles
+    FOR EACH ROW EXECUTE FUNCTION notify_new_article();
+
+DROP TRIGGER IF EXISTS articles_notify_on_change ON articles;
+CREATE TRIGGER articles_notify_on_change
+AFTER UPDATE OF title, body, category, status ON articles
+    FOR EACH ROW EXECUTE FUNCTION notify_article_change();
+
+-- Last article delivered to each subscriber, so missed articles can be
+-- replayed when they reconnect.
+CREATE TABLE IF NOT EXISTS subscriber_cursors (
+  user_id TEXT PRIMARY KEY,
+  last_seq BIGINT NOT NULL
+);
+
+-- Notifications the publisher couldn't process, kept for inspection.
+CREATE TABLE IF NOT EXISTS dead_letters (
+  id BIGSERIAL PRIMARY KEY,
+  channel TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  error TEXT NOT NULL,
+  received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
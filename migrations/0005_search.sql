@@ -0,0 +1,11 @@
+-- The history API lists articles by category, newest first
+CREATE INDEX IF NOT EXISTS articles_category_idx ON articles (LOWER(TRIM(category)), seq);
+
+-- Searched words, those in the title rank above the ones in the body
+ALTER TABLE articles
+  ADD COLUMN IF NOT EXISTS search TSVECTOR GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE(body, '')), 'B')
+  ) STORED;
+
+CREATE INDEX IF NOT EXISTS articles_search_idx ON articles USING GIN (search);
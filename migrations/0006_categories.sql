@@ -0,0 +1,92 @@
+-- Categories articles are filed under. Subscribing to a category covers
+-- its children.
+CREATE TABLE categories (
+  slug TEXT PRIMARY KEY CHECK (slug ~ '^[a-z0-9]+(-[a-z0-9]+)*$'),
+  name TEXT NOT NULL,
+  parent TEXT REFERENCES categories (slug) ON UPDATE CASCADE,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX categories_parent_idx ON categories (parent);
+
+-- Other spellings journalists may file articles under, in lower case.
+CREATE TABLE category_aliases (
+  alias TEXT PRIMARY KEY,
+  slug TEXT NOT NULL REFERENCES categories (slug) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE OR REPLACE FUNCTION reject_category_cycle() RETURNS TRIGGER AS $$
+    BEGIN
+        IF (NEW.parent IS NOT NULL AND EXISTS (
+            WITH RECURSIVE ancestors (slug) AS (
+                SELECT NEW.parent
+                UNION
+                SELECT c.parent FROM categories c JOIN ancestors a ON c.slug = a.slug WHERE c.parent IS NOT NULL
+            )
+            SELECT 1 FROM ancestors WHERE slug = NEW.slug
+        )) THEN
+            RAISE EXCEPTION 'category % would be its own ancestor', NEW.slug USING ERRCODE = 'check_violation';
+        END IF;
+
+        RETURN NEW;
+    END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER categories_acyclic
+BEFORE INSERT OR UPDATE OF parent ON categories
+    FOR EACH ROW EXECUTE FUNCTION reject_category_cycle();
+
+-- The publisher keeps the tree in memory and reloads it on changes.
+CREATE OR REPLACE FUNCTION notify_categories_changed() RETURNS TRIGGER AS $$
+    BEGIN
+        PERFORM pg_notify('categories_changed', '');
+
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER categories_notify_on_change
+AFTER INSERT OR UPDATE OR DELETE ON categories
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_categories_changed();
+
+CREATE TRIGGER category_aliases_notify_on_change
+AFTER INSERT OR UPDATE OR DELETE ON category_aliases
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_categories_changed();
+
+INSERT INTO categories (slug, name) VALUES
+  ('japan', 'Japan'),
+  ('travel', 'Travel'),
+  ('technology', 'Technology');
+
+INSERT INTO category_aliases (alias, slug) VALUES ('tech', 'technology');
+
+-- Categories articles were already filed under join the taxonomy, and the
+-- articles refer to them by slug. Subscribers aren't told about the change.
+-- Categories without any letter or digit are dropped.
+CREATE TEMPORARY TABLE article_slugs ON COMMIT DROP AS
+SELECT id, TRIM(category) AS name, TRIM(BOTH '-' FROM REGEXP_REPLACE(LOWER(category), '[^a-z0-9]+', '-', 'g')) AS slug
+FROM articles
+WHERE category IS NOT NULL;
+
+INSERT INTO categories (slug, name)
+SELECT slug, MIN(name)
+FROM article_slugs
+WHERE slug != ''
+GROUP BY slug
+ON CONFLICT (slug) DO NOTHING;
+
+ALTER TABLE articles DISABLE TRIGGER articles_notify_on_change;
+
+UPDATE articles a
+SET category = NULLIF(s.slug, '')
+FROM article_slugs s
+WHERE a.id = s.id AND a.category IS DISTINCT FROM NULLIF(s.slug, '');
+
+ALTER TABLE articles ENABLE TRIGGER articles_notify_on_change;
+
+ALTER TABLE articles
+  ADD CONSTRAINT articles_category_fkey FOREIGN KEY (category) REFERENCES categories (slug) ON UPDATE CASCADE;
+
+-- Categories are stored as slugs, the history API no longer normalizes them.
+DROP INDEX IF EXISTS articles_category_idx;
+CREATE INDEX articles_category_idx ON articles (category, seq);
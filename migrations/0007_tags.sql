@@ -0,0 +1,15 @@
+-- Tags file articles under more topics than their category. They're free
+-- form, stored in lower case.
+CREATE TABLE tags (
+  name TEXT PRIMARY KEY CHECK (name != '' AND name = LOWER(name)),
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE article_tags (
+  article_id BIGINT NOT NULL REFERENCES articles (id) ON DELETE CASCADE,
+  tag TEXT NOT NULL REFERENCES tags (name),
+  PRIMARY KEY (article_id, tag)
+);
+
+-- The history API lists articles by tag
+CREATE INDEX article_tags_tag_idx ON article_tags (tag, article_id);
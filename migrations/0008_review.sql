@@ -0,0 +1,21 @@
+-- Articles may go through editorial review before going live. Drafts are
+-- submitted for review, and editors either approve them, to be published
+-- by the scheduler when due, or reject them back to draft with a note.
+-- Until published, published_at holds the time asked for, if any.
+ALTER TABLE articles DROP CONSTRAINT articles_status_check;
+ALTER TABLE articles
+  ADD CONSTRAINT articles_status_check CHECK (status IN ('draft', 'in_review', 'approved', 'scheduled', 'published', 'retracted')),
+  ADD COLUMN submitted_at TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN reviewed_by BIGINT REFERENCES journalists (id),
+  ADD COLUMN review_note TEXT;
+
+-- The review queue, oldest submission first
+CREATE INDEX articles_review_idx ON articles (submitted_at, id) WHERE status = 'in_review';
+
+-- Approved articles are released like scheduled ones
+DROP INDEX articles_scheduled_idx;
+CREATE INDEX articles_scheduled_idx ON articles (published_at) WHERE status IN ('scheduled', 'approved');
+
+-- Editors review the articles of the other journalists.
+ALTER TABLE journalists
+  ADD COLUMN editor BOOLEAN NOT NULL DEFAULT FALSE;
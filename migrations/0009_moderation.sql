@@ -0,0 +1,13 @@
+-- What moderation decided for each article sent, with the rules it
+-- matched. Rejected articles aren't stored, their title is kept instead.
+CREATE TABLE moderation_decisions (
+  id BIGSERIAL PRIMARY KEY,
+  article_id BIGINT REFERENCES articles (id) ON DELETE SET NULL,
+  author_id BIGINT REFERENCES journalists (id) ON DELETE SET NULL,
+  title TEXT NOT NULL,
+  action TEXT NOT NULL CHECK (action IN ('allow', 'fix', 'quarantine', 'reject')),
+  hits JSONB NOT NULL DEFAULT '[]',
+  decided_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX moderation_decisions_article_idx ON moderation_decisions (article_id);
@@ -0,0 +1,18 @@
+-- Journalists publishing under other limits than the aggregator's
+-- defaults. Zero values don't limit.
+CREATE TABLE journalist_limits (
+  journalist_id BIGINT PRIMARY KEY REFERENCES journalists (id) ON DELETE CASCADE,
+  rate_per_minute DOUBLE PRECISION NOT NULL CHECK (rate_per_minute >= 0),
+  burst INTEGER NOT NULL CHECK (burst >= 0),
+  daily_quota INTEGER NOT NULL CHECK (daily_quota >= 0)
+);
+
+-- Articles stored per client and UTC day, counted against the daily
+-- quotas. Clients are journalists, or addresses when publishing
+-- anonymously.
+CREATE TABLE publishing_usage (
+  client TEXT NOT NULL,
+  day DATE NOT NULL,
+  articles INTEGER NOT NULL CHECK (articles >= 0),
+  PRIMARY KEY (client, day)
+);
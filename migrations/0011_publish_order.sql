@@ -0,0 +1,15 @@
+-- Sequence numbers are handed out in the order articles are committed.
+-- Publishing transactions wait for each other from the moment they number
+-- an article until they commit, so no article can become visible with a
+-- lower number than one subscribers were already sent. Cursors only move
+-- forward and would skip it otherwise.
+CREATE OR REPLACE FUNCTION sequence_published_article() RETURNS TRIGGER AS $$
+    BEGIN
+        IF (NEW.status = 'published' AND NEW.seq IS NULL) THEN
+            PERFORM pg_advisory_xact_lock(7325846022);
+            NEW.seq = nextval('articles_seq');
+        END IF;
+
+        RETURN NEW;
+    END;
+$$ LANGUAGE plpgsql;
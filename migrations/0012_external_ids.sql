@@ -0,0 +1,5 @@
+-- External ids are chosen by each journalist, they only identify retries
+-- of the same author. Anonymous articles share theirs.
+ALTER TABLE articles DROP CONSTRAINT IF EXISTS articles_external_id_key;
+
+CREATE UNIQUE INDEX articles_external_id_idx ON articles (COALESCE(author_id, 0), external_id);
@@ -0,0 +1,5 @@
+-- Users pay once per article. Debits lock the account before looking for
+-- the article in the ledger, and the index rejects any second charge.
+DROP INDEX IF EXISTS account_ledger_article_id_idx;
+
+CREATE UNIQUE INDEX account_ledger_article_id_key ON account_ledger (user_id, article_id) WHERE article_id IS NOT NULL;
@@ -0,0 +1,190 @@
+// Package migrations holds the database schema as an ordered list of SQL
+// migrations, embedded in the services that apply them.
+//
+// Migrations are named <version>_<name>.sql and applied in version order,
+// each in its own transaction. Applied versions are recorded in the
+// schema_migrations table and never run again, so a migration must not be
+// changed once released: schema changes go in a new one.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// lockID is the Postgres advisory lock held while migrating, so services
+// starting together don't apply the same migration twice.
+const lockID = 7325846021
+
+// baselineVersion is the schema databases created with the former
+// initdb.sql started from. Those databases are adopted as being at it, and
+// the migrations after it are written to apply on top of any later
+// initdb.sql too.
+const baselineVersion = 1
+
+type Migration struct {
+	Version int64
+	Name    string
+	sql     string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Up applies the migrations the database is missing, in order, and returns
+// them.
+func Up(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// Advisory locks belong to the session, every statement must run on
+	// the same connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1::bigint)`, lockID)
+	if err != nil {
+		return nil, fmt.Errorf("locking: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1::bigint)`, lockID)
+
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		err := apply(ctx, conn, m)
+		if err != nil {
+			return done, fmt.Errorf("applying %s: %w", m, err)
+		}
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// appliedVersions creates the schema_migrations table when missing and
+// returns the versions recorded in it.
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]bool, error) {
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		)`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	// Databases created by initdb.sql have the articles table but no
+	// migration recorded.
+	_, err = conn.ExecContext(ctx, `
+		INSERT INTO schema_migrations (version, name)
+		SELECT $1::bigint, 'baseline'
+		WHERE to_regclass('articles') IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM schema_migrations)`,
+		baselineVersion,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("adopting existing schema: %w", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var version int64
+		err := rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+func apply(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, m.sql)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+		m.Version,
+		m.Name,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// load reads the migrations in fsys sorted by version.
+func load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int64]string)
+	for _, name := range names {
+		version, rest, ok := strings.Cut(strings.TrimSuffix(path.Base(name), ".sql"), "_")
+		v, err := strconv.ParseInt(version, 10, 64)
+		if !ok || err != nil || v <= 0 || rest == "" {
+			return nil, fmt.Errorf("migration %s isn't named <version>_<name>.sql", name)
+		}
+		if other, ok := seen[v]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, v)
+		}
+		seen[v] = name
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: v, Name: rest, sql: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUp(t *testing.T) {
+	db, err := sql.Open("postgres", "host=localhost port=5432 user=y password=y dbname=y sslmode=disable")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	_, err = Up(ctx, db)
+	assert.Nil(t, err)
+
+	// Applied migrations don't run again
+	applied, err := Up(ctx, db)
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+
+	migrations, err := load(files)
+	assert.Nil(t, err)
+
+	var latest int64
+	err = db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&latest)
+	assert.Nil(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].Version, latest)
+
+	// Concurrent runs wait for each other
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := Up(ctx, db)
+			errs <- err
+		}()
+	}
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-errs)
+}
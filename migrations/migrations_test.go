@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := load(fstest.MapFS{
+		"0010_search.sql":   {Data: []byte("CREATE INDEX")},
+		"0002_accounts.sql": {Data: []byte("CREATE TABLE accounts")},
+		"README.md":         {Data: []byte("not a migration")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 2, Name: "accounts", sql: "CREATE TABLE accounts"},
+		{Version: 10, Name: "search", sql: "CREATE INDEX"},
+	}, migrations)
+
+	_, err = load(fstest.MapFS{"accounts.sql": {}})
+	assert.EqualError(t, err, "migration accounts.sql isn't named <version>_<name>.sql")
+
+	_, err = load(fstest.MapFS{"2_accounts.sql": {}, "0002_ledger.sql": {}})
+	assert.EqualError(t, err, "migrations 0002_ledger.sql and 2_accounts.sql share version 2")
+}
+
+func TestEmbedded(t *testing.T) {
+	migrations, err := load(files)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, migrations)
+	assert.Equal(t, int64(baselineVersion), migrations[0].Version)
+
+	for i, m := range migrations {
+		assert.Equal(t, int64(i+1), m.Version, "migration versions have gaps")
+	}
+}
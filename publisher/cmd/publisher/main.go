@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"flag"
 	"log"
 	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/XaviFP/notifications/migrations"
 	"github.com/XaviFP/notifications/publisher/internal/publisher"
 	"github.com/gorilla/websocket"
 )
@@ -18,6 +25,12 @@ var dbPassword = flag.String("dbPassword", "y", "Database password")
 var dbName = flag.String("dbName", "y", "Database name")
 var dbSSLMode = flag.String("dbSSLMode", "disable", "SSL mode for DB connection")
 var initialCredits = flag.Int("initialCredits", 10, "Initial credits for each user")
+var premiumSessions = flag.Int("premiumSessions", 3, "Concurrent sessions allowed to premium users")
+var queueSize = flag.Int("queueSize", 64, "Articles queued per session before the overflow policy applies")
+var overflowPolicy = flag.String("overflowPolicy", "drop-oldest", "What to do when a session queue is full: drop-oldest, drop-newest or disconnect")
+var adminToken = flag.String("adminToken", "", "Bearer token for the billing and category APIs, disabled if empty")
+var shutdownTimeout = flag.Duration("shutdownTimeout", 10*time.Second, "Time given to subscribers to receive pending articles on shutdown")
+var migrateOnStart = flag.Bool("migrate", true, "Apply pending schema migrations at startup")
 var upgrader = websocket.Upgrader{}
 
 func main() {
@@ -30,10 +43,86 @@ func main() {
 		Name:     *dbName,
 		SSLMode:  *dbSSLMode,
 	}
-	broker = publisher.NewBroker(dbConfig, *initialCredits)
-	s := publisher.NewServer(broker)
+
+	overflow, err := publisher.ParseOverflowPolicy(*overflowPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *queueSize < 1 {
+		log.Fatal("queueSize must be at least 1")
+	}
+
+	db, err := sql.Open("postgres", dbConfig.String())
+	if err != nil {
+		panic(err)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		migrate(db)
+		return
+	}
+	if *migrateOnStart {
+		migrate(db)
+	}
+
+	accountRepo := publisher.NewAccountRepository(db, *initialCredits)
+	articleRepo := publisher.NewArticleRepository(db)
+	categoryRepo := publisher.NewCategoryRepository(db)
+	broker, err = publisher.NewBroker(
+		dbConfig,
+		publisher.NewCursorRepository(db),
+		articleRepo,
+		categoryRepo,
+		accountRepo,
+		publisher.NewDeadLetterRepository(db),
+		publisher.BrokerConfig{
+			PremiumSessions: *premiumSessions,
+			QueueSize:       *queueSize,
+			Overflow:        overflow,
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := publisher.NewServer(broker, articleRepo, categoryRepo, accountRepo, *adminToken)
 	s.RegistersRoutes()
 	s.Start()
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	srv := &http.Server{Addr: *addr}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections first, then let subscribers drain
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("error shutting down http server:", err)
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println("error shutting down subscribers:", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Println("error closing database:", err)
+	}
+}
+
+// migrate applies the schema migrations the database is missing.
+func migrate(db *sql.DB) {
+	applied, err := migrations.Up(context.Background(), db)
+	if err != nil {
+		log.Fatal("error migrating database: ", err)
+	}
+	for _, m := range applied {
+		log.Println("applied migration", m)
+	}
 }
@@ -0,0 +1,145 @@
+package publisher
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type creditRequest struct {
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type creditResponse struct {
+	UserID  string `json:"user_id"`
+	Balance int    `json:"balance"`
+}
+
+type planRequest struct {
+	Plan string `json:"plan"`
+}
+
+// accounts serves the billing API:
+//
+//	GET  /accounts/{id}          balance and recent ledger entries
+//	POST /accounts/{id}/credits  adds (or takes, when negative) credits
+//	PUT  /accounts/{id}/plan     changes the plan, free or premium
+//
+// Balances live in Postgres and are checked on every delivery, so a top up
+// applies to the subscriber's connected sessions straight away.
+func (s *Server) accounts(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, errorPayload{Err: "Unauthorized"})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/"), "/")
+	userID := parts[0]
+	if userID == "" {
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Not found"})
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.getAccount(w, userID)
+	case len(parts) == 2 && parts[1] == "credits" && r.Method == http.MethodPost:
+		s.addCredits(w, r, userID)
+	case len(parts) == 2 && parts[1] == "plan" && r.Method == http.MethodPut:
+		s.setPlan(w, r, userID)
+	case len(parts) <= 2:
+		writeJSON(w, http.StatusMethodNotAllowed, errorPayload{Err: "Method not allowed"})
+	default:
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Not found"})
+	}
+}
+
+func (s *Server) getAccount(w http.ResponseWriter, userID string) {
+	a, err := s.accountRepo.account(userID)
+	if errors.Is(err, errAccountNotFound) {
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Account not found"})
+		return
+	}
+	if err != nil {
+		log.Println("error loading account:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (s *Server) addCredits(w http.ResponseWriter, r *http.Request, userID string) {
+	var req creditRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Amount == 0 {
+		writeJSON(w, http.StatusBadRequest, errorPayload{Err: "A non zero amount is required"})
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "top up"
+	}
+
+	balance, err := s.accountRepo.credit(userID, req.Amount, req.Reason)
+	switch {
+	case errors.Is(err, errAccountNotFound):
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Account not found"})
+		return
+	case errors.Is(err, errInsufficientBalance):
+		writeJSON(w, http.StatusConflict, errorPayload{Err: "Balance can't go below zero"})
+		return
+	case err != nil:
+		log.Println("error crediting account:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, creditResponse{UserID: userID, Balance: balance})
+}
+
+// setPlan changes the user's plan. Sessions already connected are kept,
+// the new limit applies to the next ones.
+func (s *Server) setPlan(w http.ResponseWriter, r *http.Request, userID string) {
+	var req planRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || (req.Plan != PlanFree && req.Plan != PlanPremium) {
+		writeJSON(w, http.StatusBadRequest, errorPayload{Err: "Plan must be free or premium"})
+		return
+	}
+
+	err = s.accountRepo.setPlan(userID, req.Plan)
+	if errors.Is(err, errAccountNotFound) {
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Account not found"})
+		return
+	}
+	if err != nil {
+		log.Println("error setting plan:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	s.getAccount(w, userID)
+}
+
+// authorized checks the request carries the admin token as a bearer token.
+// Without a configured token the API is closed.
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if s.adminToken == "" || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("write error:", err)
+	}
+}
@@ -0,0 +1,72 @@
+package publisher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Accounts(t *testing.T) {
+	accounts := &mockAccountRepository{}
+	srv := NewServer(&mockBroker{}, nil, nil, accounts, "secret")
+
+	accounts.On("account", "testUserID").Return(Account{UserID: "testUserID", Plan: PlanPremium, Balance: 3, Ledger: []LedgerEntry{}}, nil)
+	accounts.On("account", "unknown").Return(Account{}, errAccountNotFound)
+	accounts.On("credit", "testUserID", 10, "top up").Return(13, nil)
+	accounts.On("credit", "testUserID", -20, "refund").Return(0, errInsufficientBalance)
+	accounts.On("setPlan", "testUserID", PlanPremium).Return(nil)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		status   int
+		expected string
+	}{
+		{"get", http.MethodGet, "/accounts/testUserID", "secret", "", http.StatusOK, `{"user_id":"testUserID","plan":"premium","balance":3,"ledger":[]}`},
+		{"not found", http.MethodGet, "/accounts/unknown", "secret", "", http.StatusNotFound, `{"error":"Account not found"}`},
+		{"unauthorized", http.MethodGet, "/accounts/testUserID", "wrong", "", http.StatusUnauthorized, `{"error":"Unauthorized"}`},
+		{"top up", http.MethodPost, "/accounts/testUserID/credits", "secret", `{"amount":10}`, http.StatusOK, `{"user_id":"testUserID","balance":13}`},
+		{"below zero", http.MethodPost, "/accounts/testUserID/credits", "secret", `{"amount":-20,"reason":"refund"}`, http.StatusConflict, `{"error":"Balance can't go below zero"}`},
+		{"no amount", http.MethodPost, "/accounts/testUserID/credits", "secret", `{}`, http.StatusBadRequest, `{"error":"A non zero amount is required"}`},
+		{"plan", http.MethodPut, "/accounts/testUserID/plan", "secret", `{"plan":"premium"}`, http.StatusOK, `{"user_id":"testUserID","plan":"premium","balance":3,"ledger":[]}`},
+		{"unknown plan", http.MethodPut, "/accounts/testUserID/plan", "secret", `{"plan":"gold"}`, http.StatusBadRequest, `{"error":"Plan must be free or premium"}`},
+		{"wrong method", http.MethodDelete, "/accounts/testUserID", "secret", "", http.StatusMethodNotAllowed, `{"error":"Method not allowed"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			srv.accounts(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	accounts.AssertExpectations(t)
+}
+
+func TestServer_AccountsDisabled(t *testing.T) {
+	srv := NewServer(&mockBroker{}, nil, nil, &mockAccountRepository{}, "")
+
+	r := httptest.NewRequest(http.MethodGet, "/accounts/testUserID", nil)
+	w := httptest.NewRecorder()
+
+	srv.accounts(w, r)
+
+	var actual errorPayload
+	err := json.NewDecoder(w.Body).Decode(&actual)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Unauthorized", actual.Err)
+}
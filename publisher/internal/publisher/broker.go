@@ -1,35 +1,110 @@
 package publisher
 
 import (
-	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/lib/pq"
 )
 
 type Article struct {
+	ID          int64     `json:"id"`
 	Title       string    `json:"title"`
 	Body        string    `json:"body"`
 	Category    string    `json:"category"`
 	PublishedAt time.Time `json:"published_at"`
+	// Author is the name of the journalist, empty for anonymous articles.
+	Author string `json:"author,omitempty"`
+	// Tags file the article under more topics than its category.
+	Tags []string `json:"tags,omitempty"`
+	// Type tells corrections apart from new articles, which have none.
+	Type string `json:"type,omitempty"`
+	// seq orders articles by the time they were published, which differs
+	// from their ids for scheduled articles. Cursors follow it.
+	seq int64
+}
+
+// Channels the articles table notifies on.
+const (
+	channelNewArticles      = "new_articles"
+	channelArticleUpdated   = "article_updated"
+	channelArticleRetracted = "article_retracted"
+	// channelCategoriesChanged carries no payload, the taxonomy is loaded
+	// again.
+	channelCategoriesChanged = "categories_changed"
+)
+
+// Types of the frames changing an article subscribers were already sent.
+const (
+	TypeArticleUpdated   = "article_updated"
+	TypeArticleRetracted = "article_retracted"
+)
+
+// Retraction is the frame telling subscribers an article was withdrawn.
+type Retraction struct {
+	Type string `json:"type"`
+	ID   int64  `json:"id"`
+}
+
+// Filter selects the articles a session receives: the ones in any of the
+// categories, or their children, and the ones with any of the tags.
+type Filter struct {
+	Categories []string `json:"categories,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+func (f Filter) empty() bool {
+	return len(f.Categories) == 0 && len(f.Tags) == 0
 }
 
 type Broker interface {
-	AddSubscriber(userID string) chan Article
-	RemoveSubscriber(userID string)
+	AddSubscriber(userID string, filter Filter) (*Session, error)
+	RemoveSubscriber(session *Session)
+	Subscribe(session *Session, filter Filter) (Filter, error)
+	Unsubscribe(session *Session, filter Filter) (Filter, error)
+	Delivered(userID string, seq int64)
+	Health() ListenerHealth
 	Run()
 	Stop()
 }
 
-type subscriberSession struct {
-	channel chan Article
-	balance int
+var (
+	errSubscriberNotFound = errors.New("subscriber not found")
+	errAllCategories      = errors.New("subscribed to all categories, subscribe to specific categories first")
+	errUpgradeRequired    = errors.New("free plan allows a single session")
+	errTooManySessions    = errors.New("too many sessions")
+	errShuttingDown       = errors.New("broker shutting down")
+	errInvalidQueueSize   = errors.New("queue size must be at least 1")
+)
+
+// BrokerConfig tunes how the broker delivers articles to sessions.
+type BrokerConfig struct {
+	// PremiumSessions is the number of concurrent sessions premium users
+	// may hold. Free users hold a single one.
+	PremiumSessions int
+	// QueueSize is the number of articles queued per session before the
+	// Overflow policy applies.
+	QueueSize int
+	Overflow  OverflowPolicy
 }
 
+// paywallNotice replaces the body of the articles a user can't pay for.
+const paywallNotice = "Top up your account to read the full content"
+
+// replayBatchSize is the number of missed articles fetched at a time when
+// a subscriber reconnects.
+const replayBatchSize = 100
+
+// backfillRetry is how long the broker waits before loading the articles
+// missed during a listener reconnect again after failing to.
+const backfillRetry = 5 * time.Second
+
 type DbConfig struct {
 	Host     string
 	Port     string
@@ -52,113 +127,714 @@ func (dbC DbConfig) String() string {
 }
 
 type broker struct {
-	subscribers    map[string]*subscriberSession
-	mut            sync.Mutex
-	done           chan struct{}
-	pgListener     *pq.Listener
-	initialBalance int
+	// subscribers holds the sessions of each user.
+	subscribers map[string]map[*Session]struct{}
+	// byCategory and byTag index sessions by the slugs of the categories
+	// and the tags they follow so fan-out only visits interested
+	// subscribers. Sessions without filters live in allCategories and
+	// receive every article.
+	byCategory    map[string]map[*Session]struct{}
+	byTag         map[string]map[*Session]struct{}
+	allCategories map[*Session]struct{}
+	taxonomy      taxonomy
+	mut           sync.Mutex
+	// done is closed to stop the notifications loop, which closes stopped
+	// once it returns.
+	done         chan struct{}
+	stopped      chan struct{}
+	stopOnce     sync.Once
+	running      bool
+	shuttingDown bool
+	pgListener   *pq.Listener
+	// notify receives the listener notifications, a nil one meaning the
+	// connection was re-established and articles may have been missed.
+	notify <-chan *pq.Notification
+	// lastSeen is the sequence number of the latest article published and
+	// behind tells that articles past it still need to be backfilled. Both
+	// are only used by the notifications loop.
+	lastSeen    int64
+	behind      bool
+	health      listenerHealth
+	cursors     CursorRepository
+	articles    ArticleRepository
+	categories  CategoryRepository
+	accounts    AccountRepository
+	deadLetters DeadLetterRepository
+	config      BrokerConfig
+}
+
+// NewBroker returns a broker delivering the articles notified by Postgres.
+// Following a category follows its children too. It fails with
+// errInvalidQueueSize when sessions can't queue a single article.
+func NewBroker(dbConfig DbConfig, cursors CursorRepository, articles ArticleRepository, categories CategoryRepository, accounts AccountRepository, deadLetters DeadLetterRepository, config BrokerConfig) (Broker, error) {
+	if config.QueueSize < 1 {
+		return nil, errInvalidQueueSize
+	}
+
+	b := &broker{
+		subscribers:   make(map[string]map[*Session]struct{}),
+		byCategory:    make(map[string]map[*Session]struct{}),
+		byTag:         make(map[string]map[*Session]struct{}),
+		allCategories: make(map[*Session]struct{}),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		cursors:       cursors,
+		articles:      articles,
+		categories:    categories,
+		accounts:      accounts,
+		deadLetters:   deadLetters,
+		config:        config,
+	}
+	b.pgListener = newPostgresListener(dbConfig, b.health.event)
+	b.notify = b.pgListener.Notify
+
+	return b, nil
+}
+
+// AddSubscriber registers a session for the user. Articles published since
+// the user last received one are replayed before live ones. It fails with
+// errUpgradeRequired or errTooManySessions when the user's plan doesn't
+// allow another session.
+func (b *broker) AddSubscriber(userID string, filter Filter) (*Session, error) {
+	cursor, err := b.cursors.cursor(userID)
+	if err != nil {
+		return nil, fmt.Errorf("loading cursor: %w", err)
+	}
+
+	err = b.accounts.open(userID)
+	if err != nil {
+		return nil, fmt.Errorf("opening account: %w", err)
+	}
+
+	plan, err := b.accounts.plan(userID)
+	if err != nil {
+		return nil, fmt.Errorf("loading plan: %w", err)
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if b.shuttingDown {
+		return nil, errShuttingDown
+	}
+
+	if len(b.subscribers[userID]) >= b.sessionLimit(plan) {
+		if plan == PlanPremium {
+			return nil, errTooManySessions
+		}
+		return nil, errUpgradeRequired
+	}
+
+	session := newSession(userID, b.config.QueueSize, b.config.Overflow, b.charge)
+	session.lastSeq = cursor
+	session.replaying = true
+	addFilter(session, b.resolve(filter))
+
+	if _, ok := b.subscribers[userID]; !ok {
+		b.subscribers[userID] = make(map[*Session]struct{})
+	}
+	b.subscribers[userID][session] = struct{}{}
+	b.index(session)
+
+	go b.replay(session)
+
+	return session, nil
+}
+
+func (b *broker) sessionLimit(plan string) int {
+	if plan == PlanPremium {
+		return b.config.PremiumSessions
+	}
+
+	return 1
+}
+
+// replay sends the session the articles it missed, in order, and then
+// switches it to live delivery. Live articles received meanwhile are
+// buffered and deduplicated by sequence number, so nothing is lost or
+// repeated. Unlike live ones, replayed articles wait for room in the
+// session queue. Sessions whose articles can't be loaded are closed, so
+// the subscriber reconnects from its saved cursor instead of skipping
+// them.
+func (b *broker) replay(s *Session) {
+	after := s.lastSeq
+	for {
+		articles, err := b.articles.articlesAfter(after, replayBatchSize)
+		if err != nil {
+			log.Println(fmt.Sprintf("error replaying articles of subscriber %s: %v", s.userID, err))
+			b.mut.Lock()
+			b.remove(s, websocket.CloseTryAgainLater, "Missed articles could not be loaded")
+			b.mut.Unlock()
+			return
+		}
+
+		if len(articles) == 0 {
+			b.mut.Lock()
+			if b.registered(s) {
+				s.replaying = false
+				for _, article := range s.pending {
+					b.send(s, article)
+				}
+				s.pending = nil
+			}
+			b.mut.Unlock()
+			return
+		}
+
+		for _, article := range articles {
+			if !s.waitSpace() {
+				return
+			}
+
+			b.mut.Lock()
+			if !b.registered(s) {
+				b.mut.Unlock()
+				return
+			}
+			if s.follows(b.taxonomy.lineage(article.Category), article.Tags) {
+				b.send(s, article)
+			}
+			s.lastSeq = article.seq
+			b.mut.Unlock()
+
+			after = article.seq
+		}
+	}
 }
 
-func NewBroker(dbConfig DbConfig, initialBalance int) Broker {
-	l := newPostgresListener(dbConfig)
-	return &broker{
-		subscribers:    make(map[string]*subscriberSession),
-		pgListener:     l,
-		initialBalance: initialBalance,
+// Delivered records the article with the given sequence number as the last
+// one the user received, so a later connection resumes after it.
+func (b *broker) Delivered(userID string, seq int64) {
+	err := b.cursors.saveCursor(userID, seq)
+	if err != nil {
+		log.Println(fmt.Sprintf("error saving cursor of subscriber %s: %v", userID, err))
 	}
 }
 
-func (b *broker) AddSubscriber(userID string) chan Article {
+func (b *broker) RemoveSubscriber(s *Session) {
 	b.mut.Lock()
 	defer b.mut.Unlock()
 
-	if _, ok := b.subscribers[userID]; ok {
-		return nil
+	b.remove(s, 0, "")
+}
+
+// remove closes the session with the given websocket close code and reason
+// and unregisters it. It must be called with the mutex held.
+func (b *broker) remove(s *Session, code int, reason string) {
+	s.close(code, reason)
+
+	if !b.registered(s) {
+		return
 	}
 
-	ch := make(chan Article, 10)
-	b.subscribers[userID] = &subscriberSession{
-		channel: ch,
-		balance: b.initialBalance,
+	b.unindex(s)
+	delete(b.subscribers[s.userID], s)
+	if len(b.subscribers[s.userID]) == 0 {
+		delete(b.subscribers, s.userID)
 	}
+}
 
-	return ch
+func (b *broker) registered(s *Session) bool {
+	_, ok := b.subscribers[s.userID][s]
+	return ok
 }
 
-func (b *broker) RemoveSubscriber(userID string) {
+// Subscribe adds categories and tags to the ones the session follows.
+// Subscribing to neither follows every category. It returns what the
+// session follows, nil categories meaning all of them.
+func (b *broker) Subscribe(s *Session, filter Filter) (Filter, error) {
 	b.mut.Lock()
 	defer b.mut.Unlock()
 
-	s, ok := b.subscribers[userID]
-	if !ok {
+	if !b.registered(s) {
+		return Filter{}, errSubscriberNotFound
+	}
+
+	b.unindex(s)
+	if filter.empty() {
+		s.categories = nil
+		s.tags = nil
+	} else {
+		addFilter(s, b.resolve(filter))
+	}
+	b.index(s)
+
+	return s.filter(), nil
+}
+
+// Unsubscribe removes categories and tags from the ones the session
+// follows. Unsubscribing from neither stops following everything.
+func (b *broker) Unsubscribe(s *Session, filter Filter) (Filter, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if !b.registered(s) {
+		return Filter{}, errSubscriberNotFound
+	}
+
+	if !filter.empty() && s.categories == nil {
+		return Filter{}, errAllCategories
+	}
+
+	b.unindex(s)
+	if filter.empty() {
+		s.categories = make(map[string]struct{})
+		s.tags = nil
+	}
+	filter = b.resolve(filter)
+	for _, c := range filter.Categories {
+		delete(s.categories, c)
+	}
+	for _, t := range filter.Tags {
+		delete(s.tags, tagKey(t))
+	}
+	b.index(s)
+
+	return s.filter(), nil
+}
+
+// resolve maps the categories of the filter to their slugs.
+func (b *broker) resolve(filter Filter) Filter {
+	return Filter{Categories: b.taxonomy.resolve(filter.Categories), Tags: filter.Tags}
+}
+
+// index registers the session under each of its categories and tags, or as a
+// catch-all session when it has no filters.
+func (b *broker) index(s *Session) {
+	if s.categories == nil {
+		b.allCategories[s] = struct{}{}
 		return
 	}
 
-	close(s.channel)
+	indexKeys(b.byCategory, s.categories, s)
+	indexKeys(b.byTag, s.tags, s)
+}
+
+func (b *broker) unindex(s *Session) {
+	delete(b.allCategories, s)
+
+	unindexKeys(b.byCategory, s.categories, s)
+	unindexKeys(b.byTag, s.tags, s)
+}
+
+func indexKeys(index map[string]map[*Session]struct{}, keys map[string]struct{}, s *Session) {
+	for k := range keys {
+		if _, ok := index[k]; !ok {
+			index[k] = make(map[*Session]struct{})
+		}
+		index[k][s] = struct{}{}
+	}
+}
+
+func unindexKeys(index map[string]map[*Session]struct{}, keys map[string]struct{}, s *Session) {
+	for k := range keys {
+		delete(index[k], s)
+		if len(index[k]) == 0 {
+			delete(index, k)
+		}
+	}
+}
+
+// categoryKey normalizes a category so filters match regardless of case
+// or surrounding whitespace.
+func categoryKey(category string) string {
+	return strings.ToLower(strings.TrimSpace(category))
+}
 
-	delete(b.subscribers, userID)
-	return
+// tagKey normalizes tags the way the aggregator stores them.
+func tagKey(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
 }
 
 func (b *broker) Run() {
+	b.mut.Lock()
+	b.running = true
+	b.mut.Unlock()
+
 	go func() {
+		defer close(b.stopped)
+
+		b.loadTaxonomy()
+
+		// Articles published from now on are either notified or backfilled
+		seq, err := b.articles.latestSeq()
+		if err != nil {
+			log.Println("error loading latest article:", err)
+		}
+		b.seen(seq)
+
 		for {
+			var retry <-chan time.Time
+			if b.behind {
+				retry = time.After(backfillRetry)
+			}
+
 			select {
 			case <-b.done:
-				log.Println("broker shutdown")
-				return
-			case n := <-b.pgListener.Notify:
-				var article Article
-				err := json.Unmarshal([]byte(n.Extra), &article)
-				if err != nil {
-					log.Println("Error processing JSON: ", err)
-					return
-				}
-				article.PublishedAt = article.PublishedAt.UTC()
-
-				b.mut.Lock()
-				for userID := range b.subscribers {
-					session := b.subscribers[userID]
-					if session.balance > 0 {
-						session.channel <- article
-						session.balance--
-					} else {
-						session.channel <- Article{
-							Title:       article.Title,
-							Body:        "Top up your account to read the full content",
-							Category:    article.Category,
-							PublishedAt: article.PublishedAt,
-						}
+				// Deliver the notifications already received before leaving
+				for {
+					select {
+					case n := <-b.notify:
+						b.handle(n)
+					default:
+						log.Println("broker shutdown")
+						return
 					}
 				}
-				b.mut.Unlock()
+			case n := <-b.notify:
+				b.handle(n)
+			case <-retry:
+				b.backfill()
 			}
 		}
 	}()
 }
 
-func (b *broker) Stop() {
-	b.done <- struct{}{}
+func (b *broker) handle(n *pq.Notification) {
+	if n == nil {
+		// The listener reconnected, notifications sent meanwhile are lost
+		metrics.Add(metricListenerReconnects, 1)
+		b.loadTaxonomy()
+		b.behind = true
+	}
+	if b.behind {
+		b.backfill()
+	}
+	if n == nil {
+		return
+	}
+
+	if n.Channel == channelCategoriesChanged {
+		b.loadTaxonomy()
+		return
+	}
+
+	id, err := parseNotification(n.Extra)
+	if err != nil {
+		b.deadLetter(n, err)
+		return
+	}
+
+	switch n.Channel {
+	case channelNewArticles:
+	case channelArticleUpdated:
+		b.handleUpdate(id)
+		return
+	case channelArticleRetracted:
+		b.handleRetraction(n, id)
+		return
+	default:
+		b.deadLetter(n, errUnknownChannel)
+		return
+	}
+
+	article, err := b.articles.article(id)
+	if errors.Is(err, errArticleNotFound) {
+		b.deadLetter(n, err)
+		return
+	}
+	if err != nil {
+		// Not the notification's fault, backfill picks the article up
+		log.Printf("error loading article %d: %v", id, err)
+		b.behind = true
+		return
+	}
+
+	b.publish(article)
+	b.seen(article.seq)
+}
+
+// handleUpdate sends the new version of an article to the sessions it was
+// sent to. Updates notified while the listener was reconnecting are lost,
+// as are the ones of articles retracted meanwhile.
+func (b *broker) handleUpdate(id int64) {
+	article, err := b.articles.article(id)
+	if err != nil {
+		log.Printf("error loading updated article %d: %v", id, err)
+		return
+	}
+
+	article.Type = TypeArticleUpdated
+	b.publishChange(article)
+}
+
+// loadTaxonomy replaces the category tree, keeping the current one when
+// it can't be loaded. Sessions keep the categories they resolved to.
+func (b *broker) loadTaxonomy() {
+	categories, err := b.categories.categories()
+	if err != nil {
+		log.Println("error loading categories:", err)
+		return
+	}
+
+	b.taxonomy.set(categories)
+}
+
+func (b *broker) handleRetraction(n *pq.Notification, id int64) {
+	article, err := b.articles.retracted(id)
+	if errors.Is(err, errArticleNotFound) {
+		b.deadLetter(n, err)
+		return
+	}
+	if err != nil {
+		log.Printf("error loading retracted article %d: %v", id, err)
+		return
+	}
+
+	b.publishChange(Article{ID: article.ID, Category: article.Category, Tags: article.Tags, Type: TypeArticleRetracted, seq: article.seq})
 }
 
-func newPostgresListener(dbConfig DbConfig) *pq.Listener {
+// maxNotificationSize bounds the payloads accepted from the listener,
+// which only carry an article id.
+const maxNotificationSize = 32
+
+var (
+	errNotificationTooLarge = errors.New("notification too large")
+	errInvalidArticleID     = errors.New("invalid article id")
+	errUnknownChannel       = errors.New("unknown channel")
+)
+
+func parseNotification(payload string) (int64, error) {
+	if len(payload) > maxNotificationSize {
+		return 0, fmt.Errorf("%w: %d bytes", errNotificationTooLarge, len(payload))
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(payload), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalidArticleID
+	}
 
-	_, err := sql.Open("postgres", dbConfig.String())
+	return id, nil
+}
+
+// deadLetter records a notification that can't be processed so it doesn't
+// stop the ones after it.
+func (b *broker) deadLetter(n *pq.Notification, reason error) {
+	metrics.Add(metricPoisonNotifications, 1)
+
+	payload := n.Extra
+	if len(payload) > 64 {
+		payload = payload[:64] + "..."
+	}
+	log.Printf("dropping notification on %s from pid %d: %v: %q", n.Channel, n.BePid, reason, payload)
+
+	err := b.deadLetters.store(n.Channel, n.Extra, reason.Error())
 	if err != nil {
-		panic(err)
+		log.Println("error storing dead letter:", err)
 	}
+}
 
-	reportProblem := func(ev pq.ListenerEventType, err error) {
+// backfill publishes the articles published after the last one seen. It's
+// retried after backfillRetry or on the next notification when the
+// articles can't be loaded.
+// Sessions skip the articles they were already sent.
+func (b *broker) backfill() {
+	for {
+		articles, err := b.articles.articlesAfter(b.lastSeen, replayBatchSize)
 		if err != nil {
-			fmt.Println(err.Error())
+			log.Println("error backfilling articles:", err)
+			b.health.backfillFailed(err)
+			return
+		}
+		if len(articles) == 0 {
+			b.behind = false
+			b.health.backfilled()
+			return
+		}
+
+		for _, a := range articles {
+			b.publish(a)
+			b.seen(a.seq)
 		}
+		metrics.Add(metricBackfilledArticles, int64(len(articles)))
 	}
+}
 
-	listener := pq.NewListener(dbConfig.String(), 10*time.Second, time.Minute, reportProblem)
-	err = listener.Listen("new_articles")
-	if err != nil {
-		panic(err)
+func (b *broker) seen(seq int64) {
+	if seq > b.lastSeen {
+		b.lastSeen = seq
+		b.health.seen(seq)
 	}
+}
 
-	return listener
+// Health reports the state of the Postgres listener.
+func (b *broker) Health() ListenerHealth {
+	return b.health.get()
+}
+
+// publish delivers the article to every session following its category,
+// one of its ancestors or one of its tags, and to the sessions without
+// filters. Articles are queued on each session, so a stalled connection
+// doesn't hold up the others.
+func (b *broker) publish(article Article) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	for session := range b.audience(article) {
+		b.deliver(session, article)
+	}
+}
+
+// audience returns the sessions following the article's category, one of
+// its ancestors, one of its tags or every category, each once. It must be
+// called with the mutex held.
+func (b *broker) audience(article Article) map[*Session]struct{} {
+	sessions := make(map[*Session]struct{}, len(b.allCategories))
+	for session := range b.allCategories {
+		sessions[session] = struct{}{}
+	}
+	for _, c := range b.taxonomy.lineage(article.Category) {
+		for session := range b.byCategory[c] {
+			sessions[session] = struct{}{}
+		}
+	}
+	for _, t := range article.Tags {
+		for session := range b.byTag[t] {
+			sessions[session] = struct{}{}
+		}
+	}
+
+	return sessions
+}
+
+func (b *broker) deliver(session *Session, article Article) {
+	if session.replaying {
+		session.pending = append(session.pending, article)
+		return
+	}
+
+	b.send(session, article)
+}
+
+// send hands the article to the session unless it already got it. It's
+// charged for once the session writes it.
+func (b *broker) send(session *Session, article Article) {
+	if article.seq <= session.lastSeq {
+		return
+	}
+	session.lastSeq = article.seq
+
+	if !session.enqueue(article) {
+		log.Println(fmt.Sprintf("disconnecting subscriber %s, too slow reading articles", session.userID))
+		metrics.Add(metricSlowConsumerDisconnects, 1)
+		b.remove(session, websocket.ClosePolicyViolation, "Too slow reading articles")
+	}
+}
+
+// charge debits the user for an article a session is about to write,
+// paywalling it when they can't pay. It's called by the session without
+// holding the broker mutex, so a slow account lookup only holds up that
+// session.
+func (b *broker) charge(userID string, article Article) Article {
+	var paid bool
+	var err error
+	switch article.Type {
+	case "":
+		// Articles are paywalled when the balance can't be checked, rather
+		// than given away for free. Users are charged once per article no
+		// matter how many of their sessions receive it.
+		paid, err = b.accounts.debit(userID, article.ID)
+		if err != nil {
+			log.Println(fmt.Sprintf("error debiting account of subscriber %s: %v", userID, err))
+		}
+	case TypeArticleUpdated:
+		// Corrections are free, but only show the full content to the
+		// users who paid for the article.
+		paid, err = b.accounts.paid(userID, article.ID)
+		if err != nil {
+			log.Println(fmt.Sprintf("error checking payment of subscriber %s: %v", userID, err))
+		}
+	default:
+		return article
+	}
+
+	if !paid {
+		article.Body = paywallNotice
+	}
+
+	return article
+}
+
+// publishChange delivers an update or retraction to the sessions following
+// the article's category, one of its ancestors or one of its tags. Sessions
+// following only the category or tags an updated article had before aren't
+// told.
+func (b *broker) publishChange(change Article) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	for session := range b.audience(change) {
+		b.sendChange(session, change)
+	}
+}
+
+// sendChange hands the change to the session when it was sent the article,
+// whatever its sequence number. The copies of the article waiting for the
+// replay to end are changed instead, and the ones the replay is yet to
+// load are loaded as they are now.
+func (b *broker) sendChange(session *Session, change Article) {
+	if session.replaying {
+		session.pending = applyChange(session.pending, change)
+	}
+	if change.seq > session.lastSeq {
+		return
+	}
+
+	if !session.enqueue(change) {
+		log.Println(fmt.Sprintf("disconnecting subscriber %s, too slow reading articles", session.userID))
+		metrics.Add(metricSlowConsumerDisconnects, 1)
+		b.remove(session, websocket.ClosePolicyViolation, "Too slow reading articles")
+	}
+}
+
+// applyChange replaces the article changed in the list, or removes it when
+// it was retracted.
+func applyChange(articles []Article, change Article) []Article {
+	changed := articles[:0]
+	for _, a := range articles {
+		if a.ID != change.ID {
+			changed = append(changed, a)
+			continue
+		}
+		if change.Type == TypeArticleUpdated {
+			change.Type = ""
+			changed = append(changed, change)
+		}
+	}
+
+	return changed
+}
+
+// Stop stops listening for articles and delivers the ones already
+// received. Sessions are then closed with a going away close frame once
+// the articles queued on them are written.
+func (b *broker) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+
+		b.mut.Lock()
+		running := b.running
+		b.mut.Unlock()
+		if running {
+			<-b.stopped
+		}
+
+		b.mut.Lock()
+		b.shuttingDown = true
+		for userID, sessions := range b.subscribers {
+			for s := range sessions {
+				s.drain(websocket.CloseGoingAway, "Server shutting down")
+				b.unindex(s)
+			}
+			delete(b.subscribers, userID)
+		}
+		b.mut.Unlock()
+
+		if b.pgListener != nil {
+			err := b.pgListener.Close()
+			if err != nil {
+				log.Println("error closing listener:", err)
+			}
+		}
+	})
 }
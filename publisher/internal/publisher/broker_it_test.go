@@ -1,28 +1,33 @@
 package publisher
 
 import (
+	"context"
 	"database/sql"
 	"testing"
 	"time"
 
+	"github.com/XaviFP/notifications/migrations"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestBroker(t *testing.T) {
 	h := newTestHarness(t)
-	broker := NewBroker(h.dbConfig, 1)
+	broker, err := NewBroker(h.dbConfig, NewCursorRepository(h.db), NewArticleRepository(h.db), NewCategoryRepository(h.db), NewAccountRepository(h.db, 1), NewDeadLetterRepository(h.db), testBrokerConfig)
+	assert.Nil(t, err)
 	broker.Run()
 
-	ch := broker.AddSubscriber("testUserID")
+	session, err := broker.AddSubscriber("testUserID", Filter{})
+	assert.Nil(t, err)
+	ch := session.Articles()
 
 	expected := Article{
 		Title:       "title",
 		Body:        "body",
-		Category:    "category",
+		Category:    "travel",
 		PublishedAt: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
 	}
 
-	_, err := h.db.Exec(`
+	_, err = h.db.Exec(`
 		INSERT INTO articles (
 				title,
 				body,
@@ -38,6 +43,8 @@ func TestBroker(t *testing.T) {
 
 	actual := <-ch
 
+	expected.ID = actual.ID
+	expected.seq = actual.seq
 	assert.Equal(t, expected, actual)
 
 	// After reading the previous article,
@@ -45,7 +52,7 @@ func TestBroker(t *testing.T) {
 	fullArticle := Article{
 		Title:       "Full Title",
 		Body:        "Full Body",
-		Category:    "Full Category",
+		Category:    "japan",
 		PublishedAt: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
 	}
 
@@ -66,8 +73,10 @@ func TestBroker(t *testing.T) {
 	actual = <-ch
 
 	noFundsArticle := Article{
+		ID:          actual.ID,
+		seq:         actual.seq,
 		Title:       fullArticle.Title,
-		Body:        "Top up your account to read the full content",
+		Body:        paywallNotice,
 		Category:    fullArticle.Category,
 		PublishedAt: fullArticle.PublishedAt,
 	}
@@ -75,6 +84,170 @@ func TestBroker(t *testing.T) {
 	assert.Equal(t, noFundsArticle, actual)
 }
 
+func TestBroker_ReplayOnReconnect(t *testing.T) {
+	h := newTestHarness(t)
+	broker, err := NewBroker(h.dbConfig, NewCursorRepository(h.db), NewArticleRepository(h.db), NewCategoryRepository(h.db), NewAccountRepository(h.db, 10), NewDeadLetterRepository(h.db), testBrokerConfig)
+	assert.Nil(t, err)
+	broker.Run()
+
+	session, err := broker.AddSubscriber("testUserID", Filter{})
+	assert.Nil(t, err)
+	ch := session.Articles()
+
+	first := h.insertArticle(t, "first")
+	actual := <-ch
+	assert.Equal(t, first, actual.ID)
+	broker.Delivered("testUserID", actual.seq)
+
+	broker.RemoveSubscriber(session)
+
+	// Published while the subscriber was offline
+	missed := []int64{h.insertArticle(t, "second"), h.insertArticle(t, "third")}
+
+	session, err = broker.AddSubscriber("testUserID", Filter{})
+	assert.Nil(t, err)
+	ch = session.Articles()
+	live := h.insertArticle(t, "fourth")
+
+	for _, id := range append(missed, live) {
+		actual := <-ch
+		assert.Equal(t, id, actual.ID)
+	}
+
+	select {
+	case a := <-ch:
+		t.Fatalf("unexpected article %d", a.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroker_BalanceSurvivesReconnect(t *testing.T) {
+	h := newTestHarness(t)
+	broker, err := NewBroker(h.dbConfig, NewCursorRepository(h.db), NewArticleRepository(h.db), NewCategoryRepository(h.db), NewAccountRepository(h.db, 1), NewDeadLetterRepository(h.db), testBrokerConfig)
+	assert.Nil(t, err)
+	broker.Run()
+
+	session, err := broker.AddSubscriber("testUserID", Filter{})
+	assert.Nil(t, err)
+	ch := session.Articles()
+	h.insertArticle(t, "paid")
+	actual := <-ch
+	assert.Equal(t, "body", actual.Body)
+
+	broker.RemoveSubscriber(session)
+
+	// Reconnecting must not reset the balance
+	session, err = broker.AddSubscriber("testUserID", Filter{})
+	assert.Nil(t, err)
+	ch = session.Articles()
+	h.insertArticle(t, "paywalled")
+	actual = <-ch
+	assert.Equal(t, paywallNotice, actual.Body)
+}
+
+func TestBroker_CorrectionsAndRetractions(t *testing.T) {
+	h := newTestHarness(t)
+	broker, err := NewBroker(h.dbConfig, NewCursorRepository(h.db), NewArticleRepository(h.db), NewCategoryRepository(h.db), NewAccountRepository(h.db, 10), NewDeadLetterRepository(h.db), testBrokerConfig)
+	assert.Nil(t, err)
+	broker.Run()
+
+	session, err := broker.AddSubscriber("testUserID", Filter{})
+	assert.Nil(t, err)
+	ch := session.Articles()
+
+	id := h.insertArticle(t, "title")
+	assert.Equal(t, id, (<-ch).ID)
+
+	_, err = h.db.Exec(`UPDATE articles SET title = 'fixed title' WHERE id = $1`, id)
+	assert.Nil(t, err)
+
+	actual := <-ch
+	assert.Equal(t, TypeArticleUpdated, actual.Type)
+	assert.Equal(t, "fixed title", actual.Title)
+	assert.Equal(t, "body", actual.Body)
+
+	_, err = h.db.Exec(`UPDATE articles SET status = 'retracted' WHERE id = $1`, id)
+	assert.Nil(t, err)
+
+	actual = <-ch
+	assert.Equal(t, TypeArticleRetracted, actual.Type)
+	assert.Equal(t, id, actual.ID)
+}
+
+func TestBroker_CategoriesChanged(t *testing.T) {
+	h := newTestHarness(t)
+	broker, err := NewBroker(h.dbConfig, NewCursorRepository(h.db), NewArticleRepository(h.db), NewCategoryRepository(h.db), NewAccountRepository(h.db, 10), NewDeadLetterRepository(h.db), testBrokerConfig)
+	assert.Nil(t, err)
+	broker.Run()
+
+	session, err := broker.AddSubscriber("testUserID", Filter{Categories: []string{"asia"}})
+	assert.Nil(t, err)
+	ch := session.Articles()
+
+	// Notified before the article, the broker knows korea is in asia
+	// when it's published
+	_, err = h.db.Exec(`INSERT INTO categories (slug, name) VALUES ('asia', 'Asia'), ('korea', 'Korea')`)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`UPDATE categories SET parent = 'asia' WHERE slug = 'korea'`)
+	assert.Nil(t, err)
+
+	h.insertArticle(t, "travel")
+	var id int64
+	err = h.db.QueryRow(`
+		INSERT INTO articles (title, body, category, published_at)
+		VALUES ('korea', 'body', 'korea', NOW()) RETURNING id`,
+	).Scan(&id)
+	assert.Nil(t, err)
+
+	actual := <-ch
+	assert.Equal(t, id, actual.ID)
+	assert.Equal(t, "korea", actual.Category)
+}
+
+func TestBroker_CommitOrder(t *testing.T) {
+	h := newTestHarness(t)
+	broker, err := NewBroker(h.dbConfig, NewCursorRepository(h.db), NewArticleRepository(h.db), NewCategoryRepository(h.db), NewAccountRepository(h.db, 10), NewDeadLetterRepository(h.db), testBrokerConfig)
+	assert.Nil(t, err)
+	broker.Run()
+
+	session, err := broker.AddSubscriber("testUserID", Filter{})
+	assert.Nil(t, err)
+	ch := session.Articles()
+
+	first, err := h.db.Begin()
+	assert.Nil(t, err)
+	var firstID int64
+	err = first.QueryRow(`
+		INSERT INTO articles (title, body, category, published_at)
+		VALUES ('first', 'body', 'travel', NOW()) RETURNING id`,
+	).Scan(&firstID)
+	assert.Nil(t, err)
+
+	// Numbered after the first one, it waits for it to commit
+	second := make(chan int64)
+	go func() {
+		second <- h.insertArticle(t, "second")
+	}()
+	select {
+	case <-second:
+		t.Fatal("published before the article numbered first was committed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.Nil(t, first.Commit())
+	secondID := <-second
+
+	assert.Equal(t, firstID, (<-ch).ID)
+	assert.Equal(t, secondID, (<-ch).ID)
+	assert.Less(t, h.seq(t, firstID), h.seq(t, secondID))
+}
+
+var testBrokerConfig = BrokerConfig{
+	PremiumSessions: 1,
+	QueueSize:       10,
+	Overflow:        DropOldest,
+}
+
 type testHarness struct {
 	db       *sql.DB
 	dbConfig DbConfig
@@ -94,12 +267,36 @@ func newTestHarness(t *testing.T) *testHarness {
 	if err != nil {
 		panic(err)
 	}
+	_, err = migrations.Up(context.Background(), db)
+	if err != nil {
+		panic(err)
+	}
 
 	t.Cleanup(func() {
 		defer db.Close()
 
 		_, err = db.Exec("DELETE FROM articles")
 		assert.Nil(t, err)
+
+		_, err = db.Exec("DELETE FROM journalists")
+		assert.Nil(t, err)
+
+		_, err = db.Exec("DELETE FROM subscriber_cursors")
+		assert.Nil(t, err)
+
+		_, err = db.Exec("DELETE FROM dead_letters")
+		assert.Nil(t, err)
+
+		_, err = db.Exec("DELETE FROM tags")
+		assert.Nil(t, err)
+
+		// Keep the categories seeded by the migrations
+		_, err = db.Exec("DELETE FROM categories WHERE slug NOT IN ('japan', 'travel', 'technology')")
+		assert.Nil(t, err)
+
+		// The ledger is append-only, row deletes are rejected
+		_, err = db.Exec("TRUNCATE account_ledger, accounts")
+		assert.Nil(t, err)
 	})
 
 	return &testHarness{
@@ -107,3 +304,38 @@ func newTestHarness(t *testing.T) *testHarness {
 		dbConfig: dbConfig,
 	}
 }
+
+func (h *testHarness) insertArticle(t *testing.T, title string) int64 {
+	var id int64
+	err := h.db.QueryRow(`
+		INSERT INTO articles (
+				title,
+				body,
+				category,
+				published_at
+		) VALUES ($1, 'body', 'travel', NOW()) RETURNING id`,
+		title,
+	).Scan(&id)
+	assert.Nil(t, err)
+
+	return id
+}
+
+// tag files the article under the tags.
+func (h *testHarness) tag(t *testing.T, id int64, tags ...string) {
+	for _, tag := range tags {
+		_, err := h.db.Exec(`INSERT INTO tags (name) VALUES ($1) ON CONFLICT DO NOTHING`, tag)
+		assert.Nil(t, err)
+		_, err = h.db.Exec(`INSERT INTO article_tags (article_id, tag) VALUES ($1, $2)`, id, tag)
+		assert.Nil(t, err)
+	}
+}
+
+// seq returns the sequence number the article was published with.
+func (h *testHarness) seq(t *testing.T, id int64) int64 {
+	var seq int64
+	err := h.db.QueryRow(`SELECT seq FROM articles WHERE id = $1`, id).Scan(&seq)
+	assert.Nil(t, err)
+
+	return seq
+}
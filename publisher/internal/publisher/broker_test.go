@@ -1,22 +1,730 @@
 package publisher
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestBroker_AddRemove(t *testing.T) {
-	b := &broker{
-		subscribers: make(map[string]*subscriberSession),
+	b := newTestBroker()
+
+	session, err := b.AddSubscriber("test", Filter{})
+	assert.Nil(t, err)
+	assert.Contains(t, b.subscribers["test"], session)
+	assert.Equal(t, "test", session.UserID())
+	assert.Nil(t, session.categories)
+	assert.Contains(t, b.allCategories, session)
+
+	b.RemoveSubscriber(session)
+	_, ok := b.subscribers["test"]
+	assert.False(t, ok)
+	assert.NotContains(t, b.allCategories, session)
+
+	_, ok = <-session.Articles()
+	assert.False(t, ok)
+}
+
+func TestNewBroker_QueueSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		_, err := NewBroker(DbConfig{}, nil, nil, nil, nil, nil, BrokerConfig{QueueSize: size, Overflow: DropOldest})
+		assert.Equal(t, errInvalidQueueSize, err)
+	}
+}
+
+func TestBroker_SessionLimit(t *testing.T) {
+	accounts := &mockAccountRepository{}
+	accounts.On("open", mock.Anything).Return(nil)
+	accounts.On("plan", "free").Return(PlanFree, nil)
+	accounts.On("plan", "premium").Return(PlanPremium, nil)
+
+	b := newTestBroker()
+	b.accounts = accounts
+	b.config.PremiumSessions = 2
+
+	first, err := b.AddSubscriber("free", Filter{})
+	assert.Nil(t, err)
+
+	_, err = b.AddSubscriber("free", Filter{})
+	assert.Equal(t, errUpgradeRequired, err)
+
+	// A free session slot is released once removed
+	b.RemoveSubscriber(first)
+	_, err = b.AddSubscriber("free", Filter{})
+	assert.Nil(t, err)
+
+	_, err = b.AddSubscriber("premium", Filter{})
+	assert.Nil(t, err)
+	_, err = b.AddSubscriber("premium", Filter{})
+	assert.Nil(t, err)
+	assert.Len(t, b.subscribers["premium"], 2)
+
+	_, err = b.AddSubscriber("premium", Filter{})
+	assert.Equal(t, errTooManySessions, err)
+}
+
+func TestBroker_MultipleSessions(t *testing.T) {
+	accounts := &mockAccountRepository{}
+	accounts.On("open", "premium").Return(nil)
+	accounts.On("plan", "premium").Return(PlanPremium, nil)
+	// Every session of the user asks, the repository charges once
+	accounts.On("debit", "premium", int64(1)).Return(true, nil).Twice()
+
+	b := newTestBroker()
+	b.accounts = accounts
+	b.config.PremiumSessions = 2
+
+	phone, err := b.AddSubscriber("premium", Filter{Categories: []string{"japan"}})
+	assert.Nil(t, err)
+	laptop, err := b.AddSubscriber("premium", Filter{Categories: []string{"japan"}})
+	assert.Nil(t, err)
+
+	article := Article{ID: 1, seq: 1, Title: "title", Body: "body", Category: "japan"}
+	b.publish(article)
+
+	assert.Equal(t, article, <-phone.Articles())
+	assert.Equal(t, article, <-laptop.Articles())
+
+	// Removing one session keeps the other one
+	b.RemoveSubscriber(phone)
+	assert.Len(t, b.subscribers["premium"], 1)
+	assert.Contains(t, b.byCategory["japan"], laptop)
+
+	accounts.AssertExpectations(t)
+}
+
+func TestBroker_CategoryIndex(t *testing.T) {
+	b := newTestBroker()
+
+	session, err := b.AddSubscriber("test", Filter{Categories: []string{" Japan", "travel", ""}})
+	assert.Nil(t, err)
+	assert.Contains(t, b.byCategory["japan"], session)
+	assert.Contains(t, b.byCategory["travel"], session)
+	assert.NotContains(t, b.allCategories, session)
+
+	b.RemoveSubscriber(session)
+	assert.Empty(t, b.byCategory)
+}
+
+func TestBroker_PublishByCategory(t *testing.T) {
+	b := newTestBroker()
+
+	japan, _ := b.AddSubscriber("japan", Filter{Categories: []string{"japan"}})
+	travel, _ := b.AddSubscriber("travel", Filter{Categories: []string{"travel"}})
+	all, _ := b.AddSubscriber("all", Filter{})
+
+	article := Article{ID: 1, seq: 1, Title: "title", Body: "body", Category: "Japan"}
+	b.publish(article)
+
+	assert.Equal(t, article, <-japan.Articles())
+	assert.Equal(t, article, <-all.Articles())
+	assert.Empty(t, travel.Articles())
+}
+
+func TestBroker_PublishByTag(t *testing.T) {
+	b := newTestBroker()
+
+	batteries, _ := b.AddSubscriber("batteries", Filter{Tags: []string{"Batteries"}})
+	both, _ := b.AddSubscriber("both", Filter{Categories: []string{"technology"}, Tags: []string{"japan"}})
+	travel, _ := b.AddSubscriber("travel", Filter{Categories: []string{"travel"}})
+
+	article := Article{ID: 1, seq: 1, Title: "title", Body: "body", Category: "technology", Tags: []string{"batteries", "japan"}}
+	b.publish(article)
+
+	// Sessions matching the category and a tag get the article once
+	assert.Equal(t, article, <-batteries.Articles())
+	assert.Equal(t, article, <-both.Articles())
+	assert.Empty(t, both.Articles())
+	assert.Empty(t, travel.Articles())
+
+	b.publishChange(Article{ID: 1, seq: 1, Category: "technology", Tags: []string{"batteries"}, Type: TypeArticleRetracted})
+	assert.Equal(t, TypeArticleRetracted, (<-batteries.Articles()).Type)
+	assert.Equal(t, TypeArticleRetracted, (<-both.Articles()).Type)
+}
+
+func TestBroker_CategoryTree(t *testing.T) {
+	categories := &mockCategoryRepository{}
+	categories.On("categories").Return([]Category{
+		{Slug: "asia", Name: "Asia"},
+		{Slug: "japan", Name: "Japan", Parent: "asia", Aliases: []string{"nippon"}},
+		{Slug: "travel", Name: "Travel"},
+	}, nil)
+
+	b := newTestBroker()
+	b.categories = categories
+	b.handle(&pq.Notification{Channel: channelCategoriesChanged})
+
+	asia, _ := b.AddSubscriber("asia", Filter{Categories: []string{"Asia"}})
+	both, _ := b.AddSubscriber("both", Filter{Categories: []string{"asia", "Nippon"}})
+	travel, _ := b.AddSubscriber("travel", Filter{Categories: []string{"travel"}})
+	assert.Equal(t, []string{"asia", "japan"}, both.filter().Categories)
+
+	// Parents cover their children, sessions following both get it once
+	article := Article{ID: 1, seq: 1, Title: "title", Body: "body", Category: "japan"}
+	b.publish(article)
+
+	assert.Equal(t, article, <-asia.Articles())
+	assert.Equal(t, article, <-both.Articles())
+	assert.Empty(t, both.Articles())
+	assert.Empty(t, travel.Articles())
+
+	// Children don't cover their parents
+	_, err := b.Unsubscribe(both, Filter{Categories: []string{"asia"}})
+	assert.Nil(t, err)
+	b.publish(Article{ID: 2, seq: 2, Title: "title", Body: "body", Category: "asia"})
+	<-asia.Articles()
+	assert.Empty(t, both.Articles())
+
+	categories.AssertExpectations(t)
+}
+
+func TestBroker_SubscribeUnsubscribe(t *testing.T) {
+	b := newTestBroker()
+	session, _ := b.AddSubscriber("test", Filter{})
+
+	filter, err := b.Subscribe(session, Filter{Categories: []string{"Japan"}})
+	assert.Nil(t, err)
+	assert.Equal(t, Filter{Categories: []string{"japan"}}, filter)
+	assert.Contains(t, b.byCategory["japan"], session)
+	assert.NotContains(t, b.allCategories, session)
+
+	filter, err = b.Subscribe(session, Filter{Categories: []string{"travel"}, Tags: []string{" Electric  Vehicles"}})
+	assert.Nil(t, err)
+	assert.Equal(t, Filter{Categories: []string{"japan", "travel"}, Tags: []string{"electric vehicles"}}, filter)
+	assert.Contains(t, b.byTag["electric vehicles"], session)
+
+	filter, err = b.Unsubscribe(session, Filter{Categories: []string{"japan"}, Tags: []string{"electric vehicles"}})
+	assert.Nil(t, err)
+	assert.Equal(t, Filter{Categories: []string{"travel"}}, filter)
+	assert.NotContains(t, b.byCategory, "japan")
+	assert.Empty(t, b.byTag)
+
+	// Unsubscribing from everything keeps the session but follows nothing
+	filter, err = b.Unsubscribe(session, Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, Filter{Categories: []string{}}, filter)
+	assert.Empty(t, b.byCategory)
+	assert.NotContains(t, b.allCategories, session)
+
+	filter, err = b.Subscribe(session, Filter{})
+	assert.Nil(t, err)
+	assert.Nil(t, filter.Categories)
+	assert.Contains(t, b.allCategories, session)
+
+	_, err = b.Unsubscribe(session, Filter{Categories: []string{"japan"}})
+	assert.Equal(t, errAllCategories, err)
+
+	b.RemoveSubscriber(session)
+	_, err = b.Subscribe(session, Filter{})
+	assert.Equal(t, errSubscriberNotFound, err)
+}
+
+func TestBroker_Replay(t *testing.T) {
+	cursors := &mockCursorRepository{}
+	cursors.On("cursor", "test").Return(int64(1), nil)
+
+	missed := []Article{
+		{ID: 2, seq: 2, Title: "missed", Category: "japan"},
+		{ID: 3, seq: 3, Title: "other category", Category: "travel"},
+		{ID: 4, seq: 4, Title: "also live", Category: "japan"},
 	}
 
-	ch := b.AddSubscriber("test")
-	session, ok := b.subscribers["test"]
-	assert.True(t, ok)
-	assert.Equal(t, subscriberSession{channel: ch, balance: 0}, *session)
+	articles := &mockArticleRepository{}
+	// The first query is held until a live article shows up, to exercise
+	// the handoff between replayed and live articles.
+	live := make(chan struct{})
+	articles.On("articlesAfter", int64(1), replayBatchSize).
+		Run(func(mock.Arguments) { <-live }).
+		Return(missed, nil).Once()
+	articles.On("articlesAfter", int64(4), replayBatchSize).Return([]Article(nil), nil).Once()
+
+	b := newTestBroker()
+	b.cursors = cursors
+	b.articles = articles
+
+	session, err := b.AddSubscriber("test", Filter{Categories: []string{"japan"}})
+	assert.Nil(t, err)
+
+	// Already replayed, it must not be delivered twice
+	b.publish(missed[2])
+	b.publish(Article{ID: 5, seq: 5, Title: "live", Category: "japan"})
+	close(live)
+
+	ch := session.Articles()
+	assert.Equal(t, int64(2), (<-ch).ID)
+	assert.Equal(t, int64(4), (<-ch).ID)
+	assert.Equal(t, int64(5), (<-ch).ID)
+	assert.Empty(t, ch)
+
+	cursors.AssertExpectations(t)
+	articles.AssertExpectations(t)
+}
+
+func TestBroker_ReplayFailure(t *testing.T) {
+	cursors := &mockCursorRepository{}
+	cursors.On("cursor", "test").Return(int64(1), nil)
+
+	articles := &mockArticleRepository{}
+	live := make(chan struct{})
+	articles.On("articlesAfter", int64(1), replayBatchSize).
+		Run(func(mock.Arguments) { <-live }).
+		Return([]Article(nil), errors.New("connection refused")).Once()
+
+	b := newTestBroker()
+	b.cursors = cursors
+	b.articles = articles
+
+	session, err := b.AddSubscriber("test", Filter{})
+	assert.Nil(t, err)
+
+	// Sending it would skip the articles that couldn't be replayed
+	b.publish(Article{ID: 5, seq: 5, Title: "live", Category: "japan"})
+	close(live)
+
+	_, ok := <-session.Articles()
+	assert.False(t, ok)
+	code, _ := session.CloseReason()
+	assert.Equal(t, websocket.CloseTryAgainLater, code)
+
+	b.mut.Lock()
+	assert.False(t, b.registered(session))
+	b.mut.Unlock()
+
+	articles.AssertExpectations(t)
+}
+
+func TestBroker_Paywall(t *testing.T) {
+	accounts := &mockAccountRepository{}
+	accounts.On("open", "test").Return(nil)
+	accounts.On("plan", "test").Return(PlanFree, nil)
+	accounts.On("debit", "test", int64(1)).Return(true, nil).Once()
+	accounts.On("debit", "test", int64(2)).Return(false, nil).Once()
+
+	b := newTestBroker()
+	b.accounts = accounts
+
+	session, err := b.AddSubscriber("test", Filter{})
+	assert.Nil(t, err)
+
+	paid := Article{ID: 1, seq: 1, Title: "title", Body: "body", Category: "japan"}
+	b.publish(paid)
+	assert.Equal(t, paid, <-session.Articles())
+
+	b.publish(Article{ID: 2, seq: 2, Title: "title", Body: "body", Category: "japan"})
+	assert.Equal(t, Article{ID: 2, seq: 2, Title: "title", Body: paywallNotice, Category: "japan"}, <-session.Articles())
+
+	accounts.AssertExpectations(t)
+}
+
+func TestBroker_SlowDebit(t *testing.T) {
+	debiting := make(chan struct{})
+	release := make(chan struct{})
+	accounts := &mockAccountRepository{}
+	accounts.On("open", mock.Anything).Return(nil)
+	accounts.On("plan", mock.Anything).Return(PlanFree, nil)
+	accounts.On("debit", "slow", int64(1)).
+		Run(func(mock.Arguments) {
+			close(debiting)
+			<-release
+		}).
+		Return(true, nil).Once()
+
+	b := newTestBroker()
+	b.accounts = accounts
+
+	slow, err := b.AddSubscriber("slow", Filter{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		b.mut.Lock()
+		defer b.mut.Unlock()
+
+		return !slow.replaying
+	}, time.Second, time.Millisecond)
+
+	b.publish(Article{ID: 1, seq: 1, Body: "body", Category: "japan"})
+	<-debiting
+
+	// Other subscribers aren't held up while the slow session is charged
+	other, err := b.AddSubscriber("other", Filter{})
+	assert.Nil(t, err)
+	b.RemoveSubscriber(other)
 
-	b.RemoveSubscriber("test")
-	_, ok = b.subscribers["test"]
+	close(release)
+	assert.Equal(t, "body", (<-slow.Articles()).Body)
+	accounts.AssertExpectations(t)
+}
+
+func TestBroker_Stop(t *testing.T) {
+	b := newTestBroker()
+
+	s, err := b.AddSubscriber("test", Filter{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		b.mut.Lock()
+		defer b.mut.Unlock()
+
+		return !s.replaying
+	}, time.Second, time.Millisecond)
+
+	b.publish(Article{ID: 1, seq: 1, Category: "tech"})
+	b.Stop()
+
+	assert.Equal(t, int64(1), (<-s.Articles()).ID)
+	_, ok := <-s.Articles()
 	assert.False(t, ok)
+
+	code, _ := s.CloseReason()
+	assert.Equal(t, websocket.CloseGoingAway, code)
+
+	_, err = b.AddSubscriber("test", Filter{})
+	assert.Equal(t, errShuttingDown, err)
+
+	// Stopping twice is harmless
+	b.Stop()
+}
+
+func TestBroker_Backfill(t *testing.T) {
+	articles := &mockArticleRepository{}
+	articles.On("latestSeq").Return(int64(1), nil)
+	articles.On("articlesAfter", int64(0), replayBatchSize).Return([]Article(nil), nil)
+	articles.On("articlesAfter", int64(2), replayBatchSize).Return([]Article(nil), errors.New("connection refused")).Once()
+	articles.On("articlesAfter", int64(2), replayBatchSize).Return([]Article{{ID: 3, seq: 3}, {ID: 4, seq: 4}}, nil).Once()
+	articles.On("articlesAfter", int64(4), replayBatchSize).Return([]Article(nil), nil).Once()
+	articles.On("article", int64(2)).Return(Article{ID: 2, seq: 2}, nil)
+	articles.On("article", int64(4)).Return(Article{ID: 4, seq: 4}, nil)
+
+	notify := make(chan *pq.Notification)
+	b := newTestBroker()
+	b.articles = articles
+	b.notify = notify
+
+	s, err := b.AddSubscriber("test", Filter{})
+	assert.Nil(t, err)
+
+	b.Run()
+	notify <- &pq.Notification{Channel: "new_articles", Extra: "2"}
+	assert.Equal(t, int64(2), (<-s.Articles()).ID)
+
+	// Articles 3 and 4 were inserted while the listener was reconnecting,
+	// the first attempt to load them fails and is retried on the next
+	// notification.
+	b.health.event(pq.ListenerEventReconnected, nil)
+	notify <- nil
+	assert.Equal(t, ListenerBackfilling, b.Health().State)
+	notify <- &pq.Notification{Channel: "new_articles", Extra: "4"}
+
+	assert.Equal(t, int64(3), (<-s.Articles()).ID)
+	assert.Equal(t, int64(4), (<-s.Articles()).ID)
+
+	b.Stop()
+	_, ok := <-s.Articles()
+	assert.False(t, ok)
+
+	h := b.Health()
+	assert.Equal(t, ListenerConnected, h.State)
+	assert.Equal(t, 1, h.Reconnects)
+	assert.Equal(t, "connection refused", h.LastError)
+	assert.Equal(t, int64(4), h.LastSeq)
+	articles.AssertExpectations(t)
+}
+
+func TestBroker_PoisonNotification(t *testing.T) {
+	articles := &mockArticleRepository{}
+	articles.On("latestSeq").Return(int64(0), nil)
+	articles.On("articlesAfter", int64(0), replayBatchSize).Return([]Article(nil), nil)
+	articles.On("article", int64(3)).Return(Article{}, errArticleNotFound)
+	articles.On("article", int64(4)).Return(Article{ID: 4, seq: 4}, nil)
+
+	deadLetters := &mockDeadLetterRepository{}
+	deadLetters.On("store", "new_articles", `{"id": 1}`, errInvalidArticleID.Error()).Return(nil)
+	deadLetters.On("store", "new_articles", strings.Repeat("9", 40), mock.MatchedBy(func(reason string) bool {
+		return strings.HasPrefix(reason, errNotificationTooLarge.Error())
+	})).Return(nil)
+	deadLetters.On("store", "new_articles", "3", errArticleNotFound.Error()).Return(errors.New("connection refused"))
+	deadLetters.On("store", "articles", "4", errUnknownChannel.Error()).Return(nil)
+
+	notify := make(chan *pq.Notification)
+	b := newTestBroker()
+	b.articles = articles
+	b.deadLetters = deadLetters
+	b.notify = notify
+
+	s, err := b.AddSubscriber("test", Filter{})
+	assert.Nil(t, err)
+
+	b.Run()
+	notify <- &pq.Notification{Channel: "new_articles", Extra: `{"id": 1}`}
+	notify <- &pq.Notification{Channel: "new_articles", Extra: strings.Repeat("9", 40)}
+	notify <- &pq.Notification{Channel: "new_articles", Extra: "3"}
+	notify <- &pq.Notification{Channel: "articles", Extra: "4"}
+
+	// The loop survives and keeps delivering
+	notify <- &pq.Notification{Channel: "new_articles", Extra: "4"}
+	assert.Equal(t, int64(4), (<-s.Articles()).ID)
+
+	b.Stop()
+	deadLetters.AssertExpectations(t)
+}
+
+func TestBroker_Changes(t *testing.T) {
+	original := Article{ID: 1, seq: 1, Title: "title", Body: "body", Category: "japan"}
+	updated := Article{ID: 1, seq: 1, Title: "fixed title", Body: "body", Category: "japan"}
+
+	articles := &mockArticleRepository{}
+	articles.On("latestSeq").Return(int64(0), nil)
+	articles.On("articlesAfter", mock.Anything, replayBatchSize).Return([]Article(nil), nil)
+	articles.On("article", int64(1)).Return(original, nil).Once()
+	articles.On("article", int64(1)).Return(updated, nil).Once()
+	articles.On("retracted", int64(1)).Return(Article{ID: 1, seq: 1, Category: "japan"}, nil)
+
+	accounts := &mockAccountRepository{}
+	accounts.On("open", mock.Anything).Return(nil)
+	accounts.On("plan", mock.Anything).Return(PlanFree, nil)
+	accounts.On("debit", "paid", int64(1)).Return(true, nil)
+	accounts.On("debit", "unpaid", int64(1)).Return(false, nil)
+	accounts.On("paid", "paid", int64(1)).Return(true, nil)
+	accounts.On("paid", "unpaid", int64(1)).Return(false, nil)
+
+	notify := make(chan *pq.Notification)
+	b := newTestBroker()
+	b.articles = articles
+	b.accounts = accounts
+	b.notify = notify
+
+	paid, err := b.AddSubscriber("paid", Filter{})
+	assert.Nil(t, err)
+	unpaid, err := b.AddSubscriber("unpaid", Filter{Categories: []string{"japan"}})
+	assert.Nil(t, err)
+	travel, err := b.AddSubscriber("travel", Filter{Categories: []string{"travel"}})
+	assert.Nil(t, err)
+
+	b.Run()
+	notify <- &pq.Notification{Channel: "new_articles", Extra: "1"}
+	assert.Equal(t, original, <-paid.Articles())
+	assert.Equal(t, paywallNotice, (<-unpaid.Articles()).Body)
+
+	// Sessions that weren't sent the article aren't told about changes
+	late, err := b.AddSubscriber("late", Filter{})
+	assert.Nil(t, err)
+
+	notify <- &pq.Notification{Channel: "article_updated", Extra: "1"}
+	expected := updated
+	expected.Type = TypeArticleUpdated
+	assert.Equal(t, expected, <-paid.Articles())
+	expected.Body = paywallNotice
+	assert.Equal(t, expected, <-unpaid.Articles())
+
+	notify <- &pq.Notification{Channel: "article_retracted", Extra: "1"}
+	retraction := Article{ID: 1, seq: 1, Category: "japan", Type: TypeArticleRetracted}
+	assert.Equal(t, retraction, <-paid.Articles())
+	assert.Equal(t, retraction, <-unpaid.Articles())
+
+	b.Stop()
+	for _, s := range []*Session{travel, late} {
+		_, ok := <-s.Articles()
+		assert.False(t, ok)
+	}
+	accounts.AssertExpectations(t)
+}
+
+func TestApplyChange(t *testing.T) {
+	pending := []Article{{ID: 1, Title: "one"}, {ID: 2, Title: "two"}, {ID: 3, Title: "three"}}
+
+	pending = applyChange(pending, Article{ID: 2, Title: "fixed", Type: TypeArticleUpdated})
+	assert.Equal(t, []Article{{ID: 1, Title: "one"}, {ID: 2, Title: "fixed"}, {ID: 3, Title: "three"}}, pending)
+
+	pending = applyChange(pending, Article{ID: 1, Type: TypeArticleRetracted})
+	assert.Equal(t, []Article{{ID: 2, Title: "fixed"}, {ID: 3, Title: "three"}}, pending)
+}
+
+func TestParseNotification(t *testing.T) {
+	id, err := parseNotification(" 42\n")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), id)
+
+	for _, payload := range []string{"", "0", "-1", "abc", `{"id": 1}`, "99999999999999999999"} {
+		_, err := parseNotification(payload)
+		assert.ErrorIs(t, err, errInvalidArticleID, payload)
+	}
+
+	_, err = parseNotification(strings.Repeat(" ", maxNotificationSize+1))
+	assert.ErrorIs(t, err, errNotificationTooLarge)
+}
+
+func TestBroker_SlowConsumerDisconnect(t *testing.T) {
+	b := newTestBroker()
+	b.config.QueueSize = 1
+	b.config.Overflow = Disconnect
+
+	slow, err := b.AddSubscriber("slow", Filter{})
+	assert.Nil(t, err)
+	fast, err := b.AddSubscriber("fast", Filter{})
+	assert.Nil(t, err)
+
+	// The fast session keeps up, reading every article as it's published
+	for id := int64(1); id <= 3; id++ {
+		b.publish(Article{ID: id, seq: id, Title: "title", Category: "japan"})
+		assert.Equal(t, id, (<-fast.Articles()).ID)
+	}
+
+	// The slow one never read, so it's closed once its queue overflows
+	for range slow.Articles() {
+	}
+	code, reason := slow.CloseReason()
+	assert.Equal(t, websocket.ClosePolicyViolation, code)
+	assert.Equal(t, "Too slow reading articles", reason)
+
+	b.mut.Lock()
+	assert.False(t, b.registered(slow))
+	assert.True(t, b.registered(fast))
+	b.mut.Unlock()
+}
+
+func newTestBroker() *broker {
+	cursors := &mockCursorRepository{}
+	cursors.On("cursor", mock.Anything).Return(int64(0), nil).Maybe()
+
+	articles := &mockArticleRepository{}
+	articles.On("articlesAfter", mock.Anything, mock.Anything).Return([]Article(nil), nil).Maybe()
+
+	categories := &mockCategoryRepository{}
+	categories.On("categories").Return([]Category{}, nil).Maybe()
+
+	accounts := &mockAccountRepository{}
+	accounts.On("open", mock.Anything).Return(nil).Maybe()
+	accounts.On("plan", mock.Anything).Return(PlanFree, nil).Maybe()
+	accounts.On("debit", mock.Anything, mock.Anything).Return(true, nil).Maybe()
+
+	return &broker{
+		subscribers:   make(map[string]map[*Session]struct{}),
+		byCategory:    make(map[string]map[*Session]struct{}),
+		byTag:         make(map[string]map[*Session]struct{}),
+		allCategories: make(map[*Session]struct{}),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		cursors:       cursors,
+		articles:      articles,
+		categories:    categories,
+		accounts:      accounts,
+		config: BrokerConfig{
+			QueueSize: 10,
+			Overflow:  DropOldest,
+		},
+	}
+}
+
+type mockCursorRepository struct {
+	mock.Mock
+}
+
+func (m *mockCursorRepository) cursor(userID string) (int64, error) {
+	args := m.Called(userID)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockCursorRepository) saveCursor(userID string, articleID int64) error {
+	return m.Called(userID, articleID).Error(0)
+}
+
+type mockArticleRepository struct {
+	mock.Mock
+}
+
+func (m *mockArticleRepository) articlesAfter(id int64, limit int) ([]Article, error) {
+	args := m.Called(id, limit)
+	return args.Get(0).([]Article), args.Error(1)
+}
+
+func (m *mockArticleRepository) article(id int64) (Article, error) {
+	args := m.Called(id)
+	return args.Get(0).(Article), args.Error(1)
+}
+
+func (m *mockArticleRepository) retracted(id int64) (Article, error) {
+	args := m.Called(id)
+	return args.Get(0).(Article), args.Error(1)
+}
+
+func (m *mockArticleRepository) query(q articleQuery) ([]Article, error) {
+	args := m.Called(q)
+	return args.Get(0).([]Article), args.Error(1)
+}
+
+func (m *mockArticleRepository) search(q searchQuery) ([]SearchResult, error) {
+	args := m.Called(q)
+	return args.Get(0).([]SearchResult), args.Error(1)
+}
+
+func (m *mockArticleRepository) latestSeq() (int64, error) {
+	args := m.Called()
+	return args.Get(0).(int64), args.Error(1)
+}
+
+type mockCategoryRepository struct {
+	mock.Mock
+}
+
+func (m *mockCategoryRepository) categories() ([]Category, error) {
+	args := m.Called()
+	return args.Get(0).([]Category), args.Error(1)
+}
+
+func (m *mockCategoryRepository) saveCategory(c Category) error {
+	return m.Called(c).Error(0)
+}
+
+func (m *mockCategoryRepository) deleteCategory(slug string) error {
+	return m.Called(slug).Error(0)
+}
+
+type mockAccountRepository struct {
+	mock.Mock
+}
+
+func (m *mockAccountRepository) open(userID string) error {
+	return m.Called(userID).Error(0)
+}
+
+func (m *mockAccountRepository) debit(userID string, articleID int64) (bool, error) {
+	args := m.Called(userID, articleID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockAccountRepository) paid(userID string, articleID int64) (bool, error) {
+	args := m.Called(userID, articleID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockAccountRepository) plan(userID string) (string, error) {
+	args := m.Called(userID)
+	return args.String(0), args.Error(1)
+}
+
+func (m *mockAccountRepository) setPlan(userID string, plan string) error {
+	return m.Called(userID, plan).Error(0)
+}
+
+func (m *mockAccountRepository) credit(userID string, amount int, reason string) (int, error) {
+	args := m.Called(userID, amount, reason)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockAccountRepository) account(userID string) (Account, error) {
+	args := m.Called(userID)
+	return args.Get(0).(Account), args.Error(1)
+}
+
+type mockDeadLetterRepository struct {
+	mock.Mock
+}
+
+func (m *mockDeadLetterRepository) store(channel string, payload string, reason string) error {
+	args := m.Called(channel, payload, reason)
+	return args.Error(0)
 }
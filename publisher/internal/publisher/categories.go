@@ -0,0 +1,134 @@
+package publisher
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// categoryRequest is the body of PUT /categories/{slug}.
+type categoryRequest struct {
+	Name    string   `json:"name"`
+	Parent  string   `json:"parent"`
+	Aliases []string `json:"aliases"`
+}
+
+// slugPattern is the shape the categories table accepts slugs in.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// categories serves the category taxonomy:
+//
+//	GET    /categories         every category
+//	PUT    /categories/{slug}  creates a category or replaces its name, parent and aliases
+//	DELETE /categories/{slug}  removes a category no article or child uses
+//
+// Changing categories needs the admin token. The broker is notified of the
+// changes and subscriptions resolve against the new taxonomy from then on.
+func (s *Server) categories(w http.ResponseWriter, r *http.Request) {
+	slug := strings.Trim(strings.TrimPrefix(r.URL.Path, "/categories"), "/")
+	if slug == "" {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorPayload{Err: "Method not allowed"})
+			return
+		}
+		s.listCategories(w)
+		return
+	}
+	if strings.Contains(slug, "/") {
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Not found"})
+		return
+	}
+
+	if !s.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, errorPayload{Err: "Unauthorized"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		s.saveCategory(w, r, slug)
+	case http.MethodDelete:
+		s.deleteCategory(w, slug)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, errorPayload{Err: "Method not allowed"})
+	}
+}
+
+func (s *Server) listCategories(w http.ResponseWriter) {
+	categories, err := s.categoryRepo.categories()
+	if err != nil {
+		log.Println("error loading categories:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, categories)
+}
+
+func (s *Server) saveCategory(w http.ResponseWriter, r *http.Request, slug string) {
+	if !slugPattern.MatchString(slug) {
+		writeJSON(w, http.StatusBadRequest, errorPayload{Err: "Slugs are lower case letters and digits separated by single hyphens"})
+		return
+	}
+
+	var req categoryRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorPayload{Err: "Malformed category"})
+		return
+	}
+
+	c := Category{Slug: slug, Name: strings.Join(strings.Fields(req.Name), " "), Parent: categoryKey(req.Parent)}
+	if c.Name == "" {
+		writeJSON(w, http.StatusBadRequest, errorPayload{Err: "Name is required"})
+		return
+	}
+	seen := map[string]bool{slug: true}
+	for _, a := range req.Aliases {
+		a = categoryKey(a)
+		if a != "" && !seen[a] {
+			seen[a] = true
+			c.Aliases = append(c.Aliases, a)
+		}
+	}
+
+	err = s.categoryRepo.saveCategory(c)
+	switch {
+	case errors.Is(err, errParentNotFound):
+		writeJSON(w, http.StatusUnprocessableEntity, errorPayload{Err: "Parent category not found"})
+		return
+	case errors.Is(err, errCategoryCycle):
+		writeJSON(w, http.StatusUnprocessableEntity, errorPayload{Err: "Category can't be its own ancestor"})
+		return
+	case errors.Is(err, errAliasTaken):
+		writeJSON(w, http.StatusConflict, errorPayload{Err: "Alias used by another category"})
+		return
+	case err != nil:
+		log.Println("error saving category:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Server) deleteCategory(w http.ResponseWriter, slug string) {
+	err := s.categoryRepo.deleteCategory(slug)
+	switch {
+	case errors.Is(err, errCategoryNotFound):
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Category not found"})
+		return
+	case errors.Is(err, errCategoryInUse):
+		writeJSON(w, http.StatusConflict, errorPayload{Err: "Category has articles or children"})
+		return
+	case err != nil:
+		log.Println("error deleting category:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,74 @@
+package publisher
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Categories(t *testing.T) {
+	categories := &mockCategoryRepository{}
+	srv := NewServer(&mockBroker{}, nil, categories, nil, "secret")
+
+	categories.On("categories").Return([]Category{
+		{Slug: "asia", Name: "Asia"},
+		{Slug: "japan", Name: "Japan", Parent: "asia", Aliases: []string{"nippon"}},
+	}, nil)
+	categories.On("saveCategory", Category{Slug: "japan", Name: "Japan", Parent: "asia", Aliases: []string{"nippon"}}).Return(nil)
+	categories.On("saveCategory", Category{Slug: "kyoto", Name: "Kyoto", Parent: "nowhere"}).Return(errParentNotFound)
+	categories.On("saveCategory", Category{Slug: "asia", Name: "Asia", Parent: "japan"}).Return(errCategoryCycle)
+	categories.On("saveCategory", Category{Slug: "travel", Name: "Travel", Aliases: []string{"nippon"}}).Return(errAliasTaken)
+	categories.On("saveCategory", Category{Slug: "sports", Name: "Sports"}).Return(errors.New("connection refused"))
+	categories.On("deleteCategory", "travel").Return(nil)
+	categories.On("deleteCategory", "asia").Return(errCategoryInUse)
+	categories.On("deleteCategory", "sports").Return(errCategoryNotFound)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		status   int
+		expected string
+	}{
+		{"list", http.MethodGet, "/categories", "", "", http.StatusOK, `[{"slug":"asia","name":"Asia"},{"slug":"japan","name":"Japan","parent":"asia","aliases":["nippon"]}]`},
+		{"save", http.MethodPut, "/categories/japan", "secret", `{"name":" Japan ","parent":"Asia","aliases":["Nippon","nippon","japan",""]}`, http.StatusOK, `{"slug":"japan","name":"Japan","parent":"asia","aliases":["nippon"]}`},
+		{"unauthorized", http.MethodPut, "/categories/japan", "wrong", `{"name":"Japan"}`, http.StatusUnauthorized, `{"error":"Unauthorized"}`},
+		{"invalid slug", http.MethodPut, "/categories/Japan", "secret", `{"name":"Japan"}`, http.StatusBadRequest, `{"error":"Slugs are lower case letters and digits separated by single hyphens"}`},
+		{"no name", http.MethodPut, "/categories/japan", "secret", `{"name":" "}`, http.StatusBadRequest, `{"error":"Name is required"}`},
+		{"malformed", http.MethodPut, "/categories/japan", "secret", `{"name":`, http.StatusBadRequest, `{"error":"Malformed category"}`},
+		{"unknown parent", http.MethodPut, "/categories/kyoto", "secret", `{"name":"Kyoto","parent":"nowhere"}`, http.StatusUnprocessableEntity, `{"error":"Parent category not found"}`},
+		{"cycle", http.MethodPut, "/categories/asia", "secret", `{"name":"Asia","parent":"japan"}`, http.StatusUnprocessableEntity, `{"error":"Category can't be its own ancestor"}`},
+		{"alias taken", http.MethodPut, "/categories/travel", "secret", `{"name":"Travel","aliases":["nippon"]}`, http.StatusConflict, `{"error":"Alias used by another category"}`},
+		{"storage error", http.MethodPut, "/categories/sports", "secret", `{"name":"Sports"}`, http.StatusInternalServerError, `{"error":"Internal error"}`},
+		{"delete", http.MethodDelete, "/categories/travel", "secret", "", http.StatusNoContent, ""},
+		{"in use", http.MethodDelete, "/categories/asia", "secret", "", http.StatusConflict, `{"error":"Category has articles or children"}`},
+		{"not found", http.MethodDelete, "/categories/sports", "secret", "", http.StatusNotFound, `{"error":"Category not found"}`},
+		{"nested path", http.MethodGet, "/categories/asia/japan", "secret", "", http.StatusNotFound, `{"error":"Not found"}`},
+		{"wrong method", http.MethodPost, "/categories", "secret", "", http.StatusMethodNotAllowed, `{"error":"Method not allowed"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			srv.categories(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			if tt.expected == "" {
+				assert.Empty(t, w.Body.String())
+				return
+			}
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	categories.AssertExpectations(t)
+}
@@ -0,0 +1,60 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Control operations a subscriber can send over its websocket.
+const (
+	opSubscribe   = "subscribe"
+	opUnsubscribe = "unsubscribe"
+	opPing        = "ping"
+)
+
+type controlMessage struct {
+	Op         string   `json:"op"`
+	Categories []string `json:"categories"`
+	Tags       []string `json:"tags"`
+}
+
+// ackPayload acknowledges a control message. For subscription changes it
+// carries the categories and tags the subscriber now follows, All being
+// set when it follows every category.
+type ackPayload struct {
+	Ack        string   `json:"ack"`
+	Categories []string `json:"categories,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	All        bool     `json:"all,omitempty"`
+}
+
+// handleControl applies a control message sent by the subscriber and
+// returns the frame to reply with, either an ackPayload or an errorPayload.
+func (s *Server) handleControl(session *Session, data []byte) interface{} {
+	var msg controlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return errorPayload{Err: "Invalid control message"}
+	}
+
+	var (
+		filter Filter
+		err    error
+	)
+
+	switch msg.Op {
+	case opSubscribe:
+		filter, err = s.broker.Subscribe(session, Filter{Categories: msg.Categories, Tags: msg.Tags})
+	case opUnsubscribe:
+		filter, err = s.broker.Unsubscribe(session, Filter{Categories: msg.Categories, Tags: msg.Tags})
+	case opPing:
+		return ackPayload{Ack: opPing}
+	default:
+		return errorPayload{Err: fmt.Sprintf("Unknown operation %q", msg.Op)}
+	}
+
+	if err != nil {
+		return errorPayload{Err: err.Error()}
+	}
+
+	return ackPayload{Ack: msg.Op, Categories: filter.Categories, Tags: filter.Tags, All: filter.Categories == nil}
+}
@@ -0,0 +1,38 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_HandleControl(t *testing.T) {
+	broker := &mockBroker{}
+	srv := NewServer(broker, nil, nil, nil, "")
+
+	session := &Session{userID: "test"}
+	broker.On("Subscribe", session, Filter{}).Return(Filter{}, nil)
+	broker.On("Subscribe", session, Filter{Tags: []string{"batteries"}}).Return(Filter{Categories: []string{}, Tags: []string{"batteries"}}, nil)
+	broker.On("Unsubscribe", session, Filter{Categories: []string{"japan"}}).Return(Filter{}, errAllCategories)
+
+	tests := []struct {
+		name     string
+		message  string
+		expected interface{}
+	}{
+		{"ping", `{"op":"ping"}`, ackPayload{Ack: opPing}},
+		{"subscribe all", `{"op":"subscribe"}`, ackPayload{Ack: opSubscribe, All: true}},
+		{"subscribe tags", `{"op":"subscribe","tags":["batteries"]}`, ackPayload{Ack: opSubscribe, Categories: []string{}, Tags: []string{"batteries"}}},
+		{"broker error", `{"op":"unsubscribe","categories":["japan"]}`, errorPayload{Err: errAllCategories.Error()}},
+		{"unknown op", `{"op":"dance"}`, errorPayload{Err: `Unknown operation "dance"`}},
+		{"invalid json", `{"op":`, errorPayload{Err: "Invalid control message"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, srv.handleControl(session, []byte(tt.message)))
+		})
+	}
+
+	broker.AssertExpectations(t)
+}
@@ -0,0 +1,185 @@
+package publisher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPageSize and maxPageSize bound the articles listed at a time.
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type articlesPayload struct {
+	Articles []Article `json:"articles"`
+	// NextCursor lists the older articles when passed as the cursor
+	// parameter, it's empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// listArticles serves GET /articles, the published articles newest first.
+// They can be filtered by category, tag, author, and publication time with from
+// and to (RFC 3339), and paged through with limit and cursor.
+//
+// Reading is paid as in live delivery: a credit is taken for each article
+// the reader didn't pay for yet, and the body is replaced with a notice
+// once credits run out.
+func (s *Server) listArticles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorPayload{Err: "Method not allowed"})
+		return
+	}
+
+	userID, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseArticleQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorPayload{Err: err.Error()})
+		return
+	}
+
+	articles, err := s.articleRepo.query(q)
+	if err != nil {
+		log.Println("error querying articles:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	payload := articlesPayload{Articles: make([]Article, 0, len(articles))}
+	for _, a := range articles {
+		payload.Articles = append(payload.Articles, s.paywall(userID, a))
+	}
+	if len(articles) == q.limit {
+		payload.NextCursor = strconv.FormatInt(articles[len(articles)-1].seq, 10)
+	}
+
+	writeJSON(w, http.StatusOK, payload)
+}
+
+// getArticle serves GET /articles/{id}, paid like the articles listed.
+func (s *Server) getArticle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorPayload{Err: "Method not allowed"})
+		return
+	}
+
+	userID, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/articles/"), 10, 64)
+	if err != nil || id <= 0 {
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Article not found"})
+		return
+	}
+
+	article, err := s.articleRepo.article(id)
+	if errors.Is(err, errArticleNotFound) {
+		writeJSON(w, http.StatusNotFound, errorPayload{Err: "Article not found"})
+		return
+	}
+	if err != nil {
+		log.Println("error loading article:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.paywall(userID, article))
+}
+
+// reader returns the user reading articles, opening their account the
+// first time as subscribing does. It answers the request itself when it
+// reports false.
+func (s *Server) reader(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID := r.Header.Get("Y-User-ID")
+	if userID == "" {
+		writeJSON(w, http.StatusUnauthorized, errorPayload{Err: "User id not found"})
+		return "", false
+	}
+
+	err := s.accountRepo.open(userID)
+	if err != nil {
+		log.Println(fmt.Sprintf("error opening account of reader %s: %v", userID, err))
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return "", false
+	}
+
+	return userID, true
+}
+
+// paywall charges the user for the article, replacing its body when they
+// can't pay. Articles already paid for are free.
+func (s *Server) paywall(userID string, article Article) Article {
+	paid, err := s.accountRepo.debit(userID, article.ID)
+	if err != nil {
+		log.Println(fmt.Sprintf("error debiting account of reader %s: %v", userID, err))
+	}
+	if !paid {
+		article.Body = paywallNotice
+	}
+
+	return article
+}
+
+func parseArticleQuery(r *http.Request) (articleQuery, error) {
+	params := r.URL.Query()
+	q := articleQuery{
+		category: params.Get("category"),
+		tag:      params.Get("tag"),
+		author:   params.Get("author"),
+		limit:    defaultPageSize,
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return articleQuery{}, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.limit = n
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		seq, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || seq <= 0 {
+			return articleQuery{}, errors.New("invalid cursor")
+		}
+		q.before = seq
+	}
+
+	var err error
+	q.from, err = parseTime(params, "from")
+	if err != nil {
+		return articleQuery{}, err
+	}
+	q.to, err = parseTime(params, "to")
+	if err != nil {
+		return articleQuery{}, err
+	}
+
+	return q, nil
+}
+
+func parseTime(params url.Values, name string) (time.Time, error) {
+	value := params.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,96 @@
+package publisher
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_History(t *testing.T) {
+	publishedAt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	newest := Article{ID: 3, seq: 3, Title: "newest", Body: "body", Category: "japan", PublishedAt: publishedAt}
+	older := Article{ID: 1, seq: 1, Title: "older", Body: "body", Category: "japan", PublishedAt: publishedAt}
+
+	articles := &mockArticleRepository{}
+	articles.On("query", articleQuery{limit: 2}).Return([]Article{newest, older}, nil)
+	articles.On("query", articleQuery{before: 1, limit: 2}).Return([]Article(nil), nil)
+	articles.On("query", articleQuery{
+		category: "Japan",
+		tag:      "trains",
+		author:   "Alice",
+		from:     publishedAt,
+		to:       publishedAt.Add(time.Hour),
+		limit:    defaultPageSize,
+	}).Return([]Article{older}, nil)
+	articles.On("query", articleQuery{category: "failing", limit: defaultPageSize}).Return([]Article(nil), errors.New("connection refused"))
+	articles.On("article", int64(3)).Return(newest, nil)
+	articles.On("article", int64(2)).Return(Article{}, errArticleNotFound)
+
+	accounts := &mockAccountRepository{}
+	accounts.On("open", "testUserID").Return(nil)
+	accounts.On("debit", "testUserID", int64(3)).Return(true, nil)
+	accounts.On("debit", "testUserID", int64(1)).Return(false, nil)
+
+	srv := NewServer(&mockBroker{}, articles, nil, accounts, "")
+
+	tests := []struct {
+		name     string
+		path     string
+		userID   string
+		status   int
+		expected string
+	}{
+		{"page", "/articles?limit=2", "testUserID", http.StatusOK, `{"articles":[
+			{"id":3,"title":"newest","body":"body","category":"japan","published_at":"2020-01-01T12:00:00Z"},
+			{"id":1,"title":"older","body":"` + paywallNotice + `","category":"japan","published_at":"2020-01-01T12:00:00Z"}
+		],"next_cursor":"1"}`},
+		{"last page", "/articles?limit=2&cursor=1", "testUserID", http.StatusOK, `{"articles":[]}`},
+		{"filters", "/articles?category=Japan&tag=trains&author=Alice&from=2020-01-01T12:00:00Z&to=2020-01-01T13:00:00Z", "testUserID", http.StatusOK, `{"articles":[
+			{"id":1,"title":"older","body":"` + paywallNotice + `","category":"japan","published_at":"2020-01-01T12:00:00Z"}
+		]}`},
+		{"storage error", "/articles?category=failing", "testUserID", http.StatusInternalServerError, `{"error":"Internal error"}`},
+		{"invalid limit", "/articles?limit=1000", "testUserID", http.StatusBadRequest, `{"error":"limit must be between 1 and 100"}`},
+		{"invalid cursor", "/articles?cursor=abc", "testUserID", http.StatusBadRequest, `{"error":"invalid cursor"}`},
+		{"invalid time", "/articles?from=yesterday", "testUserID", http.StatusBadRequest, `{"error":"from must be an RFC 3339 time"}`},
+		{"no user", "/articles", "", http.StatusUnauthorized, `{"error":"User id not found"}`},
+		{"article", "/articles/3", "testUserID", http.StatusOK, `{"id":3,"title":"newest","body":"body","category":"japan","published_at":"2020-01-01T12:00:00Z"}`},
+		{"article not found", "/articles/2", "testUserID", http.StatusNotFound, `{"error":"Article not found"}`},
+		{"invalid id", "/articles/japan", "testUserID", http.StatusNotFound, `{"error":"Article not found"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Header.Set("Y-User-ID", tt.userID)
+			w := httptest.NewRecorder()
+
+			if r.URL.Path == "/articles" {
+				srv.listArticles(w, r)
+			} else {
+				srv.getArticle(w, r)
+			}
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	articles.AssertExpectations(t)
+	accounts.AssertExpectations(t)
+}
+
+func TestServer_HistoryMethodNotAllowed(t *testing.T) {
+	srv := NewServer(&mockBroker{}, &mockArticleRepository{}, nil, &mockAccountRepository{}, "")
+
+	w := httptest.NewRecorder()
+	srv.listArticles(w, httptest.NewRequest(http.MethodPost, "/articles", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	srv.getArticle(w, httptest.NewRequest(http.MethodDelete, "/articles/1", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,112 @@
+package publisher
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	ListenerConnecting   = "connecting"
+	ListenerConnected    = "connected"
+	ListenerDisconnected = "disconnected"
+	// ListenerBackfilling means the listener reconnected and the articles
+	// inserted meanwhile are still to be published.
+	ListenerBackfilling = "backfilling"
+)
+
+// ListenerHealth is the state of the connection notifying new articles.
+type ListenerHealth struct {
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastSeq    int64     `json:"last_seq"`
+}
+
+// Healthy tells whether articles are being delivered as they're published.
+func (h ListenerHealth) Healthy() bool {
+	return h.State == ListenerConnected
+}
+
+type listenerHealth struct {
+	mut    sync.Mutex
+	health ListenerHealth
+}
+
+// event tracks the pq.Listener connection events.
+func (l *listenerHealth) event(ev pq.ListenerEventType, err error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if err != nil {
+		log.Println("listener:", err)
+		l.health.LastError = err.Error()
+	}
+
+	switch ev {
+	case pq.ListenerEventConnected:
+		l.set(ListenerConnected)
+	case pq.ListenerEventReconnected:
+		l.health.Reconnects++
+		l.set(ListenerBackfilling)
+	case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+		l.set(ListenerDisconnected)
+	}
+}
+
+func (l *listenerHealth) backfillFailed(err error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.health.LastError = err.Error()
+}
+
+func (l *listenerHealth) backfilled() {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.health.State == ListenerBackfilling {
+		l.set(ListenerConnected)
+	}
+}
+
+func (l *listenerHealth) seen(seq int64) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.health.LastSeq = seq
+}
+
+func (l *listenerHealth) get() ListenerHealth {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	h := l.health
+	if h.State == "" {
+		h.State = ListenerConnecting
+	}
+
+	return h
+}
+
+func (l *listenerHealth) set(state string) {
+	if l.health.State != state {
+		l.health.State = state
+		l.health.Since = time.Now().UTC()
+	}
+}
+
+func newPostgresListener(dbConfig DbConfig, reportProblem pq.EventCallbackType) *pq.Listener {
+	listener := pq.NewListener(dbConfig.String(), 10*time.Second, time.Minute, reportProblem)
+	for _, channel := range []string{channelNewArticles, channelArticleUpdated, channelArticleRetracted, channelCategoriesChanged} {
+		err := listener.Listen(channel)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return listener
+}
@@ -0,0 +1,15 @@
+package publisher
+
+import "expvar"
+
+// metrics are published by expvar under /debug/vars.
+var metrics = expvar.NewMap("publisher")
+
+const (
+	metricDroppedOldest           = "dropped_oldest"
+	metricDroppedNewest           = "dropped_newest"
+	metricSlowConsumerDisconnects = "slow_consumer_disconnects"
+	metricListenerReconnects      = "listener_reconnects"
+	metricBackfilledArticles      = "backfilled_articles"
+	metricPoisonNotifications     = "poison_notifications"
+)
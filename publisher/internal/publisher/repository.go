@@ -0,0 +1,735 @@
+package publisher
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CursorRepository keeps the position of each user in the sequence of
+// published articles.
+type CursorRepository interface {
+	cursor(userID string) (int64, error)
+	saveCursor(userID string, seq int64) error
+}
+
+type cursorRepository struct {
+	db *sql.DB
+}
+
+func NewCursorRepository(db *sql.DB) CursorRepository {
+	return &cursorRepository{
+		db: db,
+	}
+}
+
+// cursor returns the sequence number of the last article delivered to the
+// user. Users seen for the first time start from the newest article, so
+// they aren't flooded with the whole history.
+func (r *cursorRepository) cursor(userID string) (int64, error) {
+	_, err := r.db.Exec(`
+		INSERT INTO subscriber_cursors (user_id, last_seq)
+		SELECT $1, COALESCE(MAX(seq), 0) FROM articles
+		ON CONFLICT (user_id) DO NOTHING`,
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var seq int64
+	err = r.db.QueryRow(`
+		SELECT last_seq FROM subscriber_cursors WHERE user_id = $1`,
+		userID,
+	).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func (r *cursorRepository) saveCursor(userID string, seq int64) error {
+	_, err := r.db.Exec(`
+		INSERT INTO subscriber_cursors (user_id, last_seq)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET last_seq = GREATEST(subscriber_cursors.last_seq, EXCLUDED.last_seq)`,
+		userID,
+		seq,
+	)
+
+	return err
+}
+
+type ArticleRepository interface {
+	articlesAfter(seq int64, limit int) ([]Article, error)
+	article(id int64) (Article, error)
+	retracted(id int64) (Article, error)
+	latestSeq() (int64, error)
+	query(q articleQuery) ([]Article, error)
+	search(q searchQuery) ([]SearchResult, error)
+}
+
+// articleQuery filters the published articles listed by the history API.
+// Zero values don't filter.
+type articleQuery struct {
+	// before pages through the articles, only those published before the
+	// one with this sequence number are listed.
+	before   int64
+	category string
+	tag      string
+	author   string
+	from     time.Time
+	to       time.Time
+	limit    int
+}
+
+type articleRepository struct {
+	db *sql.DB
+}
+
+func NewArticleRepository(db *sql.DB) ArticleRepository {
+	return &articleRepository{
+		db: db,
+	}
+}
+
+// articlesAfter returns up to limit articles published after the given
+// sequence number, in the order they were published. Retracted articles
+// are left out.
+func (r *articleRepository) articlesAfter(seq int64, limit int) ([]Article, error) {
+	rows, err := r.db.Query(`
+		SELECT a.id, a.seq, a.title, a.body, COALESCE(a.category, ''), a.published_at, COALESCE(j.name, ''),
+			(SELECT ARRAY_AGG(t.tag ORDER BY t.tag) FROM article_tags t WHERE t.article_id = a.id)
+		FROM articles a
+		LEFT JOIN journalists j ON j.id = a.author_id
+		WHERE a.seq > $1 AND a.status = 'published'
+		ORDER BY a.seq
+		LIMIT $2`,
+		seq,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var articles []Article
+	for rows.Next() {
+		var a Article
+		err := rows.Scan(&a.ID, &a.seq, &a.Title, &a.Body, &a.Category, &a.PublishedAt, &a.Author, pq.Array(&a.Tags))
+		if err != nil {
+			return nil, err
+		}
+		a.PublishedAt = a.PublishedAt.UTC()
+		articles = append(articles, a)
+	}
+
+	return articles, rows.Err()
+}
+
+// article returns the published article with the given id,
+// errArticleNotFound when there's none.
+func (r *articleRepository) article(id int64) (Article, error) {
+	var a Article
+	err := r.db.QueryRow(`
+		SELECT a.id, a.seq, a.title, a.body, COALESCE(a.category, ''), a.published_at, COALESCE(j.name, ''),
+			(SELECT ARRAY_AGG(t.tag ORDER BY t.tag) FROM article_tags t WHERE t.article_id = a.id)
+		FROM articles a
+		LEFT JOIN journalists j ON j.id = a.author_id
+		WHERE a.id = $1 AND a.status = 'published'`,
+		id,
+	).Scan(&a.ID, &a.seq, &a.Title, &a.Body, &a.Category, &a.PublishedAt, &a.Author, pq.Array(&a.Tags))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Article{}, errArticleNotFound
+	}
+	a.PublishedAt = a.PublishedAt.UTC()
+
+	return a, err
+}
+
+// retracted returns the id, sequence number, category and tags of the
+// retracted article with the given id, errArticleNotFound when there's
+// none.
+func (r *articleRepository) retracted(id int64) (Article, error) {
+	var a Article
+	err := r.db.QueryRow(`
+		SELECT
+			a.id,
+			a.seq,
+			COALESCE(a.category, ''),
+			(SELECT ARRAY_AGG(t.tag ORDER BY t.tag) FROM article_tags t WHERE t.article_id = a.id)
+		FROM articles a
+		WHERE a.id = $1 AND a.status = 'retracted' AND a.seq IS NOT NULL`,
+		id,
+	).Scan(&a.ID, &a.seq, &a.Category, pq.Array(&a.Tags))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Article{}, errArticleNotFound
+	}
+
+	return a, err
+}
+
+// query returns up to q.limit published articles matching q, newest first.
+// The category is matched by slug, name or alias regardless of case and
+// covers its children. The time range includes from but not to.
+func (r *articleRepository) query(q articleQuery) ([]Article, error) {
+	rows, err := r.db.Query(`
+		SELECT a.id, a.seq, a.title, a.body, COALESCE(a.category, ''), a.published_at, COALESCE(j.name, ''),
+			(SELECT ARRAY_AGG(t.tag ORDER BY t.tag) FROM article_tags t WHERE t.article_id = a.id)
+		FROM articles a
+		LEFT JOIN journalists j ON j.id = a.author_id
+		WHERE a.status = 'published'
+			AND ($1::bigint = 0 OR a.seq < $1)
+			AND ($2 = '' OR a.category IN (
+				WITH RECURSIVE tree (slug) AS (
+					SELECT slug FROM categories
+					WHERE slug = $2 OR LOWER(name) = $2
+						OR slug IN (SELECT slug FROM category_aliases WHERE alias = $2)
+					UNION
+					SELECT c.slug FROM categories c JOIN tree t ON c.parent = t.slug
+				)
+				SELECT slug FROM tree
+			))
+			AND ($3 = '' OR j.name = $3)
+			AND ($4::timestamptz IS NULL OR a.published_at >= $4)
+			AND ($5::timestamptz IS NULL OR a.published_at < $5)
+			AND ($7 = '' OR EXISTS (SELECT 1 FROM article_tags t WHERE t.article_id = a.id AND t.tag = $7))
+		ORDER BY a.seq DESC
+		LIMIT $6`,
+		q.before,
+		categoryKey(q.category),
+		q.author,
+		sql.NullTime{Time: q.from, Valid: !q.from.IsZero()},
+		sql.NullTime{Time: q.to, Valid: !q.to.IsZero()},
+		q.limit,
+		tagKey(q.tag),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var articles []Article
+	for rows.Next() {
+		var a Article
+		err := rows.Scan(&a.ID, &a.seq, &a.Title, &a.Body, &a.Category, &a.PublishedAt, &a.Author, pq.Array(&a.Tags))
+		if err != nil {
+			return nil, err
+		}
+		a.PublishedAt = a.PublishedAt.UTC()
+		articles = append(articles, a)
+	}
+
+	return articles, rows.Err()
+}
+
+// SearchResult is a published article matching a search. The body is left
+// out, Snippet holds the fragments of it matching the search with the
+// words found wrapped in <mark> tags. Articles the reader hasn't paid for
+// get a single short fragment, so searching doesn't give them away.
+type SearchResult struct {
+	ID          int64     `json:"id"`
+	Title       string    `json:"title"`
+	Category    string    `json:"category"`
+	PublishedAt time.Time `json:"published_at"`
+	Author      string    `json:"author,omitempty"`
+	Rank        float64   `json:"rank"`
+	Snippet     string    `json:"snippet"`
+}
+
+// searchQuery is a web search like query, see websearch_to_tsquery, over
+// the articles in any of categories or their children, or in all of them
+// when empty. Snippets depend on what reader paid for.
+type searchQuery struct {
+	reader     string
+	text       string
+	categories []string
+	limit      int
+	offset     int
+}
+
+// search returns the published articles matching q, best matches first.
+func (r *articleRepository) search(q searchQuery) ([]SearchResult, error) {
+	categories := make([]string, 0, len(q.categories))
+	for _, c := range q.categories {
+		categories = append(categories, categoryKey(c))
+	}
+
+	rows, err := r.db.Query(`
+		SELECT
+			a.id,
+			a.title,
+			COALESCE(a.category, ''),
+			a.published_at,
+			COALESCE(j.name, ''),
+			ts_rank(a.search, q) AS rank,
+			CASE WHEN EXISTS (SELECT 1 FROM account_ledger l WHERE l.user_id = $5 AND l.article_id = a.id)
+				THEN ts_headline('english', COALESCE(a.body, ''), q, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MinWords=5, MaxWords=20')
+				ELSE ts_headline('english', COALESCE(a.body, ''), q, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=1, MinWords=3, MaxWords=8')
+			END
+		FROM articles a
+		LEFT JOIN journalists j ON j.id = a.author_id
+		CROSS JOIN websearch_to_tsquery('english', $1) q
+		WHERE a.status = 'published'
+			AND a.search @@ q
+			AND (CARDINALITY($2::text[]) = 0 OR a.category IN (
+				WITH RECURSIVE tree (slug) AS (
+					SELECT slug FROM categories
+					WHERE slug = ANY($2) OR LOWER(name) = ANY($2)
+						OR slug IN (SELECT slug FROM category_aliases WHERE alias = ANY($2))
+					UNION
+					SELECT c.slug FROM categories c JOIN tree t ON c.parent = t.slug
+				)
+				SELECT slug FROM tree
+			))
+		ORDER BY rank DESC, a.seq DESC
+		LIMIT $3 OFFSET $4`,
+		q.text,
+		pq.Array(categories),
+		q.limit,
+		q.offset,
+		q.reader,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var res SearchResult
+		err := rows.Scan(&res.ID, &res.Title, &res.Category, &res.PublishedAt, &res.Author, &res.Rank, &res.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		res.PublishedAt = res.PublishedAt.UTC()
+		results = append(results, res)
+	}
+
+	return results, rows.Err()
+}
+
+// latestSeq returns the sequence number of the last article published, 0
+// when there are none.
+func (r *articleRepository) latestSeq() (int64, error) {
+	var seq int64
+	err := r.db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM articles`).Scan(&seq)
+
+	return seq, err
+}
+
+var errArticleNotFound = errors.New("article not found")
+
+var (
+	errAccountNotFound     = errors.New("account not found")
+	errInsufficientBalance = errors.New("insufficient balance")
+)
+
+// Plans available to subscribers. Premium users may connect from several
+// devices at once.
+const (
+	PlanFree    = "free"
+	PlanPremium = "premium"
+)
+
+type Account struct {
+	UserID  string        `json:"user_id"`
+	Plan    string        `json:"plan"`
+	Balance int           `json:"balance"`
+	Ledger  []LedgerEntry `json:"ledger"`
+}
+
+// LedgerEntry records a change of an account balance. ArticleID is set for
+// the credits spent reading articles.
+type LedgerEntry struct {
+	ID        int64     `json:"id"`
+	Amount    int       `json:"amount"`
+	Balance   int       `json:"balance"`
+	Reason    string    `json:"reason"`
+	ArticleID int64     `json:"article_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ledgerSize is the number of recent ledger entries returned with an
+// account.
+const ledgerSize = 20
+
+type AccountRepository interface {
+	open(userID string) error
+	debit(userID string, articleID int64) (bool, error)
+	paid(userID string, articleID int64) (bool, error)
+	plan(userID string) (string, error)
+	setPlan(userID string, plan string) error
+	credit(userID string, amount int, reason string) (int, error)
+	account(userID string) (Account, error)
+}
+
+type accountRepository struct {
+	db             *sql.DB
+	initialBalance int
+}
+
+// NewAccountRepository returns a repository of subscriber credit balances.
+// Accounts are opened with initialBalance credits the first time a user
+// subscribes. Every balance change is recorded in the account ledger by
+// the same statement that applies it.
+func NewAccountRepository(db *sql.DB, initialBalance int) AccountRepository {
+	return &accountRepository{
+		db:             db,
+		initialBalance: initialBalance,
+	}
+}
+
+func (r *accountRepository) open(userID string) error {
+	_, err := r.db.Exec(`
+		WITH opened AS (
+			INSERT INTO accounts (user_id, balance)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id) DO NOTHING
+			RETURNING user_id, balance
+		)
+		INSERT INTO account_ledger (user_id, amount, balance, reason)
+		SELECT user_id, balance, balance, 'initial credits' FROM opened`,
+		userID,
+		r.initialBalance,
+	)
+
+	return err
+}
+
+// debit takes a credit from the user's balance for a full article. Users
+// pay once per article, so it reports true without charging again when the
+// article was already paid, and false when there are no credits left. The
+// account is locked first, so concurrent debits of the same article see
+// each other's ledger entry.
+func (r *accountRepository) debit(userID string, articleID int64) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT 1 FROM accounts WHERE user_id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	var paid bool
+	err = tx.QueryRow(`
+		WITH already_paid AS (
+			SELECT 1 FROM account_ledger WHERE user_id = $1 AND article_id = $2::bigint
+		), debited AS (
+			UPDATE accounts
+			SET balance = balance - 1
+			WHERE user_id = $1 AND balance > 0 AND NOT EXISTS (SELECT 1 FROM already_paid)
+			RETURNING user_id, balance
+		), recorded AS (
+			INSERT INTO account_ledger (user_id, amount, balance, reason, article_id)
+			SELECT user_id, -1, balance, 'article read', $2::bigint FROM debited
+			RETURNING 1
+		)
+		SELECT EXISTS (SELECT 1 FROM already_paid) OR EXISTS (SELECT 1 FROM recorded)`,
+		userID,
+		articleID,
+	).Scan(&paid)
+	if err != nil {
+		return false, err
+	}
+
+	return paid, tx.Commit()
+}
+
+// paid tells whether the user paid for the article, without charging.
+func (r *accountRepository) paid(userID string, articleID int64) (bool, error) {
+	var paid bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM account_ledger WHERE user_id = $1 AND article_id = $2)`,
+		userID,
+		articleID,
+	).Scan(&paid)
+
+	return paid, err
+}
+
+func (r *accountRepository) plan(userID string) (string, error) {
+	var plan string
+	err := r.db.QueryRow(`
+		SELECT plan FROM accounts WHERE user_id = $1`,
+		userID,
+	).Scan(&plan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errAccountNotFound
+	}
+
+	return plan, err
+}
+
+func (r *accountRepository) setPlan(userID string, plan string) error {
+	res, err := r.db.Exec(`
+		UPDATE accounts SET plan = $2 WHERE user_id = $1`,
+		userID,
+		plan,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errAccountNotFound
+	}
+
+	return nil
+}
+
+// credit adds amount credits to the user's balance, or takes them when
+// negative, and returns the new balance.
+func (r *accountRepository) credit(userID string, amount int, reason string) (int, error) {
+	var balance int
+	err := r.db.QueryRow(`
+		WITH credited AS (
+			UPDATE accounts
+			SET balance = balance + $2::integer
+			WHERE user_id = $1
+			RETURNING user_id, balance
+		)
+		INSERT INTO account_ledger (user_id, amount, balance, reason)
+		SELECT user_id, $2::integer, balance, $3::text FROM credited
+		RETURNING balance`,
+		userID,
+		amount,
+		reason,
+	).Scan(&balance)
+
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, errAccountNotFound
+	case errors.As(err, &pqErr) && pqErr.Code.Name() == "check_violation":
+		return 0, errInsufficientBalance
+	case err != nil:
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+func (r *accountRepository) account(userID string) (Account, error) {
+	a := Account{UserID: userID, Ledger: []LedgerEntry{}}
+	err := r.db.QueryRow(`
+		SELECT plan, balance FROM accounts WHERE user_id = $1`,
+		userID,
+	).Scan(&a.Plan, &a.Balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Account{}, errAccountNotFound
+	}
+	if err != nil {
+		return Account{}, err
+	}
+
+	rows, err := r.db.Query(`
+		SELECT id, amount, balance, reason, article_id, created_at
+		FROM account_ledger
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2`,
+		userID,
+		ledgerSize,
+	)
+	if err != nil {
+		return Account{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			e         LedgerEntry
+			articleID sql.NullInt64
+		)
+		err := rows.Scan(&e.ID, &e.Amount, &e.Balance, &e.Reason, &articleID, &e.CreatedAt)
+		if err != nil {
+			return Account{}, err
+		}
+		e.ArticleID = articleID.Int64
+		e.CreatedAt = e.CreatedAt.UTC()
+		a.Ledger = append(a.Ledger, e)
+	}
+
+	return a, rows.Err()
+}
+
+type DeadLetterRepository interface {
+	store(channel string, payload string, reason string) error
+}
+
+type deadLetterRepository struct {
+	db *sql.DB
+}
+
+// NewDeadLetterRepository returns a repository keeping the notifications
+// the broker couldn't process.
+func NewDeadLetterRepository(db *sql.DB) DeadLetterRepository {
+	return &deadLetterRepository{
+		db: db,
+	}
+}
+
+func (r *deadLetterRepository) store(channel string, payload string, reason string) error {
+	_, err := r.db.Exec(`
+		INSERT INTO dead_letters (channel, payload, error)
+		VALUES ($1, $2, $3)`,
+		channel,
+		payload,
+		reason,
+	)
+
+	return err
+}
+
+// Category is a node of the category taxonomy. Articles are filed under
+// slugs, journalists may also use the name or one of the aliases.
+type Category struct {
+	Slug    string   `json:"slug"`
+	Name    string   `json:"name"`
+	Parent  string   `json:"parent,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+var (
+	errCategoryNotFound = errors.New("category not found")
+	errParentNotFound   = errors.New("parent category not found")
+	errCategoryCycle    = errors.New("category can't be its own ancestor")
+	errAliasTaken       = errors.New("alias used by another category")
+	errCategoryInUse    = errors.New("category has articles or children")
+)
+
+type CategoryRepository interface {
+	categories() ([]Category, error)
+	saveCategory(c Category) error
+	deleteCategory(slug string) error
+}
+
+type categoryRepository struct {
+	db *sql.DB
+}
+
+// NewCategoryRepository returns the repository of the category taxonomy.
+// Changes are notified on the categories_changed channel.
+func NewCategoryRepository(db *sql.DB) CategoryRepository {
+	return &categoryRepository{
+		db: db,
+	}
+}
+
+// categories returns every category sorted by slug.
+func (r *categoryRepository) categories() ([]Category, error) {
+	rows, err := r.db.Query(`
+		SELECT
+			c.slug,
+			c.name,
+			COALESCE(c.parent, ''),
+			COALESCE(ARRAY_AGG(a.alias ORDER BY a.alias) FILTER (WHERE a.alias IS NOT NULL), '{}')
+		FROM categories c
+		LEFT JOIN category_aliases a ON a.slug = c.slug
+		GROUP BY c.slug
+		ORDER BY c.slug`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		var c Category
+		err := rows.Scan(&c.Slug, &c.Name, &c.Parent, pq.Array(&c.Aliases))
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Aliases) == 0 {
+			c.Aliases = nil
+		}
+		categories = append(categories, c)
+	}
+
+	return categories, rows.Err()
+}
+
+// saveCategory creates the category or replaces its name, parent and
+// aliases. It fails with errParentNotFound, errCategoryCycle or
+// errAliasTaken.
+func (r *categoryRepository) saveCategory(c Category) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO categories (slug, name, parent)
+		VALUES ($1, $2, NULLIF($3, ''))
+		ON CONFLICT (slug) DO UPDATE SET name = EXCLUDED.name, parent = EXCLUDED.parent`,
+		c.Slug,
+		c.Name,
+		c.Parent,
+	)
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation":
+		return errParentNotFound
+	case errors.As(err, &pqErr) && pqErr.Code.Name() == "check_violation":
+		return errCategoryCycle
+	case err != nil:
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM category_aliases WHERE slug = $1`, c.Slug)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO category_aliases (alias, slug)
+		SELECT UNNEST($2::text[]), $1`,
+		c.Slug,
+		pq.Array(c.Aliases),
+	)
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+		return errAliasTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteCategory removes the category and its aliases. It fails with
+// errCategoryInUse while articles or other categories refer to it.
+func (r *categoryRepository) deleteCategory(slug string) error {
+	res, err := r.db.Exec(`DELETE FROM categories WHERE slug = $1`, slug)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+		return errCategoryInUse
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errCategoryNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,403 @@
+package publisher
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorRepository(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewCursorRepository(h.db)
+
+	latest := h.seq(t, h.insertArticle(t, "before first connection"))
+
+	// New users start from the newest article
+	cursor, err := repo.cursor("testUserID")
+	assert.Nil(t, err)
+	assert.Equal(t, latest, cursor)
+
+	err = repo.saveCursor("testUserID", latest+2)
+	assert.Nil(t, err)
+
+	// Cursors never move backwards
+	err = repo.saveCursor("testUserID", latest+1)
+	assert.Nil(t, err)
+
+	cursor, err = repo.cursor("testUserID")
+	assert.Nil(t, err)
+	assert.Equal(t, latest+2, cursor)
+}
+
+func TestArticleRepository_ArticlesAfter(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewArticleRepository(h.db)
+
+	first := h.insertArticle(t, "first")
+	second := h.insertArticle(t, "second")
+	third := h.insertArticle(t, "third")
+	h.tag(t, second, "trains", "food")
+
+	articles, err := repo.articlesAfter(h.seq(t, first), 1)
+	assert.Nil(t, err)
+	assert.Len(t, articles, 1)
+	assert.Equal(t, second, articles[0].ID)
+	assert.Equal(t, "second", articles[0].Title)
+	assert.Equal(t, []string{"food", "trains"}, articles[0].Tags)
+
+	articles, err = repo.articlesAfter(h.seq(t, second), 10)
+	assert.Nil(t, err)
+	assert.Len(t, articles, 1)
+	assert.Equal(t, third, articles[0].ID)
+	assert.Nil(t, articles[0].Tags)
+
+	latest, err := repo.latestSeq()
+	assert.Nil(t, err)
+	assert.Equal(t, h.seq(t, third), latest)
+
+	var authorID int64
+	err = h.db.QueryRow(`INSERT INTO journalists (name, token_hash) VALUES ('Alice', 'hash') RETURNING id`).Scan(&authorID)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`UPDATE articles SET author_id = $1 WHERE id = $2`, authorID, second)
+	assert.Nil(t, err)
+
+	article, err := repo.article(second)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", article.Title)
+	assert.Equal(t, "Alice", article.Author)
+	assert.Equal(t, []string{"food", "trains"}, article.Tags)
+
+	_, err = repo.article(third + 1)
+	assert.Equal(t, errArticleNotFound, err)
+}
+
+func TestArticleRepository_Retracted(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewArticleRepository(h.db)
+
+	first := h.insertArticle(t, "first")
+	retracted := h.insertArticle(t, "retracted")
+	h.tag(t, retracted, "trains")
+
+	_, err := repo.retracted(retracted)
+	assert.Equal(t, errArticleNotFound, err)
+
+	_, err = h.db.Exec(`UPDATE articles SET status = 'retracted' WHERE id = $1`, retracted)
+	assert.Nil(t, err)
+
+	article, err := repo.retracted(retracted)
+	assert.Nil(t, err)
+	assert.Equal(t, Article{ID: retracted, seq: h.seq(t, retracted), Category: "travel", Tags: []string{"trains"}}, article)
+
+	_, err = repo.article(retracted)
+	assert.Equal(t, errArticleNotFound, err)
+
+	// Retracted articles aren't replayed
+	articles, err := repo.articlesAfter(h.seq(t, first), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, articles)
+}
+
+func TestArticleRepository_Query(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewArticleRepository(h.db)
+
+	first := h.insertArticle(t, "first")
+	second := h.insertArticle(t, "second")
+	third := h.insertArticle(t, "third")
+	retracted := h.insertArticle(t, "retracted")
+
+	var authorID int64
+	err := h.db.QueryRow(`INSERT INTO journalists (name, token_hash) VALUES ('Alice', 'hash') RETURNING id`).Scan(&authorID)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`UPDATE articles SET author_id = $1, category = 'japan' WHERE id = $2`, authorID, second)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`INSERT INTO categories (slug, name, parent) VALUES ('tokyo', 'Tokyo', 'japan')`)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`UPDATE articles SET category = 'tokyo' WHERE id = $1`, third)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`UPDATE articles SET published_at = '2020-01-01T12:00:00Z' WHERE id = $1`, first)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`UPDATE articles SET status = 'retracted' WHERE id = $1`, retracted)
+	assert.Nil(t, err)
+
+	ids := func(articles []Article) []int64 {
+		var ids []int64
+		for _, a := range articles {
+			ids = append(ids, a.ID)
+		}
+		return ids
+	}
+
+	articles, err := repo.query(articleQuery{limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{third, second}, ids(articles))
+
+	articles, err = repo.query(articleQuery{before: articles[1].seq, limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{first}, ids(articles))
+
+	articles, err = repo.query(articleQuery{category: "japan", author: "Alice", limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{second}, ids(articles))
+	assert.Equal(t, "Alice", articles[0].Author)
+
+	// Categories cover their children and match by name
+	articles, err = repo.query(articleQuery{category: " Japan", limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{third, second}, ids(articles))
+
+	h.tag(t, first, "trains")
+	h.tag(t, third, "trains", "food")
+	h.tag(t, retracted, "trains")
+	articles, err = repo.query(articleQuery{tag: "Trains", limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{third, first}, ids(articles))
+	assert.Equal(t, []string{"food", "trains"}, articles[0].Tags)
+
+	articles, err = repo.query(articleQuery{
+		from:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		to:    time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		limit: 10,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{first}, ids(articles))
+}
+
+func TestArticleRepository_Search(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewArticleRepository(h.db)
+
+	inBody := h.insertArticle(t, "Toyota breakthrough")
+	inTitle := h.insertArticle(t, "New batteries for electric cars")
+	unrelated := h.insertArticle(t, "Best season to visit Japan")
+	retracted := h.insertArticle(t, "Batteries recalled")
+
+	_, err := h.db.Exec(`UPDATE articles SET body = 'Solid state batteries charging in minutes', category = 'technology' WHERE id = $1`, inBody)
+	assert.Nil(t, err)
+	_, err = h.db.Exec(`UPDATE articles SET status = 'retracted' WHERE id = $1`, retracted)
+	assert.Nil(t, err)
+
+	results, err := repo.search(searchQuery{text: "battery", limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	// Titles rank above bodies
+	assert.Equal(t, inTitle, results[0].ID)
+	assert.Equal(t, inBody, results[1].ID)
+	assert.Greater(t, results[0].Rank, results[1].Rank)
+	assert.Contains(t, results[1].Snippet, "<mark>batteries</mark>")
+
+	results, err = repo.search(searchQuery{text: "battery", categories: []string{"tech"}, limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, inBody, results[0].ID)
+
+	results, err = repo.search(searchQuery{text: "battery", limit: 10, offset: 1})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+
+	results, err = repo.search(searchQuery{text: "japan -season", limit: 10})
+	assert.Nil(t, err)
+	assert.Empty(t, results)
+
+	results, err = repo.search(searchQuery{text: "season", limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, unrelated, results[0].ID)
+
+	// Articles not paid for only show a few words of their body
+	_, err = h.db.Exec(`
+		UPDATE articles
+		SET body = 'Engineers in Nagoya spent a decade on the chemistry. The new batteries charge in minutes, last twice as long and cost less to build than any cell sold today.'
+		WHERE id = $1`,
+		inBody,
+	)
+	assert.Nil(t, err)
+	accounts := NewAccountRepository(h.db, 10)
+	assert.Nil(t, accounts.open("reader"))
+
+	results, err = repo.search(searchQuery{reader: "reader", text: "batteries", categories: []string{"technology"}, limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Contains(t, results[0].Snippet, "<mark>batteries</mark>")
+	assert.LessOrEqual(t, len(strings.Fields(results[0].Snippet)), 8)
+
+	paid, err := accounts.debit("reader", inBody)
+	assert.Nil(t, err)
+	assert.True(t, paid)
+	results, err = repo.search(searchQuery{reader: "reader", text: "batteries", categories: []string{"technology"}, limit: 10})
+	assert.Nil(t, err)
+	assert.Greater(t, len(strings.Fields(results[0].Snippet)), 8)
+}
+
+func TestCategoryRepository(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewCategoryRepository(h.db)
+
+	asia := Category{Slug: "asia", Name: "Asia"}
+	err := repo.saveCategory(asia)
+	assert.Nil(t, err)
+	korea := Category{Slug: "korea", Name: "Korea", Parent: "asia", Aliases: []string{"hanguk", "south-korea"}}
+	err = repo.saveCategory(korea)
+	assert.Nil(t, err)
+
+	// Saving again replaces the aliases
+	korea.Aliases = []string{"hanguk"}
+	err = repo.saveCategory(korea)
+	assert.Nil(t, err)
+
+	categories, err := repo.categories()
+	assert.Nil(t, err)
+	assert.Contains(t, categories, asia)
+	assert.Contains(t, categories, korea)
+	assert.Contains(t, categories, Category{Slug: "technology", Name: "Technology", Aliases: []string{"tech"}})
+
+	err = repo.saveCategory(Category{Slug: "seoul", Name: "Seoul", Parent: "nowhere"})
+	assert.Equal(t, errParentNotFound, err)
+	err = repo.saveCategory(Category{Slug: "asia", Name: "Asia", Parent: "korea"})
+	assert.Equal(t, errCategoryCycle, err)
+	err = repo.saveCategory(Category{Slug: "seoul", Name: "Seoul", Aliases: []string{"hanguk"}})
+	assert.Equal(t, errAliasTaken, err)
+
+	err = repo.deleteCategory("asia")
+	assert.Equal(t, errCategoryInUse, err)
+	_, err = h.db.Exec(`UPDATE articles SET category = 'korea' WHERE id = $1`, h.insertArticle(t, "title"))
+	assert.Nil(t, err)
+	err = repo.deleteCategory("korea")
+	assert.Equal(t, errCategoryInUse, err)
+
+	_, err = h.db.Exec(`DELETE FROM articles`)
+	assert.Nil(t, err)
+	err = repo.deleteCategory("korea")
+	assert.Nil(t, err)
+	err = repo.deleteCategory("korea")
+	assert.Equal(t, errCategoryNotFound, err)
+}
+
+func TestDeadLetterRepository(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewDeadLetterRepository(h.db)
+
+	err := repo.store("new_articles", "not an id", errInvalidArticleID.Error())
+	assert.Nil(t, err)
+
+	var payload, reason string
+	err = h.db.QueryRow("SELECT payload, error FROM dead_letters").Scan(&payload, &reason)
+	assert.Nil(t, err)
+	assert.Equal(t, "not an id", payload)
+	assert.Equal(t, errInvalidArticleID.Error(), reason)
+}
+
+func TestAccountRepository(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewAccountRepository(h.db, 1)
+
+	err := repo.open("testUserID")
+	assert.Nil(t, err)
+
+	paid, err := repo.debit("testUserID", 1)
+	assert.Nil(t, err)
+	assert.True(t, paid)
+
+	// Opening an existing account keeps its balance
+	err = repo.open("testUserID")
+	assert.Nil(t, err)
+
+	paid, err = repo.debit("testUserID", 2)
+	assert.Nil(t, err)
+	assert.False(t, paid)
+
+	paid, err = repo.debit("unknownUserID", 2)
+	assert.Nil(t, err)
+	assert.False(t, paid)
+
+	balance, err := repo.credit("testUserID", 5, "top up")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, balance)
+
+	_, err = repo.credit("testUserID", -6, "refund")
+	assert.Equal(t, errInsufficientBalance, err)
+
+	_, err = repo.credit("unknownUserID", 5, "top up")
+	assert.Equal(t, errAccountNotFound, err)
+
+	account, err := repo.account("testUserID")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, account.Balance)
+
+	// Newest first: top up, article read and initial credits
+	assert.Len(t, account.Ledger, 3)
+	assert.Equal(t, 5, account.Ledger[0].Amount)
+	assert.Equal(t, "top up", account.Ledger[0].Reason)
+	assert.Equal(t, -1, account.Ledger[1].Amount)
+	assert.Equal(t, int64(1), account.Ledger[1].ArticleID)
+	assert.Equal(t, 0, account.Ledger[1].Balance)
+	assert.Equal(t, 1, account.Ledger[2].Amount)
+
+	// Articles already paid aren't charged again
+	paid, err = repo.debit("testUserID", 1)
+	assert.Nil(t, err)
+	assert.True(t, paid)
+
+	paid, err = repo.paid("testUserID", 1)
+	assert.Nil(t, err)
+	assert.True(t, paid)
+
+	paid, err = repo.paid("testUserID", 2)
+	assert.Nil(t, err)
+	assert.False(t, paid)
+
+	plan, err := repo.plan("testUserID")
+	assert.Nil(t, err)
+	assert.Equal(t, PlanFree, plan)
+
+	err = repo.setPlan("testUserID", PlanPremium)
+	assert.Nil(t, err)
+
+	account, err = repo.account("testUserID")
+	assert.Nil(t, err)
+	assert.Equal(t, PlanPremium, account.Plan)
+	assert.Equal(t, 5, account.Balance)
+
+	err = repo.setPlan("unknownUserID", PlanPremium)
+	assert.Equal(t, errAccountNotFound, err)
+
+	_, err = h.db.Exec("DELETE FROM account_ledger")
+	assert.NotNil(t, err)
+
+	_, err = repo.account("unknownUserID")
+	assert.Equal(t, errAccountNotFound, err)
+}
+
+func TestAccountRepository_ConcurrentDebits(t *testing.T) {
+	h := newTestHarness(t)
+	repo := NewAccountRepository(h.db, 10)
+	assert.Nil(t, repo.open("testUserID"))
+
+	// Sessions of a premium user receive the same article at once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paid, err := repo.debit("testUserID", 1)
+			assert.Nil(t, err)
+			assert.True(t, paid)
+		}()
+	}
+	wg.Wait()
+
+	account, err := repo.account("testUserID")
+	assert.Nil(t, err)
+	assert.Equal(t, 9, account.Balance)
+	assert.Len(t, account.Ledger, 2)
+
+	_, err = h.db.Exec(`
+		INSERT INTO account_ledger (user_id, amount, balance, reason, article_id)
+		VALUES ('testUserID', -1, 8, 'article read', 1)`)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,86 @@
+package publisher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// maxSearchLength bounds the search text.
+const maxSearchLength = 200
+
+type searchPayload struct {
+	Results []SearchResult `json:"results"`
+}
+
+// search serves GET /search, the published articles matching the q
+// parameter best first, optionally in the given category parameters. Words
+// in titles rank above the ones in bodies. Results hold snippets of the
+// bodies rather than the bodies, so searching is free: articles the reader
+// hasn't paid for only show a few words around a match.
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorPayload{Err: "Method not allowed"})
+		return
+	}
+
+	userID, ok := s.reader(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorPayload{Err: err.Error()})
+		return
+	}
+	q.reader = userID
+
+	results, err := s.articleRepo.search(q)
+	if err != nil {
+		log.Println("error searching articles:", err)
+		writeJSON(w, http.StatusInternalServerError, errorPayload{Err: "Internal error"})
+		return
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+
+	writeJSON(w, http.StatusOK, searchPayload{Results: results})
+}
+
+func parseSearchQuery(r *http.Request) (searchQuery, error) {
+	params := r.URL.Query()
+	q := searchQuery{
+		text:       params.Get("q"),
+		categories: params["category"],
+		limit:      defaultPageSize,
+	}
+
+	if q.text == "" {
+		return searchQuery{}, errors.New("q is required")
+	}
+	if len(q.text) > maxSearchLength {
+		return searchQuery{}, fmt.Errorf("q is limited to %d characters", maxSearchLength)
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return searchQuery{}, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.limit = n
+	}
+
+	if offset := params.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return searchQuery{}, errors.New("offset can't be negative")
+		}
+		q.offset = n
+	}
+
+	return q, nil
+}
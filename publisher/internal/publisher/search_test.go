@@ -0,0 +1,64 @@
+package publisher
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Search(t *testing.T) {
+	result := SearchResult{
+		ID:          1,
+		Title:       "Toyota battery breakthrough",
+		Category:    "technology",
+		PublishedAt: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Rank:        0.6,
+		Snippet:     "solid state <mark>batteries</mark> charging in minutes",
+	}
+
+	articles := &mockArticleRepository{}
+	articles.On("search", searchQuery{reader: "testUserID", text: "batteries", limit: defaultPageSize}).Return([]SearchResult{result}, nil)
+	articles.On("search", searchQuery{reader: "testUserID", text: "batteries", categories: []string{"japan", "travel"}, limit: 5, offset: 10}).Return([]SearchResult(nil), nil)
+	articles.On("search", searchQuery{reader: "testUserID", text: "failing", limit: defaultPageSize}).Return([]SearchResult(nil), errors.New("connection refused"))
+
+	accounts := &mockAccountRepository{}
+	accounts.On("open", "testUserID").Return(nil)
+
+	srv := NewServer(&mockBroker{}, articles, nil, accounts, "")
+
+	tests := []struct {
+		name     string
+		query    string
+		userID   string
+		status   int
+		expected string
+	}{
+		{"found", "q=batteries", "testUserID", http.StatusOK, `{"results":[{"id":1,"title":"Toyota battery breakthrough","category":"technology","published_at":"2020-01-01T12:00:00Z","rank":0.6,"snippet":"solid state <mark>batteries</mark> charging in minutes"}]}`},
+		{"filtered", "q=batteries&category=japan&category=travel&limit=5&offset=10", "testUserID", http.StatusOK, `{"results":[]}`},
+		{"storage error", "q=failing", "testUserID", http.StatusInternalServerError, `{"error":"Internal error"}`},
+		{"no text", "category=japan", "testUserID", http.StatusBadRequest, `{"error":"q is required"}`},
+		{"too long", "q=" + strings.Repeat("a", maxSearchLength+1), "testUserID", http.StatusBadRequest, `{"error":"q is limited to 200 characters"}`},
+		{"invalid offset", "q=batteries&offset=-1", "testUserID", http.StatusBadRequest, `{"error":"offset can't be negative"}`},
+		{"no user", "q=batteries", "", http.StatusUnauthorized, `{"error":"User id not found"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/search?"+tt.query, nil)
+			r.Header.Set("Y-User-ID", tt.userID)
+			w := httptest.NewRecorder()
+
+			srv.search(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.expected, w.Body.String())
+		})
+	}
+
+	articles.AssertExpectations(t)
+}
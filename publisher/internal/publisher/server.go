@@ -1,21 +1,43 @@
 package publisher
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
 type Server struct {
-	broker Broker
+	broker       Broker
+	articleRepo  ArticleRepository
+	categoryRepo CategoryRepository
+	accountRepo  AccountRepository
+	adminToken   string
+
+	// handlers tracks the subscriber connections being served, so shutdown
+	// can wait for them.
+	handlers sync.WaitGroup
+	connsMut sync.Mutex
+	conns    map[*websocket.Conn]struct{}
 }
 
-func NewServer(broker Broker) *Server {
+// NewServer returns the publisher server. Past articles are read from
+// articleRepository and categories managed in categoryRepository.
+// adminToken guards the billing and category APIs, which stay closed when
+// empty.
+func NewServer(broker Broker, articleRepository ArticleRepository, categoryRepository CategoryRepository, accountRepository AccountRepository, adminToken string) *Server {
 	return &Server{
-
-		broker: broker,
+		broker:       broker,
+		articleRepo:  articleRepository,
+		categoryRepo: categoryRepository,
+		accountRepo:  accountRepository,
+		adminToken:   adminToken,
+		conns:        make(map[*websocket.Conn]struct{}),
 	}
 }
 
@@ -23,11 +45,54 @@ func (s *Server) Start() {
 	s.broker.Run()
 }
 
+// Shutdown stops the broker and waits for subscribers to be sent the
+// articles queued for them and a going away close frame. Connections still
+// open when ctx is done are closed abruptly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.broker.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.connsMut.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.connsMut.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+func (s *Server) track(c *websocket.Conn) {
+	s.connsMut.Lock()
+	defer s.connsMut.Unlock()
+
+	s.conns[c] = struct{}{}
+}
+
+func (s *Server) untrack(c *websocket.Conn) {
+	s.connsMut.Lock()
+	defer s.connsMut.Unlock()
+
+	delete(s.conns, c)
+}
+
 type errorPayload struct {
 	Err string `json:"error"`
 }
 
 func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+
 	upgrader := websocket.Upgrader{}
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -35,6 +100,8 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.track(c)
+	defer s.untrack(c)
 	defer c.Close()
 
 	userID := r.Header.Get("Y-User-ID")
@@ -44,25 +111,52 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ch := s.broker.AddSubscriber(userID)
-
-	if ch == nil {
+	filter := Filter{
+		Categories: parseList(r.Header.Get("Y-Categories")),
+		Tags:       parseList(r.Header.Get("Y-Tags")),
+	}
+	session, err := s.broker.AddSubscriber(userID, filter)
+	switch {
+	case errors.Is(err, errUpgradeRequired):
 		log.Println(fmt.Sprintf("subscriber %s already exists", userID))
 		c.WriteJSON(errorPayload{Err: "Upgrade to premium to use Y network from multiple devices"})
 		return
+	case errors.Is(err, errTooManySessions):
+		log.Println(fmt.Sprintf("subscriber %s reached its session limit", userID))
+		c.WriteJSON(errorPayload{Err: "Too many devices connected, disconnect one to continue"})
+		return
+	case errors.Is(err, errShuttingDown):
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"))
+		return
+	case err != nil:
+		log.Println(fmt.Sprintf("error adding subscriber %s: %v", userID, err))
+		c.WriteJSON(errorPayload{Err: "Internal error"})
+		return
 	}
 
 	log.Println(fmt.Sprintf("subscriber %s connected", userID))
 	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+
+	// Replies to control messages are handed to the loop below, as it's
+	// the only goroutine allowed to write to the connection.
+	replies := make(chan interface{})
 
 	go func() {
 		defer close(done)
 		for {
-			_, _, err := c.NextReader()
+			_, data, err := c.ReadMessage()
 			if err != nil {
 				log.Println("connection interrupted:", err)
 				break
 			}
+
+			select {
+			case replies <- s.handleControl(session, data):
+			case <-quit:
+				return
+			}
 		}
 	}()
 
@@ -70,22 +164,87 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 		select {
 		case <-done:
 			log.Println(fmt.Sprintf("subscriber %s disconnected", userID))
-			s.broker.RemoveSubscriber(userID)
+			s.broker.RemoveSubscriber(session)
 
 			return
 
-		case article := <-ch:
-			err := c.WriteJSON(article)
+		case reply := <-replies:
+			err := c.WriteJSON(reply)
+			if err != nil {
+				log.Println("write error:", err)
+				s.broker.RemoveSubscriber(session)
+
+				return
+			}
+
+		case article, ok := <-session.Articles():
+			if !ok {
+				code, reason := session.CloseReason()
+				log.Println(fmt.Sprintf("subscriber %s closed by broker: %s", userID, reason))
+				c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+				s.broker.RemoveSubscriber(session)
+
+				return
+			}
+
+			var frame interface{} = article
+			if article.Type == TypeArticleRetracted {
+				frame = Retraction{Type: article.Type, ID: article.ID}
+			}
+
+			err := c.WriteJSON(frame)
 			if err != nil {
 				log.Println("write error:", err)
-				s.broker.RemoveSubscriber(userID)
+				s.broker.RemoveSubscriber(session)
 
 				return
 			}
+			// Changes are sent for articles already delivered
+			if article.Type == "" {
+				s.broker.Delivered(userID, article.seq)
+			}
 		}
 	}
 }
 
+// parseList splits a comma separated list, as sent in the Y-Categories and
+// Y-Tags headers. Subscribing to no category nor tag follows every
+// category.
+func parseList(header string) []string {
+	var items []string
+	for _, item := range strings.Split(header, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// health reports the state of the broker's Postgres listener, answering
+// 503 while articles may not be delivered.
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorPayload{Err: "Method not allowed"})
+		return
+	}
+
+	h := s.broker.Health()
+	status := http.StatusOK
+	if !h.Healthy() {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, h)
+}
+
 func (s *Server) RegistersRoutes() {
 	http.HandleFunc("/subscribe", s.subscribe)
+	http.HandleFunc("/health", s.health)
+	http.HandleFunc("/accounts/", s.accounts)
+	http.HandleFunc("/articles", s.listArticles)
+	http.HandleFunc("/articles/", s.getArticle)
+	http.HandleFunc("/search", s.search)
+	http.HandleFunc("/categories", s.categories)
+	http.HandleFunc("/categories/", s.categories)
 }
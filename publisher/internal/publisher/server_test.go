@@ -1,6 +1,7 @@
 package publisher
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -13,7 +14,7 @@ import (
 
 func TestPublisher(t *testing.T) {
 	broker := &mockBroker{}
-	srv := NewServer(broker)
+	srv := NewServer(broker, nil, nil, nil, "")
 
 	s := httptest.NewServer(http.HandlerFunc(srv.subscribe))
 
@@ -21,14 +22,22 @@ func TestPublisher(t *testing.T) {
 
 	t.Run("success", func(t *testing.T) {
 		ch := make(chan Article)
-		broker.On("AddSubscriber", "testUserID").Return(ch)
+		session := &Session{userID: "testUserID", channel: ch}
+		broker.On("AddSubscriber", "testUserID", Filter{Categories: []string{"japan", "travel"}, Tags: []string{"trains"}}).Return(session, nil)
+		broker.On("RemoveSubscriber", session).Return().Maybe()
+		delivered := make(chan struct{})
+		broker.On("Delivered", "testUserID", int64(5)).Run(func(mock.Arguments) { close(delivered) }).Return()
 
-		c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Y-User-ID": []string{"testUserID"}})
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+			"Y-User-ID":    []string{"testUserID"},
+			"Y-Categories": []string{"japan, travel"},
+			"Y-Tags":       []string{"trains"},
+		})
 		assert.Nil(t, err)
 
 		defer c.Close()
 
-		expected := Article{Title: "title", Body: "body", Category: "category"}
+		expected := Article{ID: 1, seq: 5, Title: "title", Body: "body", Category: "category"}
 
 		// Simluate broker sending an article
 		ch <- expected
@@ -36,11 +45,141 @@ func TestPublisher(t *testing.T) {
 		var actual Article
 		err = c.ReadJSON(&actual)
 		assert.Nil(t, err)
+		// Sequence numbers aren't sent to subscribers
+		expected.seq = 0
 		assert.Equal(t, expected, actual)
 
+		<-delivered
 		broker.AssertExpectations(t)
 	})
 
+	t.Run("control", func(t *testing.T) {
+		ch := make(chan Article)
+		session := &Session{userID: "controlUserID", channel: ch}
+		broker.On("AddSubscriber", "controlUserID", Filter{}).Return(session, nil)
+		broker.On("Subscribe", session, Filter{Categories: []string{"japan"}}).Return(Filter{Categories: []string{"japan"}}, nil)
+		broker.On("RemoveSubscriber", session).Return().Maybe()
+		delivered := make(chan struct{})
+		broker.On("Delivered", "controlUserID", int64(2)).Run(func(mock.Arguments) { close(delivered) }).Return()
+
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Y-User-ID": []string{"controlUserID"}})
+		assert.Nil(t, err)
+
+		defer c.Close()
+
+		err = c.WriteJSON(controlMessage{Op: opSubscribe, Categories: []string{"japan"}})
+		assert.Nil(t, err)
+
+		var ack ackPayload
+		err = c.ReadJSON(&ack)
+		assert.Nil(t, err)
+		assert.Equal(t, ackPayload{Ack: opSubscribe, Categories: []string{"japan"}}, ack)
+
+		// Articles keep flowing on the same connection
+		expected := Article{ID: 2, seq: 2, Title: "title", Body: "body", Category: "japan"}
+		ch <- expected
+
+		var actual Article
+		err = c.ReadJSON(&actual)
+		assert.Nil(t, err)
+		// Sequence numbers aren't sent to subscribers
+		expected.seq = 0
+		assert.Equal(t, expected, actual)
+
+		<-delivered
+		broker.AssertExpectations(t)
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		ch := make(chan Article)
+		session := &Session{userID: "changesUserID", channel: ch}
+		broker.On("AddSubscriber", "changesUserID", Filter{}).Return(session, nil)
+		broker.On("RemoveSubscriber", session).Return().Maybe()
+		delivered := make(chan struct{})
+		broker.On("Delivered", "changesUserID", int64(4)).Run(func(mock.Arguments) { close(delivered) }).Return()
+
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Y-User-ID": []string{"changesUserID"}})
+		assert.Nil(t, err)
+
+		defer c.Close()
+
+		ch <- Article{ID: 3, seq: 3, Title: "fixed", Body: "body", Category: "japan", Type: TypeArticleUpdated}
+		var updated Article
+		err = c.ReadJSON(&updated)
+		assert.Nil(t, err)
+		assert.Equal(t, Article{ID: 3, Title: "fixed", Body: "body", Category: "japan", Type: TypeArticleUpdated}, updated)
+
+		ch <- Article{ID: 3, seq: 3, Category: "japan", Type: TypeArticleRetracted}
+		_, data, err := c.ReadMessage()
+		assert.Nil(t, err)
+		assert.JSONEq(t, `{"type": "article_retracted", "id": 3}`, string(data))
+
+		// Only new articles move the cursor
+		ch <- Article{ID: 4, seq: 4, Title: "title", Body: "body", Category: "japan"}
+		_, _, err = c.ReadMessage()
+		assert.Nil(t, err)
+
+		<-delivered
+		broker.AssertExpectations(t)
+	})
+
+	t.Run("closed by broker", func(t *testing.T) {
+		ch := make(chan Article)
+		session := &Session{
+			userID:      "slowUserID",
+			channel:     ch,
+			closeCode:   websocket.ClosePolicyViolation,
+			closeReason: "Too slow reading articles",
+		}
+		broker.On("AddSubscriber", "slowUserID", Filter{}).Return(session, nil)
+		broker.On("RemoveSubscriber", session).Return()
+
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Y-User-ID": []string{"slowUserID"}})
+		assert.Nil(t, err)
+
+		defer c.Close()
+
+		close(ch)
+
+		_, _, err = c.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+		assert.Contains(t, err.Error(), "Too slow reading articles")
+	})
+
+	t.Run("session limit", func(t *testing.T) {
+		broker.On("AddSubscriber", "freeUserID", Filter{}).Return(nil, errUpgradeRequired)
+		broker.On("AddSubscriber", "premiumUserID", Filter{}).Return(nil, errTooManySessions)
+
+		tests := map[string]string{
+			"freeUserID":    "Upgrade to premium to use Y network from multiple devices",
+			"premiumUserID": "Too many devices connected, disconnect one to continue",
+		}
+
+		for userID, expected := range tests {
+			c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Y-User-ID": []string{userID}})
+			assert.Nil(t, err)
+
+			var actual errorPayload
+			err = c.ReadJSON(&actual)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, actual.Err)
+
+			c.Close()
+		}
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		broker.On("AddSubscriber", "lateUserID", Filter{}).Return(nil, errShuttingDown)
+
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Y-User-ID": []string{"lateUserID"}})
+		assert.Nil(t, err)
+
+		defer c.Close()
+
+		_, _, err = c.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+	})
+
 	t.Run("error", func(t *testing.T) {
 		// No Y-User-ID header to trigger error
 		c, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
@@ -55,16 +194,62 @@ func TestPublisher(t *testing.T) {
 	})
 }
 
+func TestServer_Health(t *testing.T) {
+	tests := map[string]int{
+		ListenerConnected:    http.StatusOK,
+		ListenerBackfilling:  http.StatusServiceUnavailable,
+		ListenerDisconnected: http.StatusServiceUnavailable,
+	}
+
+	for state, status := range tests {
+		t.Run(state, func(t *testing.T) {
+			broker := &mockBroker{}
+			broker.On("Health").Return(ListenerHealth{State: state, Reconnects: 1})
+			srv := NewServer(broker, nil, nil, nil, "")
+
+			w := httptest.NewRecorder()
+			srv.health(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			assert.Equal(t, status, w.Code)
+			var actual ListenerHealth
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &actual))
+			assert.Equal(t, state, actual.State)
+			assert.Equal(t, 1, actual.Reconnects)
+		})
+	}
+}
+
 type mockBroker struct {
 	mock.Mock
 }
 
-func (m *mockBroker) AddSubscriber(userID string) chan Article {
-	return m.Called(userID).Get(0).(chan Article)
+func (m *mockBroker) AddSubscriber(userID string, filter Filter) (*Session, error) {
+	args := m.Called(userID, filter)
+	session, _ := args.Get(0).(*Session)
+	return session, args.Error(1)
+}
+
+func (m *mockBroker) RemoveSubscriber(session *Session) {
+	m.Called(session)
+}
+
+func (m *mockBroker) Subscribe(session *Session, filter Filter) (Filter, error) {
+	args := m.Called(session, filter)
+	return args.Get(0).(Filter), args.Error(1)
+}
+
+func (m *mockBroker) Unsubscribe(session *Session, filter Filter) (Filter, error) {
+	args := m.Called(session, filter)
+	return args.Get(0).(Filter), args.Error(1)
+}
+
+func (m *mockBroker) Delivered(userID string, articleID int64) {
+	m.Called(userID, articleID)
 }
 
-func (m *mockBroker) RemoveSubscriber(userID string) {
-	m.Called(userID)
+func (m *mockBroker) Health() ListenerHealth {
+	args := m.Called()
+	return args.Get(0).(ListenerHealth)
 }
 
 func (m *mockBroker) Run() {
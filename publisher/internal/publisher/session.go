@@ -0,0 +1,346 @@
+package publisher
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy decides what happens when a session's queue is full
+// because its connection can't keep up with the articles published.
+type OverflowPolicy string
+
+const (
+	// DropOldest discards the oldest queued article to make room.
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest discards the article being published.
+	DropNewest OverflowPolicy = "drop-newest"
+	// Disconnect closes the session, telling the subscriber why.
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(policy); p {
+	case DropOldest, DropNewest, Disconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", policy)
+	}
+}
+
+// Session is a subscriber connection. A user may hold several sessions,
+// depending on their plan, all sharing the same balance and cursor.
+//
+// Articles are queued on the session without blocking the broker, and a
+// goroutine per session hands them to the connection writer through the
+// Articles channel. Users are only charged for the articles handed over,
+// not the ones dropped from the queue.
+type Session struct {
+	userID  string
+	channel chan Article
+	// charge pays for an article as it's handed over, paywalling it when
+	// the user can't.
+	charge func(userID string, article Article) Article
+
+	// Fields below are guarded by the broker mutex.
+
+	// categories the session follows. A nil set follows every category
+	// while an empty one follows none.
+	categories map[string]struct{}
+	// tags the session follows on top of its categories. They're unused
+	// while it follows every category.
+	tags map[string]struct{}
+	// lastSeq is the sequence number of the newest article handed to the
+	// session.
+	lastSeq int64
+	// While replaying articles missed since the last connection, live
+	// articles are held in pending so they are sent after the missed ones.
+	replaying bool
+	pending   []Article
+
+	// Fields below are guarded by mut.
+
+	mut         sync.Mutex
+	queue       []Article
+	queueSize   int
+	overflow    OverflowPolicy
+	dropped     int
+	closeCode   int
+	closeReason string
+	// draining sessions are closed once their queue is empty.
+	draining bool
+	// ready is signalled when articles are queued and space when they
+	// leave the queue.
+	ready     chan struct{}
+	space     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(userID string, queueSize int, overflow OverflowPolicy, charge func(string, Article) Article) *Session {
+	s := &Session{
+		userID:    userID,
+		channel:   make(chan Article),
+		charge:    charge,
+		queueSize: queueSize,
+		overflow:  overflow,
+		ready:     make(chan struct{}, 1),
+		space:     make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	go s.pump()
+
+	return s
+}
+
+func (s *Session) UserID() string {
+	return s.userID
+}
+
+// Articles returns the channel articles for the session are sent on. It's
+// closed once the session is closed, see CloseReason.
+func (s *Session) Articles() <-chan Article {
+	return s.channel
+}
+
+// CloseReason returns the websocket close code and reason the broker closed
+// the session with, or websocket.CloseNormalClosure when the subscriber
+// left on its own.
+func (s *Session) CloseReason() (int, string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.closeCode == 0 {
+		return websocket.CloseNormalClosure, ""
+	}
+
+	return s.closeCode, s.closeReason
+}
+
+// Dropped returns the number of articles dropped because the queue was full.
+func (s *Session) Dropped() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.dropped
+}
+
+// enqueue adds the article to the queue without blocking, applying the
+// overflow policy when it's full. It reports false when the policy asks to
+// disconnect the session.
+func (s *Session) enqueue(article Article) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.draining {
+		return true
+	}
+
+	if len(s.queue) >= s.queueSize {
+		switch s.overflow {
+		case DropNewest:
+			s.dropped++
+			metrics.Add(metricDroppedNewest, 1)
+			return true
+		case Disconnect:
+			return false
+		default:
+			s.queue = s.queue[1:]
+			s.dropped++
+			metrics.Add(metricDroppedOldest, 1)
+		}
+	}
+
+	s.queue = append(s.queue, article)
+	signal(s.ready)
+
+	return true
+}
+
+// waitSpace blocks until the queue has room for an article. It reports
+// false if the session is closed meanwhile.
+func (s *Session) waitSpace() bool {
+	for {
+		select {
+		case <-s.closed:
+			return false
+		default:
+		}
+
+		s.mut.Lock()
+		full := len(s.queue) >= s.queueSize
+		s.mut.Unlock()
+
+		if !full {
+			return true
+		}
+
+		select {
+		case <-s.space:
+		case <-s.closed:
+			return false
+		}
+	}
+}
+
+// pop takes the next article from the queue. It reports false when the
+// queue is empty, and drained as well when the session is draining.
+func (s *Session) pop() (article Article, ok bool, drained bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if len(s.queue) == 0 {
+		return Article{}, false, s.draining
+	}
+
+	article = s.queue[0]
+	s.queue = s.queue[1:]
+	signal(s.space)
+
+	return article, true, false
+}
+
+// pump charges for the queued articles and hands them to the connection
+// writer until the session is closed, or drained.
+func (s *Session) pump() {
+	defer close(s.channel)
+
+	for {
+		article, ok, drained := s.pop()
+		if drained {
+			return
+		}
+		if !ok {
+			select {
+			case <-s.ready:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+		if s.charge != nil {
+			article = s.charge(s.userID, article)
+		}
+
+		select {
+		case s.channel <- article:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// close stops the session. Queued articles are discarded. The close code
+// and reason of a session already draining are kept.
+func (s *Session) close(code int, reason string) {
+	s.closeOnce.Do(func() {
+		s.mut.Lock()
+		if !s.draining {
+			s.closeCode = code
+			s.closeReason = reason
+		}
+		s.queue = nil
+		s.mut.Unlock()
+
+		close(s.closed)
+	})
+}
+
+// drain closes the session once the articles already queued are handed
+// to the connection writer. New articles are no longer queued.
+func (s *Session) drain(code int, reason string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.draining {
+		return
+	}
+
+	s.draining = true
+	s.closeCode = code
+	s.closeReason = reason
+	signal(s.ready)
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// addFilter makes the session follow the categories and tags of f too. A
+// session following every category only follows these afterwards.
+func addFilter(s *Session, f Filter) {
+	for _, c := range f.Categories {
+		key := categoryKey(c)
+		if key == "" {
+			continue
+		}
+		if s.categories == nil {
+			s.categories = make(map[string]struct{})
+		}
+		s.categories[key] = struct{}{}
+	}
+
+	for _, t := range f.Tags {
+		key := tagKey(t)
+		if key == "" {
+			continue
+		}
+		if s.categories == nil {
+			s.categories = make(map[string]struct{})
+		}
+		if s.tags == nil {
+			s.tags = make(map[string]struct{})
+		}
+		s.tags[key] = struct{}{}
+	}
+}
+
+// follows tells whether the session follows any of the categories in the
+// lineage of an article's category or any of its tags.
+func (s *Session) follows(lineage []string, tags []string) bool {
+	if s.categories == nil {
+		return true
+	}
+
+	for _, c := range lineage {
+		if _, ok := s.categories[c]; ok {
+			return true
+		}
+	}
+	for _, t := range tags {
+		if _, ok := s.tags[t]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns what the session follows, with nil categories when it
+// follows every category.
+func (s *Session) filter() Filter {
+	if s.categories == nil {
+		return Filter{}
+	}
+
+	f := Filter{Categories: sortedKeys(s.categories)}
+	if len(s.tags) > 0 {
+		f.Tags = sortedKeys(s.tags)
+	}
+
+	return f
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
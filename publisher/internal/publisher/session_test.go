@@ -0,0 +1,117 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_Overflow(t *testing.T) {
+	articles := []Article{{ID: 1, seq: 1}, {ID: 2, seq: 2}, {ID: 3, seq: 3}}
+
+	tests := []struct {
+		policy   OverflowPolicy
+		accepted []bool
+		queued   []int64
+		dropped  int
+	}{
+		{DropOldest, []bool{true, true, true}, []int64{2, 3}, 1},
+		{DropNewest, []bool{true, true, true}, []int64{1, 2}, 1},
+		{Disconnect, []bool{true, true, false}, []int64{1, 2}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			// Without a pump, articles stay in the queue
+			s := &Session{
+				queueSize: 2,
+				overflow:  tt.policy,
+				ready:     make(chan struct{}, 1),
+				space:     make(chan struct{}, 1),
+			}
+
+			for i, a := range articles {
+				assert.Equal(t, tt.accepted[i], s.enqueue(a))
+			}
+
+			var queued []int64
+			for _, a := range s.queue {
+				queued = append(queued, a.ID)
+			}
+			assert.Equal(t, tt.queued, queued)
+			assert.Equal(t, tt.dropped, s.Dropped())
+		})
+	}
+}
+
+func TestSession_Pump(t *testing.T) {
+	s := newSession("test", 10, DropOldest, nil)
+
+	assert.True(t, s.enqueue(Article{ID: 1, seq: 1}))
+	assert.True(t, s.enqueue(Article{ID: 2, seq: 2}))
+
+	assert.Equal(t, int64(1), (<-s.Articles()).ID)
+	assert.Equal(t, int64(2), (<-s.Articles()).ID)
+
+	s.close(websocket.CloseGoingAway, "bye")
+
+	_, ok := <-s.Articles()
+	assert.False(t, ok)
+
+	code, reason := s.CloseReason()
+	assert.Equal(t, websocket.CloseGoingAway, code)
+	assert.Equal(t, "bye", reason)
+	assert.False(t, s.waitSpace())
+}
+
+func TestSession_Drain(t *testing.T) {
+	s := newSession("test", 10, DropOldest, nil)
+
+	assert.True(t, s.enqueue(Article{ID: 1, seq: 1}))
+	s.drain(websocket.CloseGoingAway, "bye")
+	assert.True(t, s.enqueue(Article{ID: 2, seq: 2}))
+
+	assert.Equal(t, int64(1), (<-s.Articles()).ID)
+
+	_, ok := <-s.Articles()
+	assert.False(t, ok)
+
+	code, reason := s.CloseReason()
+	assert.Equal(t, websocket.CloseGoingAway, code)
+	assert.Equal(t, "bye", reason)
+}
+
+func TestSession_ChargesDelivered(t *testing.T) {
+	charged := make(chan int64, 3)
+	s := newSession("test", 1, DropNewest, func(userID string, a Article) Article {
+		charged <- a.ID
+		a.Body = "paid"
+		return a
+	})
+
+	// Taken from the queue and charged, waiting for the writer
+	assert.True(t, s.enqueue(Article{ID: 1, seq: 1}))
+	assert.Equal(t, int64(1), <-charged)
+
+	assert.True(t, s.enqueue(Article{ID: 2, seq: 2}))
+	// Dropped, it's never charged
+	assert.True(t, s.enqueue(Article{ID: 3, seq: 3}))
+
+	assert.Equal(t, Article{ID: 1, seq: 1, Body: "paid"}, <-s.Articles())
+	assert.Equal(t, Article{ID: 2, seq: 2, Body: "paid"}, <-s.Articles())
+	assert.Equal(t, int64(2), <-charged)
+	assert.Equal(t, 1, s.Dropped())
+
+	s.close(websocket.CloseGoingAway, "bye")
+	assert.Empty(t, charged)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	p, err := ParseOverflowPolicy("drop-newest")
+	assert.Nil(t, err)
+	assert.Equal(t, DropNewest, p)
+
+	_, err = ParseOverflowPolicy("drop-everything")
+	assert.NotNil(t, err)
+}
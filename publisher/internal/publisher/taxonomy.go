@@ -0,0 +1,73 @@
+package publisher
+
+import "sync"
+
+// taxonomy is the category tree the broker fans articles out with, kept in
+// memory and replaced as a whole when categories change.
+type taxonomy struct {
+	mut sync.RWMutex
+	// parents maps each slug to the slug of its parent, empty for top
+	// level categories.
+	parents map[string]string
+	// keys maps the category keys of slugs, names and aliases to slugs.
+	keys map[string]string
+}
+
+func (t *taxonomy) set(categories []Category) {
+	parents := make(map[string]string, len(categories))
+	keys := make(map[string]string, len(categories))
+	// Slugs win over names and names over aliases
+	for _, c := range categories {
+		for _, a := range c.Aliases {
+			keys[categoryKey(a)] = c.Slug
+		}
+	}
+	for _, c := range categories {
+		keys[categoryKey(c.Name)] = c.Slug
+	}
+	for _, c := range categories {
+		keys[c.Slug] = c.Slug
+		parents[c.Slug] = c.Parent
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.parents = parents
+	t.keys = keys
+}
+
+// resolve returns the slugs of the categories with the given slugs, names
+// or aliases. Unknown categories are kept as their category key, matching
+// the category created with that slug later.
+func (t *taxonomy) resolve(categories []string) []string {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	slugs := make([]string, 0, len(categories))
+	for _, c := range categories {
+		key := categoryKey(c)
+		if slug, ok := t.keys[key]; ok {
+			key = slug
+		}
+		slugs = append(slugs, key)
+	}
+
+	return slugs
+}
+
+// lineage returns the slug of the category followed by the ones of its
+// ancestors, closest first.
+func (t *taxonomy) lineage(category string) []string {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	lineage := []string{categoryKey(category)}
+	// The database rejects cycles, the bound only guards against a broken
+	// tree.
+	for parent := t.parents[lineage[0]]; parent != "" && len(lineage) <= len(t.parents); parent = t.parents[parent] {
+		lineage = append(lineage, parent)
+	}
+
+	return lineage
+}
@@ -0,0 +1,34 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaxonomy(t *testing.T) {
+	var tx taxonomy
+	tx.set([]Category{
+		{Slug: "asia", Name: "Asia"},
+		{Slug: "japan", Name: "Japan", Parent: "asia", Aliases: []string{"nippon", "travel"}},
+		{Slug: "tokyo", Name: "Tokyo City", Parent: "japan"},
+		{Slug: "travel", Name: "Travel"},
+	})
+
+	// Slugs win over names and aliases, unknown categories are kept
+	assert.Equal(t,
+		[]string{"japan", "tokyo", "travel", "sports"},
+		tx.resolve([]string{"Nippon", " tokyo city ", "travel", "Sports"}),
+	)
+
+	assert.Equal(t, []string{"tokyo", "japan", "asia"}, tx.lineage("tokyo"))
+	assert.Equal(t, []string{"asia"}, tx.lineage("Asia"))
+	assert.Equal(t, []string{"sports"}, tx.lineage("sports"))
+
+	// A broken tree doesn't loop forever
+	tx.set([]Category{
+		{Slug: "a", Name: "A", Parent: "b"},
+		{Slug: "b", Name: "B", Parent: "a"},
+	})
+	assert.Equal(t, []string{"a", "b", "a"}, tx.lineage("a"))
+}
@@ -8,25 +8,49 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/gorilla/websocket"
 )
 
 type Article struct {
+	ID          int64     `json:"id"`
 	Title       string    `json:"title"`
 	Body        string    `json:"body"`
 	Category    string    `json:"category"`
 	PublishedAt time.Time `json:"published_at"`
+	Author      string    `json:"author,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+// SearchResult is an article matching a search, with a snippet of its body.
+type SearchResult struct {
+	ID          int64     `json:"id"`
+	Title       string    `json:"title"`
+	Category    string    `json:"category"`
+	PublishedAt time.Time `json:"published_at"`
+	Author      string    `json:"author,omitempty"`
+	Snippet     string    `json:"snippet"`
+}
+
+type ControlMessage struct {
+	Op         string   `json:"op"`
+	Categories []string `json:"categories,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
 }
 
 type ArticleReader struct {
 	conn   *websocket.Conn
 	sender TeaProgramSender
 	done   chan struct{}
+	// writeMut serializes writes, the connection supports a single writer.
+	writeMut sync.Mutex
 }
 
 func (a *ArticleReader) Read() {
@@ -40,12 +64,18 @@ func (a *ArticleReader) Read() {
 			_, message, err := a.conn.ReadMessage()
 			if err != nil {
 				log.Println("read:", err)
+				a.sender.Send(disconnectedMsg{})
 				return
 			}
 
 			var payload struct {
 				Article
-				Error string `json:"error"`
+				Type       string   `json:"type"`
+				Error      string   `json:"error"`
+				Ack        string   `json:"ack"`
+				Categories []string `json:"categories"`
+				Tags       []string `json:"tags"`
+				All        bool     `json:"all"`
 			}
 
 			err = json.Unmarshal(message, &payload)
@@ -54,20 +84,50 @@ func (a *ArticleReader) Read() {
 				continue
 			}
 
-			a.sender.Send(resultMsg{
-				err: payload.Error,
-				article: Article{
-					Title:       payload.Title,
-					Body:        payload.Body,
-					Category:    payload.Category,
-					PublishedAt: payload.PublishedAt,
-				},
-			})
+			if payload.Ack != "" {
+				a.sender.Send(ackMsg{
+					op:         payload.Ack,
+					categories: payload.Categories,
+					tags:       payload.Tags,
+					all:        payload.All,
+				})
+				continue
+			}
+
+			article := Article{
+				ID:          payload.ID,
+				Title:       payload.Title,
+				Body:        payload.Body,
+				Category:    payload.Category,
+				PublishedAt: payload.PublishedAt,
+				Author:      payload.Author,
+				Tags:        payload.Tags,
+			}
+
+			switch payload.Type {
+			case "article_updated":
+				a.sender.Send(updatedMsg{article: article})
+			case "article_retracted":
+				a.sender.Send(retractedMsg{id: payload.ID})
+			default:
+				a.sender.Send(resultMsg{err: payload.Error, article: article})
+			}
 		}
 	}()
 }
 
+// Send writes a control message to change the subscription at runtime.
+func (a *ArticleReader) Send(msg ControlMessage) error {
+	a.writeMut.Lock()
+	defer a.writeMut.Unlock()
+
+	return a.conn.WriteJSON(msg)
+}
+
 func (a *ArticleReader) Close() {
+	a.writeMut.Lock()
+	defer a.writeMut.Unlock()
+
 	defer a.conn.Close()
 	err := a.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
@@ -82,7 +142,11 @@ type TeaProgramSender interface {
 
 func NewArticleReader(s TeaProgramSender) (*ArticleReader, error) {
 	u := url.URL{Scheme: "ws", Host: *addr, Path: "/subscribe"}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"y-user-id": []string{*userID}})
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{
+		"y-user-id":    []string{*userID},
+		"y-categories": []string{*categories},
+		"y-tags":       []string{*tags},
+	})
 	if err != nil {
 		log.Fatal("dial:", err)
 	}
@@ -96,29 +160,176 @@ var (
 	dotStyle      = helpStyle.Copy().UnsetMargins()
 	durationStyle = dotStyle.Copy()
 	appStyle      = lipgloss.NewStyle().Margin(1, 2, 0, 2)
+	retractStyle  = lipgloss.NewStyle().Strikethrough(true).Foreground(lipgloss.Color("241"))
+	markStyle     = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("212"))
 )
 
 type resultMsg struct {
 	article Article
 	err     string
+	// updated and retracted mark articles changed after they were read.
+	updated   bool
+	retracted bool
+}
+
+// updatedMsg carries the corrected version of an article already shown.
+type updatedMsg struct {
+	article Article
+}
+
+// retractedMsg tells an article already shown was withdrawn.
+type retractedMsg struct {
+	id int64
+}
+
+type ackMsg struct {
+	op         string
+	categories []string
+	tags       []string
+	all        bool
+}
+
+func (a ackMsg) String() string {
+	switch {
+	case a.op != "subscribe" && a.op != "unsubscribe":
+		return a.op + " acknowledged"
+	case a.all:
+		return "Following all categories"
+	case len(a.categories) == 0 && len(a.tags) == 0:
+		return "Not following any category"
+	}
+
+	following := a.categories
+	for _, tag := range a.tags {
+		following = append(following, "#"+tag)
+	}
+	return "Following " + strings.Join(following, ", ")
+}
+
+// searchMsg holds the results of a /search command.
+type searchMsg struct {
+	terms   string
+	results []SearchResult
+	err     error
+}
+
+func (s searchMsg) String() string {
+	if len(s.results) == 0 {
+		return fmt.Sprintf("No articles found for %q\n", s.terms)
+	}
+
+	out := fmt.Sprintf("Articles found for %q:\n", s.terms)
+	for _, r := range s.results {
+		out += fmt.Sprintf("\n%s| %s | %s\n%s\n",
+			durationStyle.Render(r.PublishedAt.String()),
+			r.Category,
+			r.Title,
+			highlight(r.Snippet),
+		)
+	}
+
+	return out
+}
+
+// highlight renders the words a search found, which come wrapped in
+// <mark> tags.
+func highlight(snippet string) string {
+	var out string
+	for {
+		start := strings.Index(snippet, "<mark>")
+		if start < 0 {
+			return out + snippet
+		}
+		end := strings.Index(snippet[start:], "</mark>")
+		if end < 0 {
+			return out + snippet
+		}
+		end += start
+
+		out += snippet[:start] + markStyle.Render(snippet[start+len("<mark>"):end])
+		snippet = snippet[end+len("</mark>"):]
+	}
+}
+
+// search asks the publisher for the articles matching terms.
+func search(terms string) tea.Cmd {
+	return func() tea.Msg {
+		u := url.URL{Scheme: "http", Host: *addr, Path: "/search", RawQuery: url.Values{"q": []string{terms}}.Encode()}
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return searchMsg{terms: terms, err: err}
+		}
+		req.Header.Set("Y-User-ID", *userID)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return searchMsg{terms: terms, err: err}
+		}
+		defer res.Body.Close()
+
+		var payload struct {
+			Results []SearchResult `json:"results"`
+			Error   string         `json:"error"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&payload)
+		if err != nil {
+			return searchMsg{terms: terms, err: err}
+		}
+		if res.StatusCode != http.StatusOK {
+			return searchMsg{terms: terms, err: fmt.Errorf("search failed: %s", payload.Error)}
+		}
+
+		return searchMsg{terms: terms, results: payload.Results}
+	}
+}
+
+type disconnectedMsg struct{}
+
+type sendErrMsg struct {
+	err error
 }
 
 func (r resultMsg) String() string {
+	author := r.article.Author
+	if author == "" {
+		author = "anonymous"
+	}
+
+	byline := "by " + author
+	if len(r.article.Tags) > 0 {
+		byline += " #" + strings.Join(r.article.Tags, " #")
+	}
+	if r.updated {
+		byline += ", corrected"
+	}
+
+	title, body := r.article.Title, r.article.Body
+	if r.retracted {
+		byline += ", retracted"
+		title, body = retractStyle.Render(title), retractStyle.Render(body)
+	}
+
 	return fmt.Sprintf(`
 %s| %s | %s
 %s
+%s
 -------------------------
 	`,
 		durationStyle.Render(r.article.PublishedAt.String()),
 		r.article.Category,
-		r.article.Title,
-		r.article.Body,
+		title,
+		durationStyle.Render(byline),
+		body,
 	)
 }
 
 type model struct {
 	spinner  spinner.Model
+	input    textinput.Model
+	reader   *ArticleReader
 	results  []resultMsg
+	search   *searchMsg
+	status   string
 	quitting bool
 	err      string
 }
@@ -126,35 +337,145 @@ type model struct {
 func newModel() model {
 	s := spinner.New()
 	s.Style = spinnerStyle
+
+	i := textinput.New()
+	i.Placeholder = "/sub japan #trains, /unsub japan, /search batteries, /ping"
+	i.Focus()
+
 	return model{
 		spinner: s,
+		input:   i,
 	}
 }
 
 func (m model) Init() tea.Cmd {
-	return m.spinner.Tick
+	return tea.Batch(m.spinner.Tick, textinput.Blink)
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
-		m.quitting = true
-		return m, tea.Quit
+		switch msg.Type {
+		case tea.KeyCtrlC, tea.KeyEsc:
+			m.quitting = true
+			return m, tea.Quit
+		case tea.KeyEnter:
+			command := m.input.Value()
+			if fields := strings.Fields(command); len(fields) > 0 && fields[0] == "/search" {
+				m.input.Reset()
+				m.err = ""
+				if len(fields) == 1 {
+					// A bare /search hides the results
+					m.search = nil
+					return m, nil
+				}
+				return m, search(strings.Join(fields[1:], " "))
+			}
+
+			control, err := parseCommand(command)
+			m.input.Reset()
+			if err != nil {
+				m.err = err.Error()
+				return m, nil
+			}
+			m.err = ""
+			return m, m.send(control)
+		}
 	case resultMsg:
 		if msg.err != "" {
-			m.quitting = true
 			m.err = msg.err
-			return m, tea.Quit
+			return m, nil
 		}
 		m.results = append(m.results, msg)
 		return m, nil
+	case updatedMsg:
+		for i := range m.results {
+			if m.results[i].article.ID == msg.article.ID {
+				m.results[i].article = msg.article
+				m.results[i].updated = true
+			}
+		}
+		return m, nil
+	case retractedMsg:
+		for i := range m.results {
+			if m.results[i].article.ID == msg.id {
+				m.results[i].retracted = true
+			}
+		}
+		return m, nil
+	case ackMsg:
+		m.status = msg.String()
+		return m, nil
+	case searchMsg:
+		if msg.err != nil {
+			m.err = msg.err.Error()
+			return m, nil
+		}
+		m.search = &msg
+		return m, nil
+	case sendErrMsg:
+		m.err = msg.err.Error()
+		return m, nil
+	case disconnectedMsg:
+		m.quitting = true
+		return m, tea.Quit
 	case spinner.TickMsg:
 		var cmd tea.Cmd
 		m.spinner, cmd = m.spinner.Update(msg)
 		return m, cmd
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+func (m model) send(control ControlMessage) tea.Cmd {
+	return func() tea.Msg {
+		if m.reader == nil {
+			return nil
+		}
+		if err := m.reader.Send(control); err != nil {
+			return sendErrMsg{err: err}
+		}
+		return nil
+	}
+}
+
+// parseCommand turns what the user typed into a control message.
+func parseCommand(command string) (ControlMessage, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ControlMessage{}, fmt.Errorf("empty command")
+	}
+
+	switch fields[0] {
+	case "/sub":
+		return filterMessage("subscribe", fields[1:]), nil
+	case "/unsub":
+		return filterMessage("unsubscribe", fields[1:]), nil
+	case "/ping":
+		return ControlMessage{Op: "ping"}, nil
 	default:
-		return m, nil
+		return ControlMessage{}, fmt.Errorf("unknown command %q", fields[0])
+	}
+}
+
+// filterMessage builds a subscription change, #words being tags and the
+// rest categories.
+func filterMessage(op string, fields []string) ControlMessage {
+	msg := ControlMessage{Op: op}
+	for _, f := range fields {
+		if tag := strings.TrimPrefix(f, "#"); tag != f {
+			if tag != "" {
+				msg.Tags = append(msg.Tags, tag)
+			}
+			continue
+		}
+		msg.Categories = append(msg.Categories, f)
 	}
+
+	return msg
 }
 
 func (m model) View() string {
@@ -166,6 +487,10 @@ func (m model) View() string {
 		s += res.String() + "\n"
 	}
 
+	if m.search != nil {
+		s += m.search.String() + "\n"
+	}
+
 	if m.quitting {
 		if m.err != "" {
 			s += m.err
@@ -174,7 +499,14 @@ func (m model) View() string {
 		s += "\n"
 	} else {
 		s += m.spinner.View() + " Connected, receiving articles..."
-		s += helpStyle.Render("Press any key to exit")
+		if m.status != "" {
+			s += " " + durationStyle.Render(m.status)
+		}
+		if m.err != "" {
+			s += "\n" + m.err
+		}
+		s += "\n\n" + m.input.View()
+		s += helpStyle.Render("Type /sub or /unsub followed by categories or #tags to change them, /search to look up past articles, Esc to exit")
 	}
 
 	return appStyle.Render(s)
@@ -182,16 +514,20 @@ func (m model) View() string {
 
 var addr = flag.String("addr", "localhost:8080", "http service address")
 var userID = flag.String("user-id", "", "user id")
+var categories = flag.String("categories", "", "comma separated categories to follow, all if empty")
+var tags = flag.String("tags", "", "comma separated tags to follow")
 
 func main() {
 	flag.Parse()
 
-	p := tea.NewProgram(newModel())
+	m := newModel()
+	p := tea.NewProgram(&m)
 
 	reader, err := NewArticleReader(p)
 	if err != nil {
 		log.Fatalf("Error creating article reader: %v", err)
 	}
+	m.reader = reader
 
 	reader.Read()
 